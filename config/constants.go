@@ -41,6 +41,8 @@ type constants struct {
 	TwitchBotQueue    string   `envconfig:"TWITCHBOT_QUEUE" default:"twitchbot" doc:"Name of queue over which RPC calls to Pauling are sent"`
 	FumbleQueue       string   `envconfig:"FUMBLE_QUEUE" default:"fumble" doc:"Name of queue over which RPC calls to Fumble are sent"`
 	RabbitMQQueue     string   `envconfig:"RABBITMQ_QUEUE" default:"events" doc:"Name of queue over which events are sent"`
+	BroadcastExchange string   `envconfig:"BROADCAST_EXCHANGE" default:"helen-broadcasts" doc:"Name of the fanout exchange over which socket broadcasts are sent to all Helen instances"`
+	EventsExchange    string   `envconfig:"EVENTS_EXCHANGE" default:"helen-events" doc:"Name of the topic exchange over which domain events are published for other services"`
 
 	// database
 	DbAddr     string `envconfig:"DATABASE_ADDR" default:"127.0.0.1:5432" doc:"Database Address"`
@@ -59,6 +61,7 @@ type constants struct {
 	HealthChecks       bool     `envconfig:"HEALTH_CHECKS" default:"false" doc:"Enable health checks"`
 	SecureCookies      bool     `envconfig:"SECURE_COOKIE" doc:"Enable 'secure' flag on cookies" default:"false"`
 	FilteredWords      []string `envconfig:"FILTERED_WORDS"`
+	SecretKeys         []string `envconfig:"SECRET_KEYS" doc:"Comma separated id:key pairs (base64 encoded 32 byte keys) for encrypting RCON and server passwords, the first one is used for new passwords"`
 }
 
 var Constants = constants{}
@@ -0,0 +1,63 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package admin
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TF2Stadium/Helen/config"
+	"github.com/TF2Stadium/Helen/models/event"
+	"golang.org/x/net/xsrftoken"
+)
+
+var deadLettersTempl *template.Template
+
+//ViewDeadLetters lists events which couldn't be handled
+func ViewDeadLetters(w http.ResponseWriter, r *http.Request) {
+	err := deadLettersTempl.Execute(w, map[string]interface{}{
+		"XSRFToken": xsrftoken.Generate(config.Constants.CookieStoreSecret, "admin", "POST"),
+		"Events":    event.GetDeadLetterEvents(),
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+//ReplayDeadLetter handles a dead-lettered event again, or discards it
+func ReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	values := r.Form
+
+	token := values.Get("xsrf-token")
+	if !xsrftoken.Valid(token, config.Constants.CookieStoreSecret, "admin", "POST") {
+		http.Error(w, "invalid xsrf token", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.ParseUint(values.Get("id"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid event ID", http.StatusBadRequest)
+		return
+	}
+
+	if values.Get("discard") == "true" {
+		if err := event.Discard(uint(id)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "Event discarded.")
+		return
+	}
+
+	if err := event.Replay(uint(id)); err != nil {
+		http.Error(w, "Couldn't handle event: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Event handled successfully.")
+}
@@ -0,0 +1,100 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package admin
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TF2Stadium/Helen/config"
+	chelpers "github.com/TF2Stadium/Helen/controllers/controllerhelpers"
+	"github.com/TF2Stadium/Helen/helpers"
+	"github.com/TF2Stadium/Helen/models/player"
+	"golang.org/x/net/xsrftoken"
+)
+
+var joinPolicyTempl *template.Template
+
+//roles which can be exempted from the join policy
+var exemptableRoles = []string{"moderator", "administrator", "developer"}
+
+//ViewJoinPolicy shows the site-wide policy for joining lobbies
+func ViewJoinPolicy(w http.ResponseWriter, r *http.Request) {
+	policy := player.GetJoinPolicy()
+
+	type role struct {
+		Name   string
+		Exempt bool
+	}
+	var roles []role
+	for _, name := range exemptableRoles {
+		roles = append(roles, role{name, policy.IsExempt(helpers.RoleMap[name])})
+	}
+
+	err := joinPolicyTempl.Execute(w, map[string]interface{}{
+		"XSRFToken":    xsrftoken.Generate(config.Constants.CookieStoreSecret, "admin", "POST"),
+		"Policy":       policy,
+		"Roles":        roles,
+		"SteamEnabled": config.Constants.SteamDevAPIKey != "",
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+//UpdateJoinPolicy changes the site-wide policy for joining lobbies
+func UpdateJoinPolicy(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	values := r.Form
+
+	token := values.Get("xsrf-token")
+	if !xsrftoken.Valid(token, config.Constants.CookieStoreSecret, "admin", "POST") {
+		http.Error(w, "invalid xsrf token", http.StatusBadRequest)
+		return
+	}
+
+	policy := &player.JoinPolicy{
+		AllowPrivateProfiles: values.Get("allowPrivateProfiles") == "on",
+	}
+	for _, field := range []struct {
+		name  string
+		value *int
+	}{
+		{"minHours", &policy.MinHours},
+		{"minAccountAgeDays", &policy.MinAccountAgeDays},
+		{"staleHours", &policy.StaleHours},
+	} {
+		n, err := strconv.Atoi(values.Get(field.name))
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid value for "+field.name, http.StatusBadRequest)
+			return
+		}
+		*field.value = n
+	}
+
+	var exempt []string
+	for _, name := range values["exemptRoles"] {
+		if _, ok := helpers.RoleMap[name]; !ok {
+			http.Error(w, "Invalid role "+name, http.StatusBadRequest)
+			return
+		}
+		exempt = append(exempt, name)
+	}
+	policy.ExemptRoles = strings.Join(exempt, ",")
+
+	jwt, _ := chelpers.GetToken(r)
+	policy.UpdatedBy = chelpers.GetPlayer(jwt).SteamID
+
+	if err := policy.Save(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "Join policy updated.")
+}
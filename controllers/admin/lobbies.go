@@ -3,11 +3,13 @@ package admin
 import (
 	"html/template"
 	"net/http"
+	"strconv"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/TF2Stadium/Helen/config"
 	db "github.com/TF2Stadium/Helen/database"
 	"github.com/TF2Stadium/Helen/models/lobby"
+	"github.com/TF2Stadium/Helen/models/player"
 )
 
 var lobbiesTempl *template.Template
@@ -23,3 +25,43 @@ func ViewOpenLobbies(w http.ResponseWriter, r *http.Request) {
 		logrus.Error(err)
 	}
 }
+
+var lobbyHistoryTempl *template.Template
+
+type stateHistoryEntry struct {
+	*lobby.LobbyStateTransition
+	Actor *player.Player
+}
+
+//ViewLobbyHistory shows the state transitions of the lobby with the given id
+func ViewLobbyHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid lobby ID", http.StatusBadRequest)
+		return
+	}
+
+	lob, err := lobby.GetLobbyByIDServer(uint(id))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var history []stateHistoryEntry
+	for _, t := range lob.GetStateHistory() {
+		entry := stateHistoryEntry{LobbyStateTransition: t}
+		if t.ActorID != 0 {
+			entry.Actor, _ = player.GetPlayerByID(t.ActorID)
+		}
+		history = append(history, entry)
+	}
+
+	err = lobbyHistoryTempl.Execute(w, map[string]interface{}{
+		"Lobby":       lob,
+		"History":     history,
+		"FrontendURL": config.Constants.LoginRedirectPath,
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package admin
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TF2Stadium/Helen/config"
+	chelpers "github.com/TF2Stadium/Helen/controllers/controllerhelpers"
+	"github.com/TF2Stadium/Helen/models/player"
+	"golang.org/x/net/xsrftoken"
+)
+
+var reliabilityTempl *template.Template
+
+//ViewReliability shows the weights used to compute reliability scores
+func ViewReliability(w http.ResponseWriter, r *http.Request) {
+	err := reliabilityTempl.Execute(w, map[string]interface{}{
+		"XSRFToken": xsrftoken.Generate(config.Constants.CookieStoreSecret, "admin", "POST"),
+		"Config":    player.GetReliabilityConfig(),
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+//UpdateReliability changes the weights used to compute reliability scores
+func UpdateReliability(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	values := r.Form
+
+	token := values.Get("xsrf-token")
+	if !xsrftoken.Valid(token, config.Constants.CookieStoreSecret, "admin", "POST") {
+		http.Error(w, "invalid xsrf token", http.StatusBadRequest)
+		return
+	}
+
+	c := &player.ReliabilityConfig{}
+	for _, field := range []struct {
+		name  string
+		value *float64
+	}{
+		{"prior", &c.Prior},
+		{"completed", &c.Completed},
+		{"subsTaken", &c.SubsTaken},
+		{"subReports", &c.SubReports},
+		{"voteReports", &c.VoteReports},
+		{"rageQuits", &c.RageQuits},
+		{"halfLifeDays", &c.HalfLifeDays},
+	} {
+		f, err := strconv.ParseFloat(values.Get(field.name), 64)
+		if err != nil || f < 0 {
+			http.Error(w, "Invalid value for "+field.name, http.StatusBadRequest)
+			return
+		}
+		*field.value = f
+	}
+
+	jwt, _ := chelpers.GetToken(r)
+	c.UpdatedBy = chelpers.GetPlayer(jwt).SteamID
+
+	if err := c.Save(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "Reliability weights updated.")
+}
@@ -47,14 +47,12 @@ func ChangeRole(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if remove == "true" {
-		player.Role = 0
-		player.Save()
+		player.SetRole(helpers.RolePlayer)
 		fmt.Fprintf(w, "Player %s (%s) has been removed as %s", player.Name, player.SteamID, helpers.RoleNames[role])
 		return
 	}
 
-	player.Role = role
-	player.Save()
+	player.SetRole(role)
 	fmt.Fprintf(w, "Player %s (%s) has been made a %s", player.Name, player.SteamID, helpers.RoleNames[role])
 	return
 }
@@ -73,7 +71,6 @@ func Remove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	player.Role = authority.AuthRole(0)
-	player.Save()
+	player.SetRole(helpers.RolePlayer)
 	fmt.Fprintf(w, "%s (%s) is no longer an admin/mod", player.Name, player.SteamID)
 }
@@ -1,9 +1,14 @@
 package admin
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/TF2Stadium/Helen/config"
@@ -11,7 +16,10 @@ import (
 	"golang.org/x/net/xsrftoken"
 )
 
-var serverPage *template.Template
+var (
+	serverPage         *template.Template
+	serverHistoryTempl *template.Template
+)
 
 func AddServer(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
@@ -47,6 +55,11 @@ func AddServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := setServerSettings(server, values); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "Server successfully added (ID: #%d)", server.ID)
 }
@@ -71,10 +84,102 @@ func RemoveServer(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Server successfully deleted.")
 }
 
+//setServerSettings sets the server's region, tags, priority and maintenance flag from the form
+func setServerSettings(server *gameserver.StoredServer, values url.Values) error {
+	if name := values.Get("name"); name != "" {
+		server.Name = name
+	}
+	if region := values.Get("region"); region != "" {
+		server.Region = strings.ToLower(region)
+	}
+	server.Tags = strings.Replace(values.Get("tags"), " ", "", -1)
+	server.Maintenance = values.Get("maintenance") == "on"
+
+	if priority := values.Get("priority"); priority != "" {
+		var err error
+		if server.Priority, err = strconv.Atoi(priority); err != nil {
+			return errors.New("Invalid priority")
+		}
+	}
+
+	return server.Save()
+}
+
+func UpdateServer(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	values := r.Form
+
+	token := values.Get("xsrf-token")
+	if !xsrftoken.Valid(token, config.Constants.CookieStoreSecret, "admin", "POST") {
+		http.Error(w, "invalid xsrf token", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.ParseUint(values.Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+
+	server, err := gameserver.GetStoredServerByID(uint(id))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := setServerSettings(server, values); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/server/", http.StatusFound)
+}
+
+//serverRow is a stored server with it's uptime, shown on the server page
+type serverRow struct {
+	*gameserver.StoredServer
+	UptimeDay  float64
+	UptimeWeek float64
+}
+
 func ViewServerPage(w http.ResponseWriter, r *http.Request) {
+	var rows []serverRow
+	now := time.Now()
+	for _, server := range gameserver.GetAllStoredServers() {
+		rows = append(rows, serverRow{
+			StoredServer: server,
+			UptimeDay:    server.Uptime(now.Add(-24 * time.Hour)),
+			UptimeWeek:   server.Uptime(now.Add(-7 * 24 * time.Hour)),
+		})
+	}
+
 	err := serverPage.Execute(w, map[string]interface{}{
-		"XSRFToken": xsrftoken.Generate(config.Constants.CookieStoreSecret, "admin", "POST"),
-		"Servers":   gameserver.GetAllStoredServers(),
+		"XSRFToken":          xsrftoken.Generate(config.Constants.CookieStoreSecret, "admin", "POST"),
+		"Servers":            rows,
+		"QuarantineFailures": gameserver.QuarantineFailures,
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+func ViewServerHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+
+	server, err := gameserver.GetStoredServerByID(uint(id))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = serverHistoryTempl.Execute(w, map[string]interface{}{
+		"Server":  server,
+		"History": server.GetUptimeHistory(),
+		"Checks":  server.GetHealthChecks(50),
 	})
 	if err != nil {
 		logrus.Error(err)
@@ -6,8 +6,13 @@ import (
 
 func InitAdminTemplates() {
 	serverPage = template.Must(template.ParseFiles("views/admin/templates/server.html"))
+	serverHistoryTempl = template.Must(template.ParseFiles("views/admin/templates/server_history.html"))
 	banlogsTempl = template.Must(template.ParseFiles("views/admin/templates/ban_logs.html"))
 	chatLogsTempl = template.Must(template.ParseFiles("views/admin/templates/chatlogs.html"))
 	lobbiesTempl = template.Must(template.ParseFiles("views/admin/templates/lobbies.html"))
+	lobbyHistoryTempl = template.Must(template.ParseFiles("views/admin/templates/lobby_history.html"))
+	reliabilityTempl = template.Must(template.ParseFiles("views/admin/templates/reliability.html"))
+	joinPolicyTempl = template.Must(template.ParseFiles("views/admin/templates/join_policy.html"))
+	deadLettersTempl = template.Must(template.ParseFiles("views/admin/templates/dead_letters.html"))
 	adminPageTempl = template.Must(template.ParseFiles("views/admin/index.html"))
 }
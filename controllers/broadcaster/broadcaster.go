@@ -2,33 +2,138 @@
 // Use of this source code is governed by the GPLv3
 // that can be found in the COPYING file.
 
+//Package broadcaster sends messages to players and rooms. Messages are published
+//over a fanout exchange, so that every Helen instance delivers them to the sockets
+//connected to it. When Connect hasn't been called, messages are only delivered
+//to sockets connected to this instance.
 package broadcaster
 
 import (
+	"encoding/json"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TF2Stadium/Helen/config"
 	"github.com/TF2Stadium/Helen/controllers/socket/sessions"
 	"github.com/TF2Stadium/Helen/helpers"
 	"github.com/TF2Stadium/Helen/routes/socket"
 	"github.com/TF2Stadium/wsevent"
+	"github.com/streadway/amqp"
+)
+
+//message is a broadcast sent between instances, either Room or SteamID is set
+type message struct {
+	Room    string          `json:"room,omitempty"`
+	SteamID string          `json:"steamid,omitempty"`
+	Event   string          `json:"event"`
+	Content json.RawMessage `json:"content"`
+}
+
+var (
+	channel *amqp.Channel
+	// replaced in tests
+	deliver = deliverLocal
 )
 
+//Connect declares the broadcast exchange and a queue for this instance on conn,
+//and starts delivering messages published by all instances.
+func Connect(conn *amqp.Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	exchange := config.Constants.BroadcastExchange
+	err = ch.ExchangeDeclare(exchange, "fanout", true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	// server named queue, deleted when this instance disconnects
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return err
+	}
+	if err := ch.QueueBind(q.Name, "", exchange, false, nil); err != nil {
+		return err
+	}
+
+	msgs, err := ch.Consume(q.Name, "", true, true, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	channel = ch
+	go consume(msgs)
+
+	logrus.Info("Receiving broadcasts on exchange ", exchange)
+	return nil
+}
+
+func consume(msgs <-chan amqp.Delivery) {
+	for d := range msgs {
+		var m message
+		if err := json.Unmarshal(d.Body, &m); err != nil {
+			logrus.Error("broadcaster: ", err)
+			continue
+		}
+
+		deliver(m)
+	}
+}
+
+//SendMessage sends the event to all sockets the player with the given steamid has open
 func SendMessage(steamid string, event string, content interface{}) {
-	sockets, ok := sessions.GetSockets(steamid)
-	if !ok {
+	publish(message{SteamID: steamid, Event: event}, content)
+}
+
+//SendMessageToRoom sends the event to all sockets in the room
+func SendMessageToRoom(r string, event string, content interface{}) {
+	publish(message{Room: r, Event: event}, content)
+}
+
+func publish(m message, content interface{}) {
+	var err error
+
+	m.Content, err = json.Marshal(content)
+	if err != nil {
+		logrus.Error("broadcaster: ", err)
 		return
 	}
 
-	for _, socket := range sockets {
-		go func(so *wsevent.Client) {
-			so.EmitJSON(helpers.NewRequest(event, content))
-		}(socket)
+	if channel == nil {
+		deliver(m)
+		return
 	}
 
-	return
+	body, _ := json.Marshal(m)
+	err = channel.Publish(config.Constants.BroadcastExchange, "", false, false, amqp.Publishing{
+		ContentType: "application/json",
+		Body:        body,
+	})
+	if err != nil {
+		// at least reach the sockets on this instance
+		logrus.Error("broadcaster: couldn't publish message: ", err)
+		deliver(m)
+	}
 }
 
-func SendMessageToRoom(r string, event string, content interface{}) {
-	v := helpers.NewRequest(event, content)
+func deliverLocal(m message) {
+	v := helpers.NewRequest(m.Event, m.Content)
 
-	socket.AuthServer.BroadcastJSON(r, v)
-	socket.UnauthServer.BroadcastJSON(r, v)
+	if m.Room != "" {
+		socket.AuthServer.BroadcastJSON(m.Room, v)
+		socket.UnauthServer.BroadcastJSON(m.Room, v)
+		return
+	}
+
+	sockets, ok := sessions.GetSockets(m.SteamID)
+	if !ok {
+		return
+	}
+
+	for _, socket := range sockets {
+		go func(so *wsevent.Client) {
+			so.EmitJSON(v)
+		}(socket)
+	}
 }
@@ -0,0 +1,52 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package broadcaster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TF2Stadium/Helen/config"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroadcast(t *testing.T) {
+	delivered := make(chan message, 1)
+	deliver = func(m message) { delivered <- m }
+	defer func() { deliver = deliverLocal }()
+
+	receive := func() message {
+		select {
+		case m := <-delivered:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("message wasn't delivered")
+		}
+		return message{}
+	}
+
+	// without a connection messages are delivered locally
+	SendMessageToRoom("0_public", "test", map[string]int{"a": 1})
+	m := receive()
+	assert.Equal(t, "0_public", m.Room)
+	assert.Equal(t, "test", m.Event)
+	assert.JSONEq(t, `{"a": 1}`, string(m.Content))
+
+	conn, err := amqp.Dial(config.Constants.RabbitMQURL)
+	if err != nil {
+		t.Skip("RabbitMQ isn't available: ", err)
+	}
+	defer conn.Close()
+
+	assert.NoError(t, Connect(conn))
+	defer func() { channel = nil }()
+
+	SendMessage("76561198000000000", "test", "content")
+	m = receive()
+	assert.Equal(t, "76561198000000000", m.SteamID)
+	assert.Empty(t, m.Room)
+	assert.JSONEq(t, `"content"`, string(m.Content))
+}
@@ -20,6 +20,16 @@ import (
 	"github.com/TF2Stadium/wsevent"
 )
 
+func init() {
+	lobby.RegisterNotInGameFunc("subNotJoined", func(lob *lobby.Lobby, player *player.Player) {
+		// if player doesn't join game server in 5 minutes,
+		// substitute them
+		message := player.Alias() + " has been reported for not joining the game within 5 minutes"
+		chat.SendNotification(message, int(lob.ID))
+		lob.Substitute(player)
+	})
+}
+
 func AfterLobbyJoin(so *wsevent.Client, lob *lobby.Lobby, player *player.Player) {
 	room := fmt.Sprintf("%s_private", GetLobbyRoom(lob.ID))
 	//make all sockets join the private room, given the one the player joined the lobby on
@@ -29,13 +39,7 @@ func AfterLobbyJoin(so *wsevent.Client, lob *lobby.Lobby, player *player.Player)
 		socket.AuthServer.Join(so, room)
 	}
 	if lob.State == lobby.InProgress { // player is a substitute
-		lob.AfterPlayerNotInGameFunc(player, 5*time.Minute, func() {
-			// if player doesn't join game server in 5 minutes,
-			// substitute them
-			message := player.Alias() + " has been reported for not joining the game within 5 minutes"
-			chat.SendNotification(message, int(lob.ID))
-			lob.Substitute(player)
-		})
+		lob.AfterPlayerNotInGameFunc(player, 5*time.Minute, "subNotJoined")
 	}
 
 	broadcaster.SendMessage(player.SteamID, "lobbyJoined", lobby.DecorateLobbyData(lob, false))
@@ -13,6 +13,7 @@ import (
 	"github.com/TF2Stadium/Helen/helpers"
 	"github.com/TF2Stadium/Helen/models/lobby"
 	"github.com/TF2Stadium/Helen/models/player"
+	"github.com/TF2Stadium/Helen/models/timer"
 	"github.com/TF2Stadium/Helen/routes/socket"
 	"github.com/TF2Stadium/wsevent"
 )
@@ -21,6 +22,7 @@ func AfterConnect(server *wsevent.Server, so *wsevent.Client) {
 	server.Join(so, "0_public") //room for global chat
 
 	so.EmitJSON(helpers.NewRequest("lobbyListData", lobby.DecorateLobbyListData(lobby.GetWaitingLobbies(), false)))
+	so.EmitJSON(helpers.NewRequest("upcomingLobbyListData", lobby.DecorateLobbyListData(lobby.GetScheduledLobbies(), false)))
 	chelpers.BroadcastScrollback(so, 0)
 	so.EmitJSON(helpers.NewRequest("subListData", lobby.DecorateSubstituteList()))
 }
@@ -32,6 +34,12 @@ func AfterConnectLoggedIn(so *wsevent.Client, player *player.Player) {
 		player.UpdatePlayerInfo()
 	}
 
+	//used for region rules when the player isn't the one joining a slot (draft picks)
+	if region, _ := helpers.GetRegion(chelpers.GetIPAddr(so.Request)); region != player.Region {
+		player.Region = region
+		db.DB.Model(player).UpdateColumn("region", region)
+	}
+
 	lobbyID, err := player.GetLobbyID(false)
 	if err == nil {
 		lob, _ := lobby.GetLobbyByIDServer(lobbyID)
@@ -64,4 +72,6 @@ func AfterConnectLoggedIn(so *wsevent.Client, player *player.Player) {
 	player.SetPlayerProfile()
 	so.EmitJSON(helpers.NewRequest("playerProfile", player))
 	sessions.AddSocket(player.SteamID, so)
+	//player is back, don't remove them from their lobby
+	timer.StopPlayer("removeDisconnected", player.ID)
 }
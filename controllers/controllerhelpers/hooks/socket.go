@@ -10,9 +10,30 @@ import (
 	chelpers "github.com/TF2Stadium/Helen/controllers/controllerhelpers"
 	"github.com/TF2Stadium/Helen/controllers/socket/sessions"
 	"github.com/TF2Stadium/Helen/models/lobby"
+	"github.com/TF2Stadium/Helen/models/player"
+	"github.com/TF2Stadium/Helen/models/queue"
+	"github.com/TF2Stadium/Helen/models/timer"
 	"github.com/dgrijalva/jwt-go"
 )
 
+func init() {
+	timer.Register("removeDisconnected", removeDisconnected)
+}
+
+//removeDisconnected removes a player who disconnected from the website from the lobby
+//they were in, if they haven't reconnected and the lobby hasn't filled up yet.
+func removeDisconnected(lobbyID, playerID uint) {
+	player, err := player.GetPlayerByID(playerID)
+	if err != nil || sessions.IsConnected(player.SteamID) {
+		return
+	}
+
+	lob, err := lobby.GetLobbyByID(lobbyID)
+	if err == nil && lob.State == lobby.Waiting {
+		lob.RemovePlayer(player)
+	}
+}
+
 //OnDisconnect is connected when a player with a given socketID disconnects
 func OnDisconnect(socketID string, token *jwt.Token) {
 	if token != nil { //player was logged in
@@ -22,6 +43,10 @@ func OnDisconnect(socketID string, token *jwt.Token) {
 		}
 
 		sessions.RemoveSocket(socketID, player.SteamID)
+		if sessions.ConnectedSockets(player.SteamID) == 0 {
+			//players can only be matched while they're online
+			queue.Leave(player)
+		}
 		id, _ := sessions.GetSpectating(socketID)
 		if id != 0 {
 			lob, _ := lobby.GetLobbyByID(id)
@@ -32,12 +57,7 @@ func OnDisconnect(socketID string, token *jwt.Token) {
 		//if player is in a waiting lobby, and hasn't connected for > 30 seconds,
 		//remove him from it. Here, connected = player isn't connected from any tab/window
 		if id != 0 && sessions.ConnectedSockets(player.SteamID) == 0 {
-			sessions.AfterDisconnectedFunc(player.SteamID, time.Second*30, func() {
-				lob, _ := lobby.GetLobbyByID(id)
-				if lob.State == lobby.Waiting {
-					lob.RemovePlayer(player)
-				}
-			})
+			timer.AfterFunc("removeDisconnected", id, player.ID, time.Second*30)
 		}
 	}
 
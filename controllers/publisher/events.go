@@ -0,0 +1,79 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package publisher
+
+import (
+	"time"
+)
+
+//LobbyCreated is published when a new lobby is opened to players, after it's game
+//server has been setup or it has been scheduled
+type LobbyCreated struct {
+	LobbyID   uint   `json:"lobbyId"`
+	Type      string `json:"type"`
+	Map       string `json:"map"`
+	League    string `json:"league"`
+	Region    string `json:"region"`
+	CreatedBy string `json:"createdBy,omitempty"` // steam ID, empty for lobbies created by matchmaking
+}
+
+//PlayerJoinedSlot is published when a player joins a slot, or changes their slot
+type PlayerJoinedSlot struct {
+	LobbyID uint   `json:"lobbyId"`
+	SteamID string `json:"steamId"`
+	Slot    int    `json:"slot"`
+	Team    string `json:"team"`
+	Class   string `json:"class"`
+}
+
+//PlayerLeft is published when a player leaves or is removed from a lobby
+type PlayerLeft struct {
+	LobbyID uint   `json:"lobbyId"`
+	SteamID string `json:"steamId"`
+}
+
+//SubstituteNeeded is published when a player in a lobby needs to be substituted
+type SubstituteNeeded struct {
+	LobbyID uint   `json:"lobbyId"`
+	SteamID string `json:"steamId"` // the player being substituted
+	Team    string `json:"team"`
+	Class   string `json:"class"`
+}
+
+//LobbyStarted is published when all players are ready and the match starts
+type LobbyStarted struct {
+	LobbyID uint `json:"lobbyId"`
+}
+
+//LobbyClosed is published when a lobby ends, or is deleted after it was published
+type LobbyClosed struct {
+	LobbyID    uint   `json:"lobbyId"`
+	Reason     string `json:"reason"`
+	MatchEnded bool   `json:"matchEnded"` // false if the lobby was closed before the match ended
+}
+
+//BanIssued is published when a player is banned, or their ban is extended
+type BanIssued struct {
+	SteamID  string    `json:"steamId"`
+	Type     string    `json:"type"`
+	Until    time.Time `json:"until"`
+	Reason   string    `json:"reason"`
+	BannedBy string    `json:"bannedBy,omitempty"` // steam ID of the admin who set the ban
+}
+
+//RoleChanged is published when a player's role changes
+type RoleChanged struct {
+	SteamID string `json:"steamId"`
+	Role    string `json:"role"`
+}
+
+func (LobbyCreated) EventName() string     { return "lobbyCreated" }
+func (PlayerJoinedSlot) EventName() string { return "playerJoinedSlot" }
+func (PlayerLeft) EventName() string       { return "playerLeft" }
+func (SubstituteNeeded) EventName() string { return "substituteNeeded" }
+func (LobbyStarted) EventName() string     { return "lobbyStarted" }
+func (LobbyClosed) EventName() string      { return "lobbyClosed" }
+func (BanIssued) EventName() string        { return "banIssued" }
+func (RoleChanged) EventName() string      { return "roleChanged" }
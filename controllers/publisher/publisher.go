@@ -0,0 +1,109 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+//Package publisher publishes domain events (like lobbies being created or closed)
+//as JSON over a topic exchange, for other services to subscribe to. Events are
+//published with the routing key "v<version>.<name>", like "v1.lobbyClosed".
+//When Connect hasn't been called, events are dropped.
+package publisher
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TF2Stadium/Helen/config"
+	"github.com/streadway/amqp"
+)
+
+//Version is the version of the event schema. It's only increased when fields
+//are removed or change their meaning, new fields can be added to the same version.
+const Version = 1
+
+//DomainEvent is the data of an event
+type DomainEvent interface {
+	EventName() string
+}
+
+//Envelope is the message published for each event
+type Envelope struct {
+	ID        string      `json:"id"`
+	Name      string      `json:"name"`
+	Version   int         `json:"version"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      DomainEvent `json:"data"`
+}
+
+var (
+	channel *amqp.Channel
+	// replaced in tests
+	send = sendAMQP
+)
+
+//Connect declares the events exchange on conn, events are published over it after this
+func Connect(conn *amqp.Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	err = ch.ExchangeDeclare(config.Constants.EventsExchange, "topic", true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	channel = ch
+	logrus.Info("Publishing events on exchange ", config.Constants.EventsExchange)
+	return nil
+}
+
+//RoutingKey returns the routing key events with the given name are published with
+func RoutingKey(name string) string {
+	return fmt.Sprintf("v%d.%s", Version, name)
+}
+
+func newID() string {
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+//Publish publishes the event. Errors are only logged, so that
+//events not being published never stops anything else from working.
+func Publish(event DomainEvent) {
+	send(Envelope{
+		ID:        newID(),
+		Name:      event.EventName(),
+		Version:   Version,
+		Timestamp: time.Now(),
+		Data:      event,
+	})
+}
+
+func sendAMQP(e Envelope) {
+	if channel == nil {
+		return
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		logrus.Error("publisher: ", err)
+		return
+	}
+
+	err = channel.Publish(config.Constants.EventsExchange, RoutingKey(e.Name), false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    e.ID,
+		Timestamp:    e.Timestamp,
+		Type:         e.Name,
+		Body:         body,
+	})
+	if err != nil {
+		logrus.Errorf("publisher: couldn't publish %s: %s", e.Name, err.Error())
+	}
+}
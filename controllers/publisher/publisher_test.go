@@ -0,0 +1,61 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package publisher
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/TF2Stadium/Helen/config"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublish(t *testing.T) {
+	sent := make(chan Envelope, 1)
+	send = func(e Envelope) { sent <- e }
+	Publish(LobbyClosed{LobbyID: 1, Reason: "match ended", MatchEnded: true})
+	send = sendAMQP
+
+	e := <-sent
+	assert.Equal(t, "lobbyClosed", e.Name)
+	assert.Equal(t, Version, e.Version)
+	assert.NotEmpty(t, e.ID)
+	assert.Equal(t, "v1.lobbyClosed", RoutingKey(e.Name))
+
+	conn, err := amqp.Dial(config.Constants.RabbitMQURL)
+	if err != nil {
+		t.Skip("RabbitMQ isn't available: ", err)
+	}
+	defer conn.Close()
+
+	assert.NoError(t, Connect(conn))
+	defer func() { channel = nil }()
+
+	ch, err := conn.Channel()
+	assert.NoError(t, err)
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, ch.QueueBind(q.Name, "v1.#", config.Constants.EventsExchange, false, nil))
+	msgs, err := ch.Consume(q.Name, "", true, true, false, false, nil)
+	assert.NoError(t, err)
+
+	Publish(RoleChanged{SteamID: "76561198000000000", Role: "moderator"})
+	select {
+	case d := <-msgs:
+		assert.Equal(t, "v1.roleChanged", d.RoutingKey)
+
+		var received struct {
+			Name string
+			Data RoleChanged
+		}
+		assert.NoError(t, json.Unmarshal(d.Body, &received))
+		assert.Equal(t, "roleChanged", received.Name)
+		assert.Equal(t, "moderator", received.Data.Role)
+	case <-time.After(5 * time.Second):
+		t.Fatal("event wasn't published")
+	}
+}
@@ -69,9 +69,38 @@ func (Chat) ChatSend(so *wsevent.Client, args struct {
 	message.Save()
 	message.Send()
 
+	if *args.Room > 0 {
+		lob, err := lobby.GetLobbyByID(uint(*args.Room))
+		if err == nil {
+			lob.RelayChat(p, *args.Message)
+		}
+	}
+
 	return emptySuccess
 }
 
+func (Chat) ChatRelay(so *wsevent.Client, args struct {
+	Room    *uint `json:"room"`
+	Enabled *bool `json:"enabled"`
+}) interface{} {
+	p := chelpers.GetPlayer(so.Token)
+	lob, err := lobby.GetLobbyByID(*args.Room)
+	if err != nil {
+		return err
+	}
+
+	var count int
+	db.DB.Model(&lobby.LobbySlot{}).Where("lobby_id = ? AND player_id = ?", lob.ID, p.ID).Count(&count)
+	if count == 0 && !p.IsSpectatingID(lob.ID) {
+		return errors.New("Player is not in the lobby.")
+	}
+
+	lob.SetChatRelay(p.ID, *args.Enabled)
+	return newResponse(struct {
+		Enabled bool `json:"enabled"`
+	}{lob.ChatRelayEnabled(p.ID)})
+}
+
 func (Chat) ChatDelete(so *wsevent.Client, args struct {
 	ID   *int  `json:"id"`
 	Room *uint `json:"room"`
@@ -15,21 +15,25 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/TF2Stadium/Helen/config"
 	"github.com/TF2Stadium/Helen/controllers/broadcaster"
 	chelpers "github.com/TF2Stadium/Helen/controllers/controllerhelpers"
 	"github.com/TF2Stadium/Helen/controllers/controllerhelpers/hooks"
 	db "github.com/TF2Stadium/Helen/database"
 	"github.com/TF2Stadium/Helen/helpers"
+	"github.com/TF2Stadium/Helen/helpers/secret"
 	"github.com/TF2Stadium/Helen/models/chat"
 	"github.com/TF2Stadium/Helen/models/gameserver"
 	"github.com/TF2Stadium/Helen/models/lobby"
 	"github.com/TF2Stadium/Helen/models/lobby/format"
 	"github.com/TF2Stadium/Helen/models/player"
+	"github.com/TF2Stadium/Helen/models/queue"
 	"github.com/TF2Stadium/Helen/models/rpc"
+	"github.com/TF2Stadium/Helen/models/timer"
 	"github.com/TF2Stadium/Helen/routes/socket"
+	"github.com/TF2Stadium/Helen/routes/socket/middleware"
 	"github.com/TF2Stadium/servemetf"
 	"github.com/TF2Stadium/wsevent"
+	"github.com/jinzhu/gorm"
 )
 
 type Lobby struct{}
@@ -41,16 +45,19 @@ func (Lobby) Name(s string) string {
 var (
 	reSteamGroup = regexp.MustCompile(`steamcommunity\.com\/groups\/(.+)`)
 	reServer     = regexp.MustCompile(`\w+\:\d+`)
-	playermap    = map[string]format.Format{
-		"debug":      format.Debug,
-		"6s":         format.Sixes,
-		"highlander": format.Highlander,
-		"ultiduo":    format.Ultiduo,
-		"bball":      format.Bball,
-		"4v4":        format.Fours,
-	}
 )
 
+func init() {
+	// lobby formats are loaded from the lobby settings file
+	middleware.RegisterValidator("format", format.IsValidName)
+	timer.Register("readyUpTimeout", readyUpTimeout)
+	lobby.OnDraftPick(afterDraftPick)
+	lobby.OnScheduledOpen(func(lob *lobby.Lobby) {
+		//players might have filled the lobby while it was scheduled
+		readyUpIfFull(lob, 0)
+	})
+}
+
 type Restriction struct {
 	Red bool `json:"red,omitempty"`
 	Blu bool `json:"blu,omitempty"`
@@ -58,6 +65,8 @@ type Restriction struct {
 type Requirement struct {
 	Hours      int         `json:"hours"`
 	Lobbies    int         `json:"lobbies"`
+	MinRating  int         `json:"minRating"`
+	MaxRating  int         `json:"maxRating"`
 	Restricted Restriction `json:"restricted"`
 }
 
@@ -73,10 +82,12 @@ func newRequirement(team, class string, requirement Requirement, lob *lobby.Lobb
 		return err
 	}
 	slotReq := &lobby.Requirement{
-		LobbyID: lob.ID,
-		Slot:    slot,
-		Hours:   int(requirement.Hours),
-		Lobbies: int(requirement.Lobbies),
+		LobbyID:   lob.ID,
+		Slot:      slot,
+		Hours:     int(requirement.Hours),
+		Lobbies:   int(requirement.Lobbies),
+		MinRating: requirement.MinRating,
+		MaxRating: requirement.MaxRating,
 	}
 	slotReq.Save()
 
@@ -88,11 +99,12 @@ func isTwitchChannelValid(name string) bool {
 	return err == nil && resp.StatusCode != 404
 }
 
-func (Lobby) LobbyCreate(so *wsevent.Client, args struct {
+//lobbyCreateArgs are the arguments for LobbyCreate, also saved in lobby presets
+type lobbyCreateArgs struct {
 	Map         *string        `json:"map"`
-	Type        *string        `json:"type" valid:"debug,6s,highlander,4v4,ultiduo,bball"`
+	Type        *string        `json:"type" valid:"@format"`
 	League      *string        `json:"league" valid:"ugc,etf2l,esea,asiafortress,ozfortress,bballtf"`
-	ServerType  *string        `json:"serverType" valid:"server,storedServer,serveme"`
+	ServerType  *string        `json:"serverType" valid:"server,storedServer,serveme,auto"`
 	Serveme     *servemeServer `json:"serveme" empty:"-"`
 	Server      *string        `json:"server" empty:"-"`
 	RconPwd     *string        `json:"rconpwd" empty:"-"`
@@ -101,18 +113,30 @@ func (Lobby) LobbyCreate(so *wsevent.Client, args struct {
 
 	Password            *string `json:"password" empty:"-"`
 	SteamGroupWhitelist *string `json:"steamGroupWhitelist" empty:"-"`
+	// region to pick a server in for the "auto" server type,
+	// the creator's region if empty
+	ServerRegion *string `json:"serverRegion" empty:"-"`
 	// restrict lobby slots to twitch subs for a particular channel
 	// not a pointer, since it is set to false when the argument json
 	// string doesn't have the field
 	TwitchWhitelistSubscribers bool `json:"twitchWhitelistSubs"`
 	TwitchWhitelistFollowers   bool `json:"twitchWhitelistFollows"`
 	RegionLock                 bool `json:"regionLock"`
+	// balance teams by player rating when the lobby fills up
+	AutoBalance bool `json:"autoBalance"`
+	// players sign up, and are picked by two captains
+	Draft bool `json:"draft"`
+	// (Unix) time at which the lobby opens, 0 to open it right away.
+	// Players can join slots before that, but the lobby doesn't ready up.
+	StartsAt int64 `json:"startsAt"`
 
 	Requirements *struct {
 		Classes map[string]Requirement `json:"classes,omitempty"`
 		General Requirement            `json:"general,omitempty"`
 	} `json:"requirements" empty:"-"`
-}) interface{} {
+}
+
+func (Lobby) LobbyCreate(so *wsevent.Client, args lobbyCreateArgs) interface{} {
 
 	p := chelpers.GetPlayer(so.Token)
 	if banned, until := p.IsBannedWithTime(player.BanCreate); banned {
@@ -126,9 +150,28 @@ func (Lobby) LobbyCreate(so *wsevent.Client, args struct {
 		}
 	}
 
+	if args.Draft && args.AutoBalance {
+		return errors.New("Teams in draft lobbies are picked by the captains, they can't be balanced.")
+	}
+
+	scheduled := args.StartsAt != 0
+	startsAt := time.Unix(args.StartsAt, 0)
+	if scheduled && (startsAt.Before(time.Now()) || startsAt.Sub(time.Now()) > lobby.MaxScheduleAhead) {
+		return lobby.ErrStartTime
+	}
+
 	var steamGroup string
-	var context *servemetf.Context
-	var reservation servemetf.Reservation
+	job := &lobbyCreateJob{
+		creator:  p,
+		provider: *args.ServerType,
+		request: gameserver.ServerRequest{
+			SteamID: p.SteamID,
+			IPAddr:  chelpers.GetIPAddr(so.Request),
+		},
+	}
+	if scheduled {
+		job.startsAt = startsAt
+	}
 
 	if *args.SteamGroupWhitelist != "" {
 		if reSteamGroup.MatchString(*args.SteamGroupWhitelist) {
@@ -138,7 +181,10 @@ func (Lobby) LobbyCreate(so *wsevent.Client, args struct {
 		}
 	}
 
-	if *args.ServerType == "serveme" {
+	//the server is acquired by the job, after the lobby has been created (or
+	//when it opens, for scheduled lobbies which don't use serveme)
+	switch *args.ServerType {
+	case gameserver.ProviderServeme:
 		if args.Serveme == nil {
 			return errors.New("No serveme info given.")
 		}
@@ -151,75 +197,64 @@ func (Lobby) LobbyCreate(so *wsevent.Client, args struct {
 		if end, err = time.Parse(servemetf.TimeFormat, (*args.Serveme).EndsAt); err != nil {
 			return err
 		}
+		if scheduled && (start.After(startsAt) || !end.After(startsAt)) {
+			return errors.New("The serveme reservation has to be running when the lobby starts.")
+		}
 
 		randBytes := make([]byte, 6)
 		rand.Read(randBytes)
-		*args.RconPwd = base64.URLEncoding.EncodeToString(randBytes)
 
-		reservation = servemetf.Reservation{
+		job.request.Reservation = servemetf.Reservation{
 			StartsAt:    start.Format(servemetf.TimeFormat),
 			EndsAt:      end.Format(servemetf.TimeFormat),
 			ServerID:    (*args.Serveme).Server.ID,
 			WhitelistID: 1,
-			RCON:        *args.RconPwd,
+			RCON:        base64.URLEncoding.EncodeToString(randBytes),
 			Password:    "foobar",
 		}
-
-		context = helpers.GetServemeContextIP(chelpers.GetIPAddr(so.Request))
-		resp, err := context.Create(reservation, so.Token.Claims["steam_id"].(string))
-		if err != nil || resp.Reservation.Errors != nil {
-			if err != nil {
-				logrus.Error(err)
-			} else {
-				logrus.Error(resp.Reservation.Errors)
-			}
-
-			return errors.New("Couldn't get serveme reservation")
-		}
-
-		*args.Server = resp.Reservation.Server.IPAndPort
-		reservation = resp.Reservation
-	} else if *args.ServerType == "storedServer" {
-		if *args.Server == "" {
+	case gameserver.ProviderStored:
+		if args.Server == nil || *args.Server == "" {
 			return errors.New("No server ID given")
 		}
-
 		id, err := strconv.ParseUint(*args.Server, 10, 64)
 		if err != nil {
 			return err
 		}
-		server, err := gameserver.GetStoredServer(uint(id))
-		if err != nil {
-			return err
+		job.request.StoredServerID = uint(id)
+	case "auto":
+		//the best free stored server in the region is picked
+		job.provider = gameserver.ProviderStored
+		if args.ServerRegion != nil && *args.ServerRegion != "" {
+			job.request.Region = *args.ServerRegion
+		} else {
+			job.request.Region, _ = helpers.GetRegion(job.request.IPAddr)
 		}
-		*args.Server = server.Address
-		*args.RconPwd = server.RCONPassword
-	} else { // *args.ServerType == "server"
+		lobbyType, _ := format.GetByName(*args.Type)
+		job.request.Tags = lobbyType.Names()
+	case gameserver.ProviderRcon:
 		if args.RconPwd == nil || *args.RconPwd == "" {
 			return errors.New("RCON Password cannot be empty")
 		}
 		if args.Server == nil || *args.Server == "" {
 			return errors.New("Server Address cannot be empty")
 		}
-	}
-
-	var count int
 
-	lobbyType := playermap[*args.Type]
-	db.DB.Model(&gameserver.ServerRecord{}).Where("host = ?", *args.Server).Count(&count)
-	if count != 0 {
-		return errors.New("A lobby is already using this server.")
+		var count int
+		db.DB.Model(&gameserver.ServerRecord{}).Where("host = ?", *args.Server).Count(&count)
+		if count != 0 {
+			return errors.New("A lobby is already using this server.")
+		}
+		job.request.Address = *args.Server
+		job.request.RconPassword = *args.RconPwd
 	}
 
+	lobbyType, _ := format.GetByName(*args.Type)
 	randBytes := make([]byte, 6)
 	rand.Read(randBytes)
 	serverPwd := base64.URLEncoding.EncodeToString(randBytes)
 
-	//TODO what if playermap[lobbytype] is nil?
 	info := gameserver.ServerRecord{
-		Host:           *args.Server,
-		RconPassword:   *args.RconPwd,
-		ServerPassword: serverPwd,
+		ServerPassword: secret.String(serverPwd),
 	}
 
 	lob := lobby.NewLobby(*args.Map, lobbyType, *args.League, info, *args.WhitelistID, *args.Mumble, steamGroup)
@@ -238,70 +273,15 @@ func (Lobby) LobbyCreate(so *wsevent.Client, args struct {
 	}
 
 	lob.RegionLock = args.RegionLock
+	lob.AutoBalance = args.AutoBalance
+	lob.Draft = args.Draft
 	lob.CreatedBySteamID = p.SteamID
-	lob.RegionCode, lob.RegionName = helpers.GetRegion(*args.Server)
-	if (lob.RegionCode == "" || lob.RegionName == "") && config.Constants.GeoIP {
-		if reservation.ID != 0 {
-			err := context.Delete(reservation.ID, p.SteamID)
-			for err != nil {
-				err = context.Delete(reservation.ID, p.SteamID)
-			}
-		} else if *args.ServerType == "storedServer" {
-			gameserver.PutStoredServer(*args.Server)
-		}
-
-		return errors.New("Couldn't find the region for this server.")
-	}
-
-	if lobby.MapRegionFormatExists(lob.MapName, lob.RegionCode, lob.Type) {
-		if reservation.ID != 0 {
-			err := context.Delete(reservation.ID, p.SteamID)
-			for err != nil {
-				err = context.Delete(reservation.ID, p.SteamID)
-			}
-		} else if *args.ServerType == "storedServer" {
-			gameserver.PutStoredServer(*args.Server)
-		}
-
-		return errors.New("Your region already has a lobby with this map and format.")
-	}
-
-	if *args.ServerType == "serveme" {
-		lob.ServemeID = reservation.ID
-	}
-
-	lob.Save()
-	lob.CreateLock()
-
-	if *args.ServerType == "serveme" {
-		now := time.Now()
-
-		for {
-			status, err := context.Status(reservation.ID, p.SteamID)
-			if err != nil {
-				logrus.Error(err)
-			}
-			if status == "ready" {
-				break
-			}
-
-			time.Sleep(10 * time.Second)
-			if time.Since(now) >= 3*time.Minute {
-				lob.Delete()
-				return errors.New("Couldn't get Serveme reservation, try another server.")
-			}
-		}
 
-		lob.ServemeCheck(context)
-	}
-
-	err := lob.SetupServer()
-	if err != nil { //lobby setup failed, delete lobby and corresponding server record
-		lob.Delete()
+	//players can only have one lobby being created at a time
+	if err := lob.CreateUnique(); err != nil {
 		return err
 	}
-
-	lob.SetState(lobby.Waiting)
+	job.lob = lob
 
 	if args.Requirements != nil {
 		for class, requirement := range (*args.Requirements).Classes {
@@ -312,13 +292,16 @@ func (Lobby) LobbyCreate(so *wsevent.Client, args struct {
 				newRequirement("red", class, requirement, lob)
 			}
 		}
-		if args.Requirements.General.Hours != 0 || args.Requirements.General.Lobbies != 0 {
-			for i := 0; i < 2*format.NumberOfClassesMap[lob.Type]; i++ {
+		general := args.Requirements.General
+		if general.Hours != 0 || general.Lobbies != 0 || general.MinRating != 0 || general.MaxRating != 0 {
+			for i := 0; i < format.NumberOfSlots(lob.Type); i++ {
 				req := &lobby.Requirement{
-					LobbyID: lob.ID,
-					Hours:   args.Requirements.General.Hours,
-					Lobbies: args.Requirements.General.Lobbies,
-					Slot:    i,
+					LobbyID:   lob.ID,
+					Hours:     general.Hours,
+					Lobbies:   general.Lobbies,
+					MinRating: general.MinRating,
+					MaxRating: general.MaxRating,
+					Slot:      i,
 				}
 				req.Save()
 			}
@@ -327,7 +310,7 @@ func (Lobby) LobbyCreate(so *wsevent.Client, args struct {
 	}
 
 	if *args.Password != "" {
-		for i := 0; i < 2*format.NumberOfClassesMap[lob.Type]; i++ {
+		for i := 0; i < format.NumberOfSlots(lob.Type); i++ {
 			req := &lobby.Requirement{
 				LobbyID:  lob.ID,
 				Slot:     i,
@@ -337,15 +320,44 @@ func (Lobby) LobbyCreate(so *wsevent.Client, args struct {
 		}
 	}
 
-	chat.NewBotMessage(fmt.Sprintf("Lobby created by %s", p.Alias()), int(lob.ID)).Send()
+	//the lobby is Initializing till the job is done, progress is sent
+	//to the player with lobbyCreateProgress events
+	go job.run()
 
-	lobby.BroadcastLobbyList()
 	return newResponse(
 		struct {
 			ID uint `json:"id"`
 		}{lob.ID})
 }
 
+func (Lobby) LobbyRematch(so *wsevent.Client, args struct {
+	Id *uint `json:"id"` // ID of the lobby which ended
+	// if true, players are reserved a slot on the other team
+	Swap bool `json:"swap"`
+}) interface{} {
+
+	p := chelpers.GetPlayer(so.Token)
+	lob, err := lobby.GetLobbyByIDServer(*args.Id)
+	if err != nil {
+		return err
+	}
+
+	if lob.CreatedBySteamID != p.SteamID {
+		return errors.New("Only the lobby leader can start a rematch.")
+	}
+
+	rematch, err := lob.Rematch(p.ID, args.Swap)
+	if err != nil {
+		return err
+	}
+
+	chat.NewBotMessage(fmt.Sprintf("Rematch of lobby #%d started by %s", lob.ID, p.Alias()), int(rematch.ID)).Send()
+	return newResponse(
+		struct {
+			ID uint `json:"id"`
+		}{rematch.ID})
+}
+
 func (Lobby) LobbyServerReset(so *wsevent.Client, args struct {
 	ID *uint `json:"id"`
 }) interface{} {
@@ -389,14 +401,17 @@ func (Lobby) ServerVerify(so *wsevent.Client, args struct {
 		return errors.New("A lobby is already using this server.")
 	}
 
+	//the record keeps other lobbies from using the server while it's being
+	//verified, the RCON password is only sent to Pauling and isn't saved
 	info := &gameserver.ServerRecord{
-		Host:         *args.Server,
-		RconPassword: *args.Rconpwd,
+		Host: *args.Server,
 	}
 	db.DB.Save(info)
 	defer db.DB.Delete(info)
 
-	err := rpc.VerifyInfo(*info)
+	verify := *info
+	verify.RconPassword = secret.String(*args.Rconpwd)
+	err := rpc.VerifyInfo(verify)
 	if err != nil {
 		return err
 	}
@@ -423,7 +438,7 @@ func (Lobby) LobbyClose(so *wsevent.Client, args struct {
 		return errors.New("Lobby already closed.")
 	}
 
-	lob.Close(true, false)
+	lob.Close(true, false, "closed by "+player.Alias(), player.ID)
 
 	notify := fmt.Sprintf("Lobby closed by %s", player.Alias())
 	chat.SendNotification(notify, int(lob.ID))
@@ -465,13 +480,8 @@ func (Lobby) LobbyJoin(so *wsevent.Client, args struct {
 	if lob.State == lobby.Initializing {
 		return errors.New("Lobby is being setup right now.")
 	}
-
-	if lob.RegionLock {
-		region, _ := helpers.GetRegion(chelpers.GetIPAddr(so.Request))
-		if region != lob.RegionCode {
-			return errors.New("This lobby is region locked.")
-		}
-	}
+	//region rules are checked against where the player is connecting from right now
+	p.Region, _ = helpers.GetRegion(chelpers.GetIPAddr(so.Request))
 
 	//Check if player is in the same lobby
 	var sameLobby bool
@@ -484,6 +494,11 @@ func (Lobby) LobbyJoin(so *wsevent.Client, args struct {
 		return tperr
 	}
 
+	//only substitutes, and players from the previous lobby in a rematch, can join draft lobbies directly
+	if lob.Draft && lob.State != lobby.InProgress && !lob.IsSlotReservedFor(slot, p.ID) {
+		return errors.New("Players are picked by the captains in this lobby, sign up instead.")
+	}
+
 	if prevId, _ := p.GetLobbyID(false); prevId != 0 && !sameLobby {
 		lob, _ := lobby.GetLobbyByID(prevId)
 		hooks.AfterLobbyLeave(lob, p, false, false)
@@ -497,45 +512,14 @@ func (Lobby) LobbyJoin(so *wsevent.Client, args struct {
 
 	if !sameLobby {
 		hooks.AfterLobbyJoin(so, lob, p)
+		//players who pick a slot themselves don't need to be matched anymore
+		if _, err := queue.GetEntry(p); err == nil {
+			queue.Leave(p)
+			queue.BroadcastStatus(p)
+		}
 	}
 
-	//check if lobby isn't already in progress (which happens when the player is subbing)
-	lob.Lock()
-	if lob.IsFull() && lob.State != lobby.InProgress && lob.State != lobby.ReadyingUp {
-		lob.State = lobby.ReadyingUp
-		lob.ReadyUpTimestamp = time.Now().Unix() + 30
-		lob.Save()
-
-		helpers.GlobalWait.Add(1)
-		time.AfterFunc(time.Second*30, func() {
-			state := lob.CurrentState()
-			//if all player's haven't readied up,
-			//remove unreadied players and unready the
-			//rest.
-			//don't do this when:
-			//  lobby.State == Waiting (someone already unreadied up, so all players have been unreadied)
-			// lobby.State == InProgress (all players have readied up, so the lobby has started)
-			// lobby.State == Ended (the lobby has been closed)
-			if state != lobby.Waiting && state != lobby.InProgress && state != lobby.Ended {
-				lob.SetState(lobby.Waiting)
-				removeUnreadyPlayers(lob)
-				lob.UnreadyAllPlayers()
-				//get updated lobby object
-				lob, _ = lobby.GetLobbyByID(lob.ID)
-				lobby.BroadcastLobby(lob)
-			}
-			helpers.GlobalWait.Done()
-		})
-
-		room := fmt.Sprintf("%s_private",
-			hooks.GetLobbyRoom(lob.ID))
-		broadcaster.SendMessageToRoom(room, "lobbyReadyUp",
-			struct {
-				Timeout int `json:"timeout"`
-			}{30})
-		lobby.BroadcastLobbyList()
-	}
-	lob.Unlock()
+	readyUpIfFull(lob, p.ID)
 
 	if lob.State == lobby.InProgress { //this happens when the player is a substitute
 		db.DB.Preload("ServerInfo").First(lob, lob.ID)
@@ -545,6 +529,65 @@ func (Lobby) LobbyJoin(so *wsevent.Client, args struct {
 	return emptySuccess
 }
 
+//readyUpIfFull starts the ready up phase for the lobby if all of it's slots have been filled.
+//Lobbies which are already in progress (which happens when the player is subbing) are left untouched.
+//actorID is the player who filled the last slot (0 for the matchmaking queue and the draft).
+func readyUpIfFull(lob *lobby.Lobby, actorID uint) {
+	var full bool
+	//the lock makes sure no one leaves the lobby while it's being checked.
+	//SetState fails if the lobby isn't waiting for players anymore.
+	lob.WithLock(func(_ *gorm.DB) error {
+		full = lob.IsFull() && lob.SetState(lobby.ReadyingUp, "lobby full", actorID) == nil
+		return nil
+	})
+	if !full {
+		return
+	}
+
+	if lob.AutoBalance {
+		//players keep their class, but might change teams
+		lob.Balance()
+	}
+
+	lob.ReadyUpTimestamp = time.Now().Unix() + 30
+	lob.Save()
+
+	if err := timer.AfterFunc("readyUpTimeout", lob.ID, 0, time.Second*30); err != nil {
+		logrus.Error(err)
+	}
+
+	room := fmt.Sprintf("%s_private",
+		hooks.GetLobbyRoom(lob.ID))
+	broadcaster.SendMessageToRoom(room, "lobbyReadyUp",
+		struct {
+			Timeout int `json:"timeout"`
+		}{30})
+	lobby.BroadcastLobbyList()
+}
+
+//readyUpTimeout is called 30 seconds after a lobby starts readying up.
+//If all player's haven't readied up, removes unreadied players and unreadies the rest.
+func readyUpTimeout(lobbyID, _ uint) {
+	lob, err := lobby.GetLobbyByID(lobbyID)
+	if err != nil {
+		return
+	}
+
+	//the transition fails when the lobby isn't readying up anymore:
+	//  lobby.State == Waiting (someone already unreadied up, so all players have been unreadied)
+	// lobby.State == InProgress (all players have readied up, so the lobby has started)
+	// lobby.State == Ended (the lobby has been closed)
+	if err := lob.SetState(lobby.Waiting, "ready up timed out", 0); err != nil {
+		return
+	}
+
+	removeUnreadyPlayers(lob)
+	lob.UnreadyAllPlayers()
+	//get updated lobby object
+	lob, _ = lobby.GetLobbyByID(lob.ID)
+	lobby.BroadcastLobby(lob)
+}
+
 //get list of unready players, remove them from lobby (and add them as spectators)
 //plus, call the after lobby leave hook for each player removed
 func removeUnreadyPlayers(lobby *lobby.Lobby) {
@@ -556,6 +599,91 @@ func removeUnreadyPlayers(lobby *lobby.Lobby) {
 	}
 }
 
+func (Lobby) LobbyDraftSignup(so *wsevent.Client, args struct {
+	Id      *uint    `json:"id"`
+	Classes []string `json:"classes"`
+	Captain bool     `json:"captain"`
+	// remove the player's sign up instead
+	Withdraw bool `json:"withdraw"`
+}) interface{} {
+
+	p := chelpers.GetPlayer(so.Token)
+	lob, err := lobby.GetLobbyByID(*args.Id)
+	if err != nil {
+		return err
+	}
+
+	if args.Withdraw {
+		if err := lob.WithdrawSignup(p); err != nil {
+			return err
+		}
+		return emptySuccess
+	}
+
+	if banned, until := p.IsBannedWithTime(player.BanJoin); banned {
+		ban, _ := p.GetActiveBan(player.BanJoin)
+		return fmt.Errorf("You have been banned from joining lobbies till %s (%s)", until.Format(time.RFC822), ban.Reason)
+	}
+	if lob.Mumble {
+		if banned, until := p.IsBannedWithTime(player.BanJoinMumble); banned {
+			ban, _ := p.GetActiveBan(player.BanJoinMumble)
+			return fmt.Errorf("You have been banned from joining Mumble lobbies till %s (%s)", until.Format(time.RFC822), ban.Reason)
+		}
+	}
+	//players have to meet the rules applying to all slots to sign up,
+	//slot specific rules are checked when they're picked
+	p.Region, _ = helpers.GetRegion(chelpers.GetIPAddr(so.Request))
+	if err := lob.CheckRules(p, -1, lob.Rules(-1)); err != nil {
+		return err
+	}
+
+	if err := lob.SignUp(p, args.Classes, args.Captain); err != nil {
+		return err
+	}
+
+	return emptySuccess
+}
+
+func (Lobby) LobbyDraftPick(so *wsevent.Client, args struct {
+	Id      *uint   `json:"id"`
+	SteamID *string `json:"steamid"`
+	Class   *string `json:"class"`
+}) interface{} {
+
+	captain := chelpers.GetPlayer(so.Token)
+	lob, err := lobby.GetLobbyByID(*args.Id)
+	if err != nil {
+		return err
+	}
+
+	if lob.State != lobby.Drafting {
+		return errors.New("Players aren't being picked in this lobby right now.")
+	}
+
+	p, err := player.GetPlayerBySteamID(*args.SteamID)
+	if err != nil {
+		return err
+	}
+
+	if err := lob.DraftPick(captain, p, *args.Class); err != nil {
+		return err
+	}
+
+	chat.NewBotMessage(fmt.Sprintf("%s picked %s", captain.Alias(), p.Alias()), int(lob.ID)).Send()
+	return emptySuccess
+}
+
+//afterDraftPick is called after a player has been put in a slot by the draft
+func afterDraftPick(lob *lobby.Lobby, p *player.Player) {
+	hooks.AfterLobbyJoin(nil, lob, p)
+	if _, err := queue.GetEntry(p); err == nil {
+		queue.Leave(p)
+		queue.BroadcastStatus(p)
+	}
+
+	readyUpIfFull(lob, 0)
+}
+
 func (Lobby) LobbySpectatorJoin(so *wsevent.Client, args struct {
 	Id *uint `json:"id"`
 }) interface{} {
@@ -744,6 +872,7 @@ func (Lobby) LobbySpectatorLeave(so *wsevent.Client, args struct {
 
 func (Lobby) RequestLobbyListData(so *wsevent.Client, _ struct{}) interface{} {
 	so.EmitJSON(helpers.NewRequest("lobbyListData", lobby.DecorateLobbyListData(lobby.GetWaitingLobbies(), false)))
+	so.EmitJSON(helpers.NewRequest("upcomingLobbyListData", lobby.DecorateLobbyListData(lobby.GetScheduledLobbies(), false)))
 
 	return emptySuccess
 }
@@ -797,7 +926,7 @@ func (Lobby) LobbySetRequirement(so *wsevent.Client, args struct {
 		return errors.New("Only lobby owners can change requirements.")
 	}
 
-	if !(*args.Slot >= 0 && *args.Slot < 2*format.NumberOfClassesMap[lob.Type]) {
+	if !(*args.Slot >= 0 && *args.Slot < format.NumberOfSlots(lob.Type)) {
 		return errors.New("Invalid slot.")
 	}
 
@@ -820,6 +949,12 @@ func (Lobby) LobbySetRequirement(so *wsevent.Client, args struct {
 	case "reliability":
 		f, err = args.Value.Float64()
 		req.Reliability = f
+	case "minRating":
+		n, err = args.Value.Int64()
+		req.MinRating = int(n)
+	case "maxRating":
+		n, err = args.Value.Int64()
+		req.MaxRating = int(n)
 	case "password":
 		req.Password = *args.Password
 	default:
@@ -837,6 +972,56 @@ func (Lobby) LobbySetRequirement(so *wsevent.Client, args struct {
 	return emptySuccess
 }
 
+func (Lobby) LobbyAddRule(so *wsevent.Client, args struct {
+	ID *uint `json:"id"` // lobby ID
+
+	Slot   *int            `json:"slot"` // -1 if for all slots
+	Type   *string         `json:"type"`
+	Params json.RawMessage `json:"params"`
+}) interface{} {
+
+	lob, err := lobby.GetLobbyByID(*args.ID)
+	if err != nil {
+		return err
+	}
+
+	player := chelpers.GetPlayer(so.Token)
+	if lob.CreatedBySteamID != player.SteamID {
+		return errors.New("Only lobby owners can change requirements.")
+	}
+
+	rule, err := lob.AddRule(*args.Slot, *args.Type, args.Params)
+	if err != nil {
+		return err
+	}
+
+	lobby.BroadcastLobby(lob)
+	return newResponse(rule)
+}
+
+func (Lobby) LobbyRemoveRule(so *wsevent.Client, args struct {
+	ID     *uint `json:"id"` // lobby ID
+	RuleID *uint `json:"ruleId"`
+}) interface{} {
+
+	lob, err := lobby.GetLobbyByID(*args.ID)
+	if err != nil {
+		return err
+	}
+
+	player := chelpers.GetPlayer(so.Token)
+	if lob.CreatedBySteamID != player.SteamID {
+		return errors.New("Only lobby owners can change requirements.")
+	}
+
+	if err := lob.RemoveRule(*args.RuleID); err != nil {
+		return err
+	}
+
+	lobby.BroadcastLobby(lob)
+	return emptySuccess
+}
+
 func (Lobby) LobbyRemoveTwitchRestriction(so *wsevent.Client, args struct {
 	ID uint `json:"id"`
 }) interface{} {
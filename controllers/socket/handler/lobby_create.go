@@ -0,0 +1,169 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TF2Stadium/Helen/config"
+	"github.com/TF2Stadium/Helen/controllers/broadcaster"
+	db "github.com/TF2Stadium/Helen/database"
+	"github.com/TF2Stadium/Helen/helpers"
+	"github.com/TF2Stadium/Helen/models/chat"
+	"github.com/TF2Stadium/Helen/models/gameserver"
+	"github.com/TF2Stadium/Helen/models/lobby"
+	"github.com/TF2Stadium/Helen/models/player"
+)
+
+//steps sent in lobbyCreateProgress events
+const (
+	createReservingServer   = "reservingServer"
+	createWaitingForServeme = "waitingForServeme"
+	createConfiguringServer = "configuringServer"
+	createReady             = "ready"
+	createFailed            = "failed"
+)
+
+//servemeTimeout is how long a new lobby waits for it's serveme reservation to be ready
+const servemeTimeout = 3 * time.Minute
+
+//lobbyCreateJob sets up the game server for a lobby created with LobbyCreate in the
+//background, while the lobby is Initializing. Progress is sent to the lobby's creator.
+type lobbyCreateJob struct {
+	lob     *lobby.Lobby
+	creator *player.Player
+
+	provider string // name of the provider to get the server from
+	request  gameserver.ServerRequest
+	startsAt time.Time // zero for lobbies which aren't scheduled
+}
+
+func (job *lobbyCreateJob) progress(step string, err error) {
+	var reason string
+	if err != nil {
+		reason = err.Error()
+	}
+
+	broadcaster.SendMessage(job.creator.SteamID, "lobbyCreateProgress", struct {
+		ID     uint   `json:"id"`
+		Step   string `json:"step"`
+		Reason string `json:"reason,omitempty"` // why creating the lobby failed
+	}{job.lob.ID, step, reason})
+}
+
+//run sets up the lobby, deleting it (and releasing it's server) if that fails
+func (job *lobbyCreateJob) run() {
+	if err := job.setup(); err != nil {
+		logrus.Warningf("Couldn't create lobby %d: %s", job.lob.ID, err.Error())
+		job.lob.Delete()
+		job.progress(createFailed, err)
+		return
+	}
+
+	job.progress(createReady, nil)
+	chat.NewBotMessage(fmt.Sprintf("Lobby created by %s", job.creator.Alias()), int(job.lob.ID)).Send()
+
+	if !job.startsAt.IsZero() {
+		lobby.BroadcastUpcomingLobbyList()
+	} else {
+		lobby.BroadcastLobbyList()
+	}
+}
+
+func (job *lobbyCreateJob) setup() error {
+	job.progress(createReservingServer, nil)
+	if !job.startsAt.IsZero() && job.provider != gameserver.ProviderServeme {
+		//only serveme reservations are made in advance, other servers
+		//are acquired when the lobby opens
+		if err := job.lob.SetPendingServer(job.provider, job.request); err != nil {
+			return err
+		}
+		return job.lob.Schedule(job.startsAt, job.creator.ID)
+	}
+
+	if err := job.reserveServer(); err != nil {
+		return err
+	}
+
+	if !job.startsAt.IsZero() {
+		//the server is setup when the lobby opens
+		return job.lob.Schedule(job.startsAt, job.creator.ID)
+	}
+
+	if status, _ := job.lob.ServerStatus(); status != gameserver.StatusReady {
+		job.progress(createWaitingForServeme, nil)
+		if err := job.waitForServer(); err != nil {
+			return err
+		}
+	}
+
+	job.progress(createConfiguringServer, nil)
+	if err := job.lob.SetupServer(); err != nil {
+		return err
+	}
+
+	return job.lob.SetState(lobby.Waiting, "server setup", job.creator.ID)
+}
+
+//reserveServer gets the server for the lobby from it's provider, and saves it with the
+//lobby so that it's released by lobby.Delete if creating the lobby fails after this.
+func (job *lobbyCreateJob) reserveServer() error {
+	provider, err := gameserver.GetProvider(job.provider)
+	if err != nil {
+		return err
+	}
+	server, err := provider.Acquire(job.request)
+	if err != nil {
+		return err
+	}
+
+	info := &job.lob.ServerInfo
+	job.lob.SetServer(job.provider, server)
+	job.lob.RegionCode, job.lob.RegionName = provider.Region(server)
+	//saved before checking the server, so that it's released with the lobby if it can't be used
+	db.DB.Save(info)
+	job.lob.Save()
+
+	var count int
+	db.DB.Model(&gameserver.ServerRecord{}).Where("host = ? AND id <> ?", info.Host, info.ID).Count(&count)
+	if count != 0 {
+		return errors.New("A lobby is already using this server.")
+	}
+
+	if (job.lob.RegionCode == "" || job.lob.RegionName == "") && config.Constants.GeoIP {
+		return errors.New("Couldn't find the region for this server.")
+	}
+	if lobby.MapRegionFormatExists(job.lob.MapName, job.lob.RegionCode, job.lob.Type) {
+		return errors.New("Your region already has a lobby with this map and format.")
+	}
+
+	return nil
+}
+
+//waitForServer polls the status of the lobby's server with increasing
+//delays, till it's ready or servemeTimeout has passed
+func (job *lobbyCreateJob) waitForServer() error {
+	deadline := time.Now().Add(servemeTimeout)
+	backoff := &helpers.Backoff{Initial: 2 * time.Second, Max: 20 * time.Second}
+
+	for {
+		status, err := job.lob.ServerStatus()
+		if err != nil {
+			logrus.Error(err)
+		}
+		if status == gameserver.StatusReady {
+			return nil
+		}
+
+		wait := backoff.Next()
+		if status == gameserver.StatusEnded || time.Now().Add(wait).After(deadline) {
+			return errors.New("Couldn't get Serveme reservation, try another server.")
+		}
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package handler
+
+import (
+	"encoding/json"
+
+	chelpers "github.com/TF2Stadium/Helen/controllers/controllerhelpers"
+	"github.com/TF2Stadium/Helen/models/lobby"
+	"github.com/TF2Stadium/Helen/routes/socket/middleware"
+	"github.com/TF2Stadium/wsevent"
+)
+
+//LobbyPresetSave saves the given LobbyCreate arguments as a preset, replacing the
+//preset with the same name if it exists. Arguments are only checked to be of the
+//right type, missing ones can be given when creating the lobby. The RCON password,
+//serveme reservation and start time aren't saved.
+func (Lobby) LobbyPresetSave(so *wsevent.Client, args struct {
+	Name *string         `json:"name"`
+	Args json.RawMessage `json:"args"`
+}) interface{} {
+
+	if err := json.Unmarshal(args.Args, &lobbyCreateArgs{}); err != nil {
+		return lobby.ErrPresetArgs
+	}
+
+	p := chelpers.GetPlayer(so.Token)
+	preset, err := lobby.SavePreset(p.ID, *args.Name, args.Args)
+	if err != nil {
+		return err
+	}
+
+	return newResponse(preset)
+}
+
+func (Lobby) LobbyPresetList(so *wsevent.Client, _ struct{}) interface{} {
+	p := chelpers.GetPlayer(so.Token)
+	presets := lobby.GetPresets(p.ID)
+	if presets == nil {
+		presets = []*lobby.LobbyPreset{}
+	}
+
+	return newResponse(presets)
+}
+
+func (Lobby) LobbyPresetDelete(so *wsevent.Client, args struct {
+	ID *uint `json:"id"`
+}) interface{} {
+
+	p := chelpers.GetPlayer(so.Token)
+	preset, err := lobby.GetPreset(p.ID, *args.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := preset.Delete(); err != nil {
+		return err
+	}
+	return emptySuccess
+}
+
+//LobbyCreateFromPreset creates a lobby with the arguments saved in a preset,
+//fields in override replace the ones in the preset.
+func (Lobby) LobbyCreateFromPreset(so *wsevent.Client, args struct {
+	ID       *uint           `json:"id"`
+	Override json.RawMessage `json:"override"`
+}) interface{} {
+
+	p := chelpers.GetPlayer(so.Token)
+	preset, err := lobby.GetPreset(p.ID, *args.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := preset.Merge(args.Override)
+	if err != nil {
+		return err
+	}
+
+	//checked the same way as arguments sent to LobbyCreate
+	var createArgs lobbyCreateArgs
+	if err := (middleware.JSONCodec{}).Unmarshal(data, &createArgs); err != nil {
+		return err
+	}
+
+	return Lobby{}.LobbyCreate(so, createArgs)
+}
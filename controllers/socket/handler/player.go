@@ -83,7 +83,7 @@ func (Player) PlayerNotReady(so *wsevent.Client, _ struct{}) interface{} {
 		return tperr
 	}
 
-	lob.SetState(lobby.Waiting)
+	lob.SetState(lobby.Waiting, "player unreadied", player.ID)
 	lob.UnreadyAllPlayers()
 	lobby.BroadcastLobby(lob)
 	return emptySuccess
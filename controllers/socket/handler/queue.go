@@ -0,0 +1,155 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package handler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TF2Stadium/Helen/controllers/broadcaster"
+	chelpers "github.com/TF2Stadium/Helen/controllers/controllerhelpers"
+	"github.com/TF2Stadium/Helen/controllers/controllerhelpers/hooks"
+	"github.com/TF2Stadium/Helen/controllers/socket/sessions"
+	"github.com/TF2Stadium/Helen/helpers"
+	"github.com/TF2Stadium/Helen/models/lobby"
+	"github.com/TF2Stadium/Helen/models/lobby/format"
+	"github.com/TF2Stadium/Helen/models/player"
+	"github.com/TF2Stadium/Helen/models/queue"
+	"github.com/TF2Stadium/wsevent"
+)
+
+type Queue struct{}
+
+func (Queue) Name(s string) string {
+	return string((s[0])+32) + s[1:]
+}
+
+func (Queue) QueueJoin(so *wsevent.Client, args struct {
+	Type    *string   `json:"type" valid:"@format"`
+	Region  *string   `json:"region" empty:"-"`
+	Classes *[]string `json:"classes"`
+}) interface{} {
+	p := chelpers.GetPlayer(so.Token)
+
+	region := *args.Region
+	if region == "" {
+		// default to the region the player is connecting from
+		region, _ = helpers.GetRegion(chelpers.GetIPAddr(so.Request))
+	}
+
+	f, _ := format.GetByName(*args.Type)
+	entry, err := queue.Join(p, f, region, *args.Classes)
+	if err != nil {
+		return err
+	}
+
+	queue.BroadcastBucket(queue.Bucket{Format: entry.Format, Region: entry.Region})
+	TriggerMatch()
+	return newResponse(queue.DecorateStatus(entry))
+}
+
+func (Queue) QueueLeave(so *wsevent.Client, _ struct{}) interface{} {
+	p := chelpers.GetPlayer(so.Token)
+
+	entry, err := queue.GetEntry(p)
+	if err != nil {
+		return err
+	}
+
+	queue.Leave(p)
+	queue.BroadcastStatus(p)
+	queue.BroadcastBucket(queue.Bucket{Format: entry.Format, Region: entry.Region})
+	return emptySuccess
+}
+
+func (Queue) QueueStatus(so *wsevent.Client, _ struct{}) interface{} {
+	p := chelpers.GetPlayer(so.Token)
+
+	entry, err := queue.GetEntry(p)
+	if err != nil {
+		return newResponse(queue.Status{})
+	}
+
+	return newResponse(queue.DecorateStatus(entry))
+}
+
+var (
+	matchMu      = new(sync.Mutex)
+	matchTrigger = make(chan struct{}, 1)
+)
+
+//TriggerMatch makes the matcher run as soon as possible
+func TriggerMatch() {
+	select {
+	case matchTrigger <- struct{}{}:
+	default: // a run is already pending
+	}
+}
+
+//RunMatcher matches queued players to lobbies every 10 seconds, or when TriggerMatch is called.
+func RunMatcher() {
+	ticker := time.NewTicker(10 * time.Second)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-matchTrigger:
+		}
+
+		matchQueue()
+	}
+}
+
+func isConnected(p *player.Player) bool {
+	return sessions.IsConnected(p.SteamID)
+}
+
+func matchQueue() {
+	created := make(map[queue.Bucket]*queue.NewLobby)
+
+	matchMu.Lock()
+	for _, bucket := range queue.GetBuckets() {
+		placements, newLobby := queue.Match(bucket.Format, bucket.Region, isConnected)
+		if newLobby != nil {
+			created[bucket] = newLobby
+		}
+		if len(placements) == 0 && newLobby == nil {
+			continue
+		}
+
+		notifyPlacements(placements)
+		queue.BroadcastBucket(bucket)
+	}
+	matchMu.Unlock()
+
+	//setting up servers takes a while, the matcher isn't held up by it
+	for bucket, newLobby := range created {
+		placements, err := newLobby.Setup()
+		if err != nil {
+			logrus.Warningf("queue: couldn't set up lobby %d: %s", newLobby.Lobby.ID, err.Error())
+			//the players are back in the queue
+			queue.BroadcastBucket(bucket)
+			continue
+		}
+
+		notifyPlacements(placements)
+	}
+}
+
+//notifyPlacements tells players they've been put in a lobby by the matcher,
+//and starts ready up in the lobbies which are full now
+func notifyPlacements(placements []queue.Placement) {
+	lobbies := make(map[uint]*lobby.Lobby)
+	for _, pl := range placements {
+		hooks.AfterLobbyJoin(nil, pl.Lobby, pl.Player)
+		broadcaster.SendMessage(pl.Player.SteamID, "queueStatus", queue.DecoratePlacement(pl))
+		lobbies[pl.Lobby.ID] = pl.Lobby
+	}
+
+	for _, lob := range lobbies {
+		readyUpIfFull(lob, 0)
+	}
+}
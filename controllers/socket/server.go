@@ -18,6 +18,7 @@ func RegisterHandlers() {
 	socket.AuthServer.Register(handler.Chat{})   //Chat Handlers
 	socket.AuthServer.Register(handler.Serveme{})
 	socket.AuthServer.Register(handler.Mumble{})
+	socket.AuthServer.Register(handler.Queue{})
 
 	socket.UnauthServer.Register(handler.Unauth{})
 }
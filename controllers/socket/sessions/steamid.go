@@ -5,7 +5,6 @@ package sessions
 
 import (
 	"sync"
-	"time"
 
 	"github.com/TF2Stadium/wsevent"
 )
@@ -14,8 +13,6 @@ var (
 	socketsMu        = new(sync.RWMutex)
 	steamIDSockets   = make(map[string][]*wsevent.Client) //steamid -> client array, since players can have multiple tabs open
 	socketSpectating = make(map[string]uint)              //socketid -> id of lobby the socket is spectating
-	connectedMu      = new(sync.Mutex)
-	connectedTimer   = make(map[string](*time.Timer))
 )
 
 //AddSocket adds so to the list of sockets connected from steamid
@@ -24,15 +21,6 @@ func AddSocket(steamid string, so *wsevent.Client) {
 	defer socketsMu.Unlock()
 
 	steamIDSockets[steamid] = append(steamIDSockets[steamid], so)
-	if len(steamIDSockets[steamid]) == 1 {
-		connectedMu.Lock()
-		timer, ok := connectedTimer[steamid]
-		if ok {
-			timer.Stop()
-			delete(connectedTimer, steamid)
-		}
-		connectedMu.Unlock()
-	}
 }
 
 //RemoveSocket removes so from the list of sockets connected from steamid
@@ -81,19 +69,3 @@ func ConnectedSockets(steamid string) int {
 
 	return l
 }
-
-//AfterDisconnectedFunc waits the duration to elapse, and if the player with the given
-//steamid is still disconnected, calls f in it's own goroutine.
-func AfterDisconnectedFunc(steamid string, d time.Duration, f func()) {
-	connectedMu.Lock()
-	connectedTimer[steamid] = time.AfterFunc(d, func() {
-		if !IsConnected(steamid) {
-			f()
-		}
-
-		connectedMu.Lock()
-		delete(connectedTimer, steamid)
-		connectedMu.Unlock()
-	})
-	connectedMu.Unlock()
-}
@@ -13,9 +13,12 @@ import (
 	"github.com/TF2Stadium/Helen/database"
 	"github.com/TF2Stadium/Helen/models"
 	"github.com/TF2Stadium/Helen/models/chat"
+	"github.com/TF2Stadium/Helen/models/event"
 	"github.com/TF2Stadium/Helen/models/gameserver"
 	"github.com/TF2Stadium/Helen/models/lobby"
 	"github.com/TF2Stadium/Helen/models/player"
+	"github.com/TF2Stadium/Helen/models/queue"
+	"github.com/TF2Stadium/Helen/models/timer"
 	"github.com/gchaincl/dotsql"
 )
 
@@ -38,6 +41,27 @@ func Do() {
 	database.DB.AutoMigrate(&Constant{})
 	database.DB.AutoMigrate(&gameserver.StoredServer{})
 	database.DB.AutoMigrate(&player.Report{})
+	database.DB.AutoMigrate(&queue.QueueEntry{})
+	database.DB.AutoMigrate(&lobby.LobbyStateTransition{})
+	database.DB.AutoMigrate(&timer.Timer{})
+	database.DB.AutoMigrate(&player.PlayerRating{})
+	database.DB.Model(&player.PlayerRating{}).AddUniqueIndex("idx_player_rating_player_id_format_class", "player_id", "format", "class")
+	database.DB.AutoMigrate(&lobby.DraftSignup{})
+	database.DB.AutoMigrate(&player.ReliabilityConfig{})
+	database.DB.AutoMigrate(&lobby.SlotRule{})
+	database.DB.AutoMigrate(&player.JoinPolicy{})
+	database.DB.AutoMigrate(&lobby.LobbyPreset{})
+	database.DB.AutoMigrate(&lobby.SlotReservation{})
+	database.DB.AutoMigrate(&gameserver.ServerHealthCheck{})
+	database.DB.AutoMigrate(&lobby.StaleReservation{})
+	database.DB.AutoMigrate(&lobby.ChatRelay{})
+	database.DB.AutoMigrate(&event.DeadLetterEvent{})
+	database.DB.AutoMigrate(&event.ProcessedEvent{})
+	database.DB.AutoMigrate(&lobby.PendingServer{})
+	database.DB.Model(&event.ProcessedEvent{}).AddIndex("idx_processed_event_lobby_id_steam_id", "lobby_id", "steam_id")
+	database.DB.Model(&lobby.DraftSignup{}).AddUniqueIndex("idx_draft_signup_lobby_id_player_id", "lobby_id", "player_id")
+	database.DB.Model(&lobby.LobbyPreset{}).AddUniqueIndex("idx_lobby_preset_player_id_name", "player_id", "name")
+	database.DB.Model(&lobby.ChatRelay{}).AddUniqueIndex("idx_chat_relay_lobby_id_player_id", "lobby_id", "player_id")
 
 	once.Do(func() {
 		checkSchema()
@@ -10,6 +10,7 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	db "github.com/TF2Stadium/Helen/database"
+	"github.com/TF2Stadium/Helen/models/gameserver"
 	"github.com/TF2Stadium/Helen/models/lobby"
 	"github.com/TF2Stadium/Helen/models/lobby/format"
 	"github.com/TF2Stadium/Helen/models/player"
@@ -30,6 +31,7 @@ var migrationRoutines = map[uint64]func(){
 	11: dropColumnUpdatedAt,
 	12: moveReportsServers,
 	13: dropUnusedColumns,
+	14: encryptServerPasswords,
 }
 
 func whitelist_id_string() {
@@ -191,3 +193,12 @@ func dropUnusedColumns() {
 	db.DB.Model(&lobby.Lobby{}).DropColumn("slot_password")
 	db.DB.Model(&player.Player{}).DropColumn("debug")
 }
+
+func encryptServerPasswords() {
+	//encrypted passwords can be longer than 255 characters
+	db.DB.Exec("ALTER TABLE stored_servers ALTER COLUMN rcon_password TYPE text")
+	db.DB.Exec("ALTER TABLE server_records ALTER COLUMN rcon_password TYPE text")
+	db.DB.Exec("ALTER TABLE server_records ALTER COLUMN server_password TYPE text")
+
+	gameserver.EncryptPasswords()
+}
@@ -37,7 +37,10 @@ const (
 	ActionViewLogs
 	ActionViewPage //view admin pages
 	ActionDeleteChat
-	ModifyServers //add/remove servers
+	ModifyServers     //add/remove servers
+	ModifyReliability //change the weights used for reliability scores
+	ModifyJoinPolicy  //change the site-wide policy for joining lobbies
+	ReplayEvents      //replay events which couldn't be handled
 )
 
 var ActionNames = map[authority.AuthAction]string{
@@ -59,7 +62,10 @@ func init() {
 	RoleMod.Allow(ActionViewPage)
 	RoleMod.Allow(ActionDeleteChat)
 	RoleMod.Allow(ModifyServers)
+	RoleMod.Allow(ModifyReliability)
 
 	RoleAdmin.Inherit(RoleMod)
 	RoleAdmin.Allow(ActionChangeRole)
+	RoleAdmin.Allow(ModifyJoinPolicy)
+	RoleAdmin.Allow(ReplayEvents)
 }
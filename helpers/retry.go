@@ -0,0 +1,29 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package helpers
+
+import (
+	"time"
+)
+
+//Backoff gives exponentially increasing delays between attempts,
+//starting at Initial and doubling each time, up to Max
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+
+	current time.Duration
+}
+
+//Next returns how long to wait before the next attempt
+func (b *Backoff) Next() time.Duration {
+	if b.current == 0 {
+		b.current = b.Initial
+	} else if b.current *= 2; b.current > b.Max {
+		b.current = b.Max
+	}
+
+	return b.current
+}
@@ -0,0 +1,253 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+//Package secret encrypts values saved in the database (like RCON passwords).
+//
+//Each value is encrypted with AES-GCM using a random data key, which is itself
+//encrypted with a key from the config (the key encryption key) and stored with
+//the value. Rotating keys only needs the data keys to be encrypted again with
+//the new key. Values are stored as "enc:v1:<key id>:<encrypted data key>:<encrypted value>".
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TF2Stadium/Helen/config"
+)
+
+const prefix = "enc:v1:"
+
+var (
+	ErrInvalidKey   = errors.New("secret: keys have to be given as id:key, with a base64 encoded 32 byte key")
+	ErrUnknownKey   = errors.New("secret: value was encrypted with an unknown key")
+	ErrInvalidValue = errors.New("secret: invalid encrypted value")
+)
+
+var (
+	keys      map[string]cipher.AEAD
+	currentID string // ID of the key used to encrypt new values, empty if encryption is disabled
+	keysMu    = new(sync.RWMutex)
+)
+
+func init() {
+	if len(config.Constants.SecretKeys) == 0 {
+		logrus.Warning("No secret keys given, RCON and server passwords are saved unencrypted")
+		return
+	}
+
+	if err := SetKeys(config.Constants.SecretKeys); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+//SetKeys sets the keys used to encrypt and decrypt values. Each key is given
+//as "id:base64 encoded key", the first key is used to encrypt new values, while
+//the others are only used to decrypt values encrypted before the keys were rotated.
+func SetKeys(list []string) error {
+	newKeys := make(map[string]cipher.AEAD)
+	var newCurrent string
+
+	for i, key := range list {
+		parts := strings.SplitN(key, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return ErrInvalidKey
+		}
+
+		data, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(data) != 32 {
+			return ErrInvalidKey
+		}
+		aead, err := newAEAD(data)
+		if err != nil {
+			return err
+		}
+
+		newKeys[parts[0]] = aead
+		if i == 0 {
+			newCurrent = parts[0]
+		}
+	}
+
+	keysMu.Lock()
+	keys, currentID = newKeys, newCurrent
+	keysMu.Unlock()
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext []byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return aead.Seal(nonce, nonce, plaintext, nil)
+}
+
+func open(aead cipher.AEAD, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, ErrInvalidValue
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+}
+
+//IsEncrypted returns true if the stored value is encrypted
+func IsEncrypted(stored string) bool {
+	return strings.HasPrefix(stored, prefix)
+}
+
+//Encrypt encrypts value with the current key. If no keys are set,
+//or value is empty, it's returned as it is.
+func Encrypt(value string) (string, error) {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+
+	if currentID == "" || value == "" {
+		return value, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s%s:%s:%s", prefix, currentID,
+		base64.StdEncoding.EncodeToString(seal(keys[currentID], dataKey)),
+		base64.StdEncoding.EncodeToString(seal(aead, []byte(value)))), nil
+}
+
+//parse splits an encrypted value into the key ID, and the decrypted data key and encrypted value
+func parse(stored string) (id string, dataKey []byte, value []byte, err error) {
+	parts := strings.Split(strings.TrimPrefix(stored, prefix), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, ErrInvalidValue
+	}
+
+	kek, ok := keys[parts[0]]
+	if !ok {
+		return "", nil, nil, ErrUnknownKey
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, nil, ErrInvalidValue
+	}
+	if value, err = base64.StdEncoding.DecodeString(parts[2]); err != nil {
+		return "", nil, nil, ErrInvalidValue
+	}
+	if dataKey, err = open(kek, wrapped); err != nil {
+		return "", nil, nil, ErrInvalidValue
+	}
+
+	return parts[0], dataKey, value, nil
+}
+
+//Decrypt returns the value of an encrypted value. Values which
+//aren't encrypted (saved before keys were set) are returned as they are.
+func Decrypt(stored string) (string, error) {
+	if !IsEncrypted(stored) {
+		return stored, nil
+	}
+
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+
+	_, dataKey, value, err := parse(stored)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(aead, value)
+	if err != nil {
+		return "", ErrInvalidValue
+	}
+	return string(plaintext), nil
+}
+
+//NeedsUpdate returns true if the stored value isn't encrypted,
+//or was encrypted with a key other than the current one
+func NeedsUpdate(stored string) bool {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+
+	if currentID == "" || stored == "" {
+		return false
+	}
+	return !strings.HasPrefix(stored, prefix+currentID+":")
+}
+
+//Update encrypts a stored value which isn't encrypted with the current key. For values encrypted
+//with an older key, only the data key is encrypted again, the value itself isn't changed.
+func Update(stored string) (string, error) {
+	if !IsEncrypted(stored) {
+		return Encrypt(stored)
+	}
+
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+
+	if currentID == "" {
+		return stored, nil
+	}
+	_, dataKey, value, err := parse(stored)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s%s:%s:%s", prefix, currentID,
+		base64.StdEncoding.EncodeToString(seal(keys[currentID], dataKey)),
+		base64.StdEncoding.EncodeToString(value)), nil
+}
+
+//String is a string which is encrypted when it's saved to the database,
+//and decrypted when it's read.
+type String string
+
+//Value encrypts the string
+func (s String) Value() (driver.Value, error) {
+	return Encrypt(string(s))
+}
+
+//Scan decrypts the value read from the database
+func (s *String) Scan(src interface{}) error {
+	var stored string
+	switch v := src.(type) {
+	case string:
+		stored = v
+	case []byte:
+		stored = string(v)
+	case nil:
+		stored = ""
+	default:
+		return fmt.Errorf("secret: can't scan %T into String", src)
+	}
+
+	value, err := Decrypt(stored)
+	if err != nil {
+		return err
+	}
+	*s = String(value)
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package secret_test
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	. "github.com/TF2Stadium/Helen/helpers/secret"
+	"github.com/stretchr/testify/assert"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+func TestSecret(t *testing.T) {
+	defer SetKeys(nil)
+
+	//values aren't encrypted without keys
+	stored, err := Encrypt("rcon")
+	assert.NoError(t, err)
+	assert.Equal(t, "rcon", stored)
+	assert.False(t, NeedsUpdate(stored))
+
+	assert.Equal(t, ErrInvalidKey, SetKeys([]string{"old:tooshort"}))
+	assert.NoError(t, SetKeys([]string{"old:" + testKey('a')}))
+	assert.True(t, NeedsUpdate("rcon"))
+
+	old, err := Encrypt("rcon")
+	assert.NoError(t, err)
+	assert.True(t, IsEncrypted(old))
+	assert.NotContains(t, old, "rcon")
+	value, err := Decrypt(old)
+	assert.NoError(t, err)
+	assert.Equal(t, "rcon", value)
+
+	//unencrypted values are read as they are
+	value, err = Decrypt("plain")
+	assert.NoError(t, err)
+	assert.Equal(t, "plain", value)
+
+	//rotate keys
+	assert.NoError(t, SetKeys([]string{"new:" + testKey('b'), "old:" + testKey('a')}))
+	assert.True(t, NeedsUpdate(old))
+	updated, err := Update(old)
+	assert.NoError(t, err)
+	assert.False(t, NeedsUpdate(updated))
+	value, err = Decrypt(updated)
+	assert.NoError(t, err)
+	assert.Equal(t, "rcon", value)
+
+	//the old key isn't needed anymore
+	assert.NoError(t, SetKeys([]string{"new:" + testKey('b')}))
+	_, err = Decrypt(old)
+	assert.Equal(t, ErrUnknownKey, err)
+
+	var s String
+	assert.NoError(t, s.Scan([]byte(updated)))
+	assert.Equal(t, String("rcon"), s)
+}
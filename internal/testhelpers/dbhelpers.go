@@ -12,6 +12,7 @@ import (
 	"github.com/TF2Stadium/Helen/database"
 	"github.com/TF2Stadium/Helen/database/migrations"
 	_ "github.com/TF2Stadium/Helen/helpers/authority"
+	"github.com/TF2Stadium/Helen/models/lobby"
 )
 
 var cleaningMutex sync.Mutex
@@ -39,22 +40,41 @@ func CleanupDB() {
 
 		database.Init()
 		migrations.Do()
+
+		// lobby formats are registered from the lobby settings
+		lobby.LoadLobbySettingsFromFile("assets/lobbySettingsData.json")
 	})
 
 	tables := []string{
 		"admin_log_entries",
 		"banned_players_lobbies",
 		"chat_messages",
+		"chat_relays",
+		"dead_letter_events",
+		"draft_signups",
+		"join_policies",
 		"lobbies",
+		"lobby_presets",
 		"lobby_slots",
+		"lobby_state_transitions",
+		"pending_servers",
 		"player_bans",
+		"player_ratings",
 		"player_stats",
 		"players",
+		"processed_events",
+		"queue_entries",
+		"reliability_configs",
 		"reports",
 		"requirements",
+		"server_health_checks",
 		"server_records",
+		"slot_reservations",
+		"slot_rules",
 		"spectators_players_lobbies",
+		"stale_reservations",
 		"stored_servers",
+		"timers",
 	}
 	for _, table := range tables {
 		database.DB.Exec("TRUNCATE TABLE " + table + " RESTART IDENTITY")
@@ -0,0 +1,105 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package testhelpers
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/TF2Stadium/Helen/models/gameserver"
+)
+
+//FakeProvider is a gameserver.ServerProvider for tests. It hands out servers without
+//contacting anything, and records which servers have been released.
+type FakeProvider struct {
+	RegionCode string
+	RegionName string
+
+	mu         sync.Mutex
+	err        error
+	releaseErr error
+	state      gameserver.ServerStatus
+	count      int
+	released   map[string]bool
+}
+
+//NewFakeProvider returns a provider whose servers have the given status
+func NewFakeProvider(state gameserver.ServerStatus) *FakeProvider {
+	return &FakeProvider{state: state, released: make(map[string]bool)}
+}
+
+//SetState sets the status returned by Status
+func (f *FakeProvider) SetState(state gameserver.ServerStatus) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.state = state
+}
+
+//SetErr sets the error returned by Acquire, nil to hand out servers again
+func (f *FakeProvider) SetErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.err = err
+}
+
+//SetReleaseErr sets the error returned by Release, nil to release servers again
+func (f *FakeProvider) SetReleaseErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.releaseErr = err
+}
+
+//Acquire returns a server with req.Address as it's host, or a new address if it's empty
+func (f *FakeProvider) Acquire(req gameserver.ServerRequest) (*gameserver.Server, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	f.count++
+	server := &gameserver.Server{
+		Host:          req.Address,
+		RconPassword:  req.RconPassword,
+		ReservationID: f.count,
+		SteamID:       req.SteamID,
+	}
+	if server.Host == "" {
+		server.Host = fmt.Sprintf("fake%d:27015", f.count)
+	}
+	return server, nil
+}
+
+func (f *FakeProvider) Release(server *gameserver.Server) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.releaseErr != nil {
+		return f.releaseErr
+	}
+	f.released[server.Host] = true
+	return nil
+}
+
+func (f *FakeProvider) Status(*gameserver.Server) (gameserver.ServerStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.state, nil
+}
+
+func (f *FakeProvider) Region(*gameserver.Server) (string, string) { return f.RegionCode, f.RegionName }
+
+//Released returns true if the server with the given host has been released
+func (f *FakeProvider) Released(host string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.released[host]
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package testhelpers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//FakeServeme is a local HTTP server which answers like serveme's reservation API,
+//for testing the serveme provider with gameserver.NewServemeProvider(fake.URL)
+type FakeServeme struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	reservations map[int]*fakeReservation
+	deleted      map[int]bool
+}
+
+type fakeReservation struct {
+	Status string `json:"status"`
+	Ended  bool   `json:"ended"`
+}
+
+//NewFakeServeme starts a fake serveme server, which has to be closed after use
+func NewFakeServeme() *FakeServeme {
+	f := &FakeServeme{
+		reservations: make(map[int]*fakeReservation),
+		deleted:      make(map[int]bool),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+//SetReservation sets the status of the reservation with the given ID
+func (f *FakeServeme) SetReservation(id int, status string, ended bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.reservations[id] = &fakeReservation{Status: status, Ended: ended}
+}
+
+//Deleted returns true if the reservation has been ended with a DELETE request
+func (f *FakeServeme) Deleted(id int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.deleted[id]
+}
+
+func (f *FakeServeme) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/reservations/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	reservation, ok := f.reservations[id]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(map[string]interface{}{"reservation": reservation})
+	case "DELETE":
+		reservation.Ended = true
+		f.deleted[id] = true
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -18,8 +18,11 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/TF2Stadium/Helen/config"
 	"github.com/TF2Stadium/Helen/controllers"
+	"github.com/TF2Stadium/Helen/controllers/broadcaster"
 	chelpers "github.com/TF2Stadium/Helen/controllers/controllerhelpers"
+	"github.com/TF2Stadium/Helen/controllers/publisher"
 	"github.com/TF2Stadium/Helen/controllers/socket"
+	"github.com/TF2Stadium/Helen/controllers/socket/handler"
 	"github.com/TF2Stadium/Helen/database"
 	"github.com/TF2Stadium/Helen/database/migrations"
 	"github.com/TF2Stadium/Helen/helpers"
@@ -28,8 +31,10 @@ import (
 	"github.com/TF2Stadium/Helen/internal/version"
 	"github.com/TF2Stadium/Helen/models/chat"
 	"github.com/TF2Stadium/Helen/models/event"
+	"github.com/TF2Stadium/Helen/models/gameserver"
 	"github.com/TF2Stadium/Helen/models/lobby"
 	"github.com/TF2Stadium/Helen/models/rpc"
+	"github.com/TF2Stadium/Helen/models/timer"
 	"github.com/TF2Stadium/Helen/routes"
 	socketServer "github.com/TF2Stadium/Helen/routes/socket"
 	"github.com/rs/cors"
@@ -73,8 +78,16 @@ func main() {
 
 	database.Init()
 	migrations.Do()
+	//encrypts passwords with the current key after keys have been rotated
+	gameserver.EncryptPasswords()
 
 	helpers.ConnectAMQP()
+	if err := broadcaster.Connect(helpers.AMQPConn); err != nil {
+		logrus.Fatal(err)
+	}
+	if err := publisher.Connect(helpers.AMQPConn); err != nil {
+		logrus.Fatal(err)
+	}
 	event.StartListening()
 	helpers.InitGeoIPDB()
 
@@ -83,9 +96,9 @@ func main() {
 		logrus.Fatal(err)
 	}
 
-	lobby.CreateLocks()
 	rpc.ConnectRPC()
-	lobby.RestoreServemeChecks()
+	go lobby.RunReservationReconciler()
+	go gameserver.RunHealthChecker(rpc.VerifyInfo)
 	//go models.TFTVStreamStatusUpdater()
 
 	if config.Constants.SteamIDWhitelist != "" {
@@ -95,6 +108,8 @@ func main() {
 	mux := http.NewServeMux()
 	routes.SetupHTTP(mux)
 	socket.RegisterHandlers()
+	timer.Restore()
+	go handler.RunMatcher()
 
 	corsHandler := cors.New(cors.Options{
 		AllowedOrigins:   config.Constants.AllowedOrigins,
@@ -117,6 +132,8 @@ func main() {
 func shutdown() {
 	logrus.Info("Received SIGINT/SIGTERM")
 	chat.SendNotification(`Backend will be going down for a while for an update, click on "Reconnect" to reconnect to TF2Stadium`, 0)
+	logrus.Info("stopping timers")
+	timer.StopAll()
 	logrus.Info("waiting for GlobalWait")
 	helpers.GlobalWait.Wait()
 	logrus.Info("waiting for socket requests to complete.")
@@ -17,7 +17,7 @@ func init() {
 
 func TestNewChatMessage(t *testing.T) {
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
 	lobby.Save()
 
 	player := testhelpers.CreatePlayer()
@@ -0,0 +1,75 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package event
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	db "github.com/TF2Stadium/Helen/database"
+)
+
+var ErrDeadLetterNotFound = errors.New("No such dead-lettered event")
+
+//DeadLetterEvent is an event which couldn't be handled after MaxEventAttempts
+//attempts, or couldn't be decoded. They're kept till an admin replays them.
+type DeadLetterEvent struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Name     string // empty if the event couldn't be decoded
+	Body     string `sql:"type:text"`
+	Error    string `sql:"type:text"` // the last error returned while handling the event
+	Attempts int
+}
+
+//deadLetter saves an event which couldn't be handled
+func deadLetter(name string, body []byte, err error, attempts int) error {
+	return db.DB.Create(&DeadLetterEvent{
+		Name:     name,
+		Body:     string(body),
+		Error:    err.Error(),
+		Attempts: attempts,
+	}).Error
+}
+
+//GetDeadLetterEvents returns all dead-lettered events, the latest first
+func GetDeadLetterEvents() []*DeadLetterEvent {
+	var events []*DeadLetterEvent
+	db.DB.Order("id desc").Find(&events)
+	return events
+}
+
+//Replay handles the dead-lettered event with the given ID again. It's deleted if it
+//was handled successfully, otherwise the error is recorded and returned.
+func Replay(id uint) error {
+	dead := &DeadLetterEvent{}
+	if err := db.DB.First(dead, id).Error; err != nil {
+		return ErrDeadLetterNotFound
+	}
+
+	var event Event
+	err := json.Unmarshal([]byte(dead.Body), &event)
+	if err == nil {
+		err = Handle(event)
+	}
+	if err != nil {
+		db.DB.Model(dead).UpdateColumns(map[string]interface{}{
+			"attempts":   dead.Attempts + 1,
+			"error":      err.Error(),
+			"updated_at": time.Now(),
+		})
+		return err
+	}
+
+	return db.DB.Delete(dead).Error
+}
+
+//Discard deletes a dead-lettered event without handling it
+func Discard(id uint) error {
+	return db.DB.Where("id = ?", id).Delete(&DeadLetterEvent{}).Error
+}
@@ -3,6 +3,8 @@ package event
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -14,10 +16,15 @@ import (
 	playerpackage "github.com/TF2Stadium/Helen/models/player"
 	"github.com/TF2Stadium/PlayerStatsScraper/steamid"
 	"github.com/TF2Stadium/TF2RconWrapper"
+	"github.com/jinzhu/gorm"
+	"github.com/streadway/amqp"
 )
 
 //Mirrored across github.com/Pauling/server
 type Event struct {
+	ID        string    // unique for each event, redelivered events have the same ID
+	Timestamp time.Time // when the event happened on the server
+
 	Name     string
 	SteamID  string
 	PlayerID uint32 // used by fumble
@@ -25,7 +32,11 @@ type Event struct {
 	LobbyID    uint
 	LogsID     int //logs.tf ID
 	ClassTimes map[string]*classTime
+	Winner     string // "red", "blu" or "draw", empty if the result isn't known
+	RedScore   int
+	BluScore   int
 	Players    []TF2RconWrapper.Player
+	Message    string // in-game chat message
 
 	Self bool // true if
 }
@@ -59,7 +70,30 @@ const (
 	ReservationOver string = "reservationOver"
 )
 
-var stop = make(chan struct{})
+func init() {
+	lobbypackage.RegisterNotInGameFunc("subDisconnected", subDisconnected)
+}
+
+const (
+	//MaxEventAttempts is how many times handling an event is tried before it's dead-lettered
+	MaxEventAttempts = 3
+	//MaxRetryDelay is the longest a failed event waits before it's requeued
+	MaxRetryDelay = 5 * time.Second
+)
+
+//RetryDelay is how long an event waits before it's requeued after it's first
+//failed attempt, doubled after each attempt
+var RetryDelay = 500 * time.Millisecond
+
+var (
+	stop = make(chan struct{})
+
+	//handle handles decoded events, replaced in tests
+	handle = Handle
+
+	failures   = make(map[string]int) // event ID (or body) -> failed attempts
+	failuresMu = new(sync.Mutex)
+)
 
 func StartListening() {
 	q, err := helpers.AMQPChannel.QueueDeclare(config.Constants.RabbitMQQueue, false, false, false, false, nil)
@@ -67,41 +101,21 @@ func StartListening() {
 		logrus.Fatal("Cannot declare queue ", err)
 	}
 
-	msgs, err := helpers.AMQPChannel.Consume(q.Name, "", true, false, false, false, nil)
+	msgs, err := helpers.AMQPChannel.Consume(q.Name, "", false, false, false, false, nil)
 	if err != nil {
 		logrus.Fatal("Cannot consume messages ", err)
 	}
 
+	go pruneProcessedEvents()
 	go func() {
 		for {
 			select {
-			case msg := <-msgs:
-				var event Event
-
-				err := json.Unmarshal(msg.Body, &event)
-				if err != nil {
-					logrus.Fatal(err)
-				}
-				switch event.Name {
-				case PlayerDisconnected:
-					playerDisc(event.SteamID, event.LobbyID)
-				case PlayerSubstituted:
-					playerSub(event.SteamID, event.LobbyID, event.Self)
-				case PlayerConnected:
-					playerConn(event.SteamID, event.LobbyID)
-				case DisconnectedFromServer:
-					disconnectedFromServer(event.LobbyID)
-				case MatchEnded:
-					matchEnded(event.LobbyID, event.LogsID, event.ClassTimes)
-				case ReservationOver:
-					reservationEnded(event.LobbyID)
-				case PlayerMumbleJoined:
-					mumbleJoined(uint(event.PlayerID))
-				case PlayerMumbleLeft:
-					mumbleLeft(uint(event.PlayerID))
-				case PlayersList:
-					playersList(event.Players)
+			case msg, ok := <-msgs:
+				if !ok {
+					logrus.Error("Event queue has been closed")
+					return
 				}
+				consume(msg)
 			case <-stop:
 				return
 			}
@@ -109,45 +123,184 @@ func StartListening() {
 	}()
 }
 
+//consume handles a message from the queue. Messages are only acknowledged after
+//they've been handled, or dead-lettered. Failed events are requeued after a delay,
+//without blocking the queue, till they've been tried MaxEventAttempts times.
+func consume(msg amqp.Delivery) {
+	var event Event
+	if err := json.Unmarshal(msg.Body, &event); err != nil {
+		logrus.Errorf("Couldn't decode event: %s", err.Error())
+		deadLetterMsg(msg, event, err, 1)
+		return
+	}
+
+	key := event.ID
+	if key == "" {
+		key = string(msg.Body)
+	}
+
+	err := handle(event)
+	switch {
+	case err == nil:
+	case permanent(err):
+		//retrying won't find the lobby or player
+		logrus.Warningf("Dropping event %s for lobby %d: %s", event.Name, event.LobbyID, err.Error())
+	default:
+		attempts := failed(key)
+		if attempts < MaxEventAttempts {
+			delay := RetryDelay << uint(attempts-1)
+			if delay > MaxRetryDelay {
+				delay = MaxRetryDelay
+			}
+			logrus.Warningf("Retrying event %s in %s: %s", event.Name, delay, err.Error())
+			time.AfterFunc(delay, func() { msg.Nack(false, true) })
+			return
+		}
+
+		forget(key)
+		deadLetterMsg(msg, event, err, attempts)
+		return
+	}
+
+	forget(key)
+	msg.Ack(false)
+}
+
+//deadLetterMsg saves a message which couldn't be handled and acknowledges it,
+//it's requeued if it couldn't be saved
+func deadLetterMsg(msg amqp.Delivery, event Event, err error, attempts int) {
+	logrus.Errorf("Dead-lettering event %s after %d attempts: %s", event.Name, attempts, err.Error())
+	if dlErr := deadLetter(event.Name, msg.Body, err, attempts); dlErr != nil {
+		logrus.Error(dlErr)
+		msg.Nack(false, true)
+		return
+	}
+	msg.Ack(false)
+}
+
+//permanent returns true if handling an event failed in a way retrying won't fix
+func permanent(err error) bool {
+	return err == lobbypackage.ErrLobbyNotFound || err == playerpackage.ErrPlayerNotFound ||
+		err == gorm.ErrRecordNotFound
+}
+
+//failed records a failed attempt at handling the event, returning the number of attempts so far
+func failed(key string) int {
+	failuresMu.Lock()
+	defer failuresMu.Unlock()
+
+	failures[key]++
+	return failures[key]
+}
+
+func forget(key string) {
+	failuresMu.Lock()
+	delete(failures, key)
+	failuresMu.Unlock()
+}
+
+//handleEvent calls the handler for the event, returning handler panics as errors
+func handleEvent(event Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while handling %s: %v", event.Name, r)
+		}
+	}()
+
+	switch event.Name {
+	case PlayerDisconnected:
+		return playerDisc(event.SteamID, event.LobbyID)
+	case PlayerSubstituted:
+		return playerSub(event.SteamID, event.LobbyID, event.Self)
+	case PlayerConnected:
+		return playerConn(event.SteamID, event.LobbyID)
+	case DisconnectedFromServer:
+		return disconnectedFromServer(event.LobbyID)
+	case MatchEnded:
+		return matchEnded(event)
+	case ReservationOver:
+		return reservationEnded(event.LobbyID)
+	case PlayerMumbleJoined:
+		return mumbleJoined(uint(event.PlayerID))
+	case PlayerMumbleLeft:
+		return mumbleLeft(uint(event.PlayerID))
+	case PlayersList:
+		return playersList(event.Players)
+	case PlayerChat:
+		return playerChat(event.LobbyID, event.SteamID, event.Message)
+	}
+
+	return nil
+}
+
 func StopListening() {
 	stop <- struct{}{}
 }
 
-func reservationEnded(lobbyID uint) {
-	lobby, _ := lobbypackage.GetLobbyByID(lobbyID)
-	lobby.Close(false, false)
+func reservationEnded(lobbyID uint) error {
+	lobby, err := lobbypackage.GetLobbyByID(lobbyID)
+	if err != nil {
+		return err
+	}
+
+	lobby.Close(false, false, "serveme reservation ended", 0)
 	chat.SendNotification("Lobby Closed (serveme.tf reservation ended)", int(lobby.ID))
+	return nil
 }
 
-func playerDisc(steamID string, lobbyID uint) {
-	player, _ := playerpackage.GetPlayerBySteamID(steamID)
-	lobby, _ := lobbypackage.GetLobbyByID(lobbyID)
+//getPlayerLobby returns the player and lobby an event is about
+func getPlayerLobby(steamID string, lobbyID uint) (*playerpackage.Player, *lobbypackage.Lobby, error) {
+	player, err := playerpackage.GetPlayerBySteamID(steamID)
+	if err != nil {
+		return nil, nil, err
+	}
+	lobby, err := lobbypackage.GetLobbyByID(lobbyID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return player, lobby, nil
+}
+
+func playerDisc(steamID string, lobbyID uint) error {
+	player, lobby, err := getPlayerLobby(steamID, lobbyID)
+	if err != nil {
+		return err
+	}
 
 	lobby.SetNotInGame(player)
 
 	chat.SendNotification(fmt.Sprintf("%s has disconected from the server.", player.Alias()), int(lobby.ID))
 
-	lobby.AfterPlayerNotInGameFunc(player, 5*time.Minute, func() {
-		lobby.Substitute(player)
-		player.NewReport(playerpackage.Substitute, lobby.ID)
-		chat.SendNotification(fmt.Sprintf("%s has been reported for not joining the game in 5 minutes", player.Alias()), int(lobby.ID))
-	})
+	lobby.AfterPlayerNotInGameFunc(player, 5*time.Minute, "subDisconnected")
+	return nil
+}
+
+func subDisconnected(lobby *lobbypackage.Lobby, player *playerpackage.Player) {
+	lobby.Substitute(player)
+	player.NewReport(playerpackage.Substitute, lobby.ID)
+	chat.SendNotification(fmt.Sprintf("%s has been reported for not joining the game in 5 minutes", player.Alias()), int(lobby.ID))
 }
 
-func playerConn(steamID string, lobbyID uint) {
-	player, _ := playerpackage.GetPlayerBySteamID(steamID)
-	lobby, _ := lobbypackage.GetLobbyByID(lobbyID)
+func playerConn(steamID string, lobbyID uint) error {
+	player, lobby, err := getPlayerLobby(steamID, lobbyID)
+	if err != nil {
+		return err
+	}
 
 	lobby.SetInGame(player)
 	chat.SendNotification(fmt.Sprintf("%s has connected to the server.", player.Alias()), int(lobby.ID))
+	return nil
 }
 
-func playerSub(steamID string, lobbyID uint, self bool) {
-	player, _ := playerpackage.GetPlayerBySteamID(steamID)
-	lobby, err := lobbypackage.GetLobbyByID(lobbyID)
+func playerSub(steamID string, lobbyID uint, self bool) error {
+	player, lobby, err := getPlayerLobby(steamID, lobbyID)
 	if err != nil {
-		logrus.Error(err)
-		return
+		return err
+	}
+	//the player has already been substituted (or left the lobby)
+	if slot, err := lobby.GetPlayerSlot(player); err != nil || lobby.SlotNeedsSubstitute(slot) {
+		return nil
 	}
 
 	lobby.Substitute(player)
@@ -160,40 +313,64 @@ func playerSub(steamID string, lobbyID uint, self bool) {
 	}
 
 	chat.SendNotification(fmt.Sprintf("%s has been reported.", player.Alias()), int(lobby.ID))
+	return nil
 }
 
-func playerChat(lobbyID uint, steamID string, message string) {
-	lobby, _ := lobbypackage.GetLobbyByIDServer(lobbyID)
-	player, _ := playerpackage.GetPlayerBySteamID(steamID)
+func playerChat(lobbyID uint, steamID string, message string) error {
+	lobby, err := lobbypackage.GetLobbyByIDServer(lobbyID)
+	if err != nil {
+		return err
+	}
+	player, err := playerpackage.GetPlayerBySteamID(steamID)
+	if err != nil { // spectators on the server who aren't on the site
+		return nil
+	}
+
+	message = strings.TrimSpace(message)
+	if message == "" || strings.HasPrefix(message, lobbypackage.ChatRelayPrefix) {
+		return nil
+	}
+	if runes := []rune(message); len(runes) > 150 {
+		message = string(runes[:150])
+	}
 
 	chatMessage := chat.NewInGameChatMessage(lobby.ID, player, message)
 	chatMessage.Save()
 	chatMessage.Send()
+	return nil
 }
 
-func disconnectedFromServer(lobbyID uint) {
+func disconnectedFromServer(lobbyID uint) error {
 	lobby, err := lobbypackage.GetLobbyByIDServer(lobbyID)
 	if err != nil {
-		logrus.Error("Couldn't find lobby ", lobbyID, " in database")
-		return
+		return err
 	}
 
-	lobby.Close(false, false)
+	lobby.Close(false, false, "connection to server lost", 0)
 	chat.SendNotification("Lobby Closed (Connection to server lost)", int(lobby.ID))
+	return nil
 }
 
-func matchEnded(lobbyID uint, logsID int, classTimes map[string]*classTime) {
-	lobby, err := lobbypackage.GetLobbyByIDServer(lobbyID)
+func matchEnded(event Event) error {
+	lobby, err := lobbypackage.GetLobbyByIDServer(event.LobbyID)
 	if err != nil {
-		logrus.Error(err)
-		return
+		return err
+	}
+	if lobby.MatchEnded { // stats have already been recorded
+		return nil
 	}
-	lobby.Close(false, true)
+	lobby.Close(false, true, "match ended", 0)
 
-	msg := fmt.Sprintf("Lobby Ended. Logs: http://logs.tf/%d", logsID)
+	msg := fmt.Sprintf("Lobby Ended. Logs: http://logs.tf/%d", event.LogsID)
 	chat.SendNotification(msg, int(lobby.ID))
 
-	for steamid, times := range classTimes {
+	if event.Winner != "" {
+		if err := lobby.RecordResult(event.Winner, event.RedScore, event.BluScore); err != nil {
+			logrus.Error(err)
+		}
+	}
+
+	for steamid, times := range event.ClassTimes {
 		player, err := playerpackage.GetPlayerBySteamID(steamid)
 		if err != nil {
 			logrus.Error("Couldn't find player ", steamid)
@@ -213,31 +390,47 @@ func matchEnded(lobbyID uint, logsID int, classTimes map[string]*classTime) {
 
 		db.DB.Save(&player.Stats)
 	}
+
+	return nil
 }
 
-func mumbleJoined(playerID uint) {
-	player, _ := playerpackage.GetPlayerByID(playerID)
+func mumbleJoined(playerID uint) error {
+	player, err := playerpackage.GetPlayerByID(playerID)
+	if err != nil {
+		return err
+	}
 	id, _ := player.GetLobbyID(false)
 	if id == 0 { // player joined mumble lobby for closed channel
-		return
+		return nil
 	}
 
-	lobby, _ := lobbypackage.GetLobbyByID(id)
+	lobby, err := lobbypackage.GetLobbyByID(id)
+	if err != nil {
+		return err
+	}
 	lobby.SetInMumble(player)
+	return nil
 }
 
-func mumbleLeft(playerID uint) {
-	player, _ := playerpackage.GetPlayerByID(playerID)
+func mumbleLeft(playerID uint) error {
+	player, err := playerpackage.GetPlayerByID(playerID)
+	if err != nil {
+		return err
+	}
 	id, _ := player.GetLobbyID(false)
 	if id == 0 { // player joined mumble lobby for closed channel
-		return
+		return nil
 	}
 
-	lobby, _ := lobbypackage.GetLobbyByID(id)
+	lobby, err := lobbypackage.GetLobbyByID(id)
+	if err != nil {
+		return err
+	}
 	lobby.SetNotInMumble(player)
+	return nil
 }
 
-func playersList(players []TF2RconWrapper.Player) {
+func playersList(players []TF2RconWrapper.Player) error {
 	for _, player := range players {
 		commid, _ := steamid.SteamIdToCommId(player.SteamID)
 		player, err := playerpackage.GetPlayerBySteamID(commid)
@@ -250,9 +443,14 @@ func playersList(players []TF2RconWrapper.Player) {
 			continue
 		}
 
-		lobby, _ := lobbypackage.GetLobbyByID(id)
+		lobby, err := lobbypackage.GetLobbyByID(id)
+		if err != nil {
+			continue
+		}
 		if !lobby.IsPlayerInGame(player) {
 			lobby.SetInGame(player)
 		}
 	}
+
+	return nil
 }
@@ -0,0 +1,159 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package event_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	db "github.com/TF2Stadium/Helen/database"
+	"github.com/TF2Stadium/Helen/internal/testhelpers"
+	. "github.com/TF2Stadium/Helen/models/event"
+	"github.com/TF2Stadium/Helen/models/lobby"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	testhelpers.CleanupDB()
+}
+
+func TestReplay(t *testing.T) {
+	t.Parallel()
+
+	failing := &DeadLetterEvent{Name: PlayerConnected, Body: `{"Name":"playerConn","SteamID":"0","LobbyID":1000000}`, Attempts: MaxEventAttempts}
+	malformed := &DeadLetterEvent{Body: `{"Name":`, Attempts: 1}
+	handled := &DeadLetterEvent{Name: Test, Body: `{"Name":"test"}`, Attempts: MaxEventAttempts}
+	for _, dead := range []*DeadLetterEvent{failing, malformed, handled} {
+		assert.NoError(t, db.DB.Create(dead).Error)
+	}
+
+	assert.Error(t, Replay(failing.ID))
+	db.DB.First(failing, failing.ID)
+	assert.Equal(t, MaxEventAttempts+1, failing.Attempts)
+	assert.NotEmpty(t, failing.Error)
+
+	assert.Error(t, Replay(malformed.ID))
+
+	assert.NoError(t, Replay(handled.ID))
+	assert.Equal(t, ErrDeadLetterNotFound, Replay(handled.ID))
+
+	assert.NoError(t, Discard(malformed.ID))
+	for _, dead := range GetDeadLetterEvents() {
+		assert.NotEqual(t, malformed.ID, dead.ID)
+	}
+}
+
+//acknowledger records what's done with deliveries
+type acknowledger chan string
+
+func (a acknowledger) Ack(uint64, bool) error { a <- "ack"; return nil }
+func (a acknowledger) Nack(_ uint64, _ bool, requeue bool) error {
+	if requeue {
+		a <- "requeue"
+	} else {
+		a <- "nack"
+	}
+	return nil
+}
+func (a acknowledger) Reject(uint64, bool) error { a <- "reject"; return nil }
+
+func TestConsume(t *testing.T) {
+	errFailed := errors.New("failed")
+	var attempts int
+	restore := SetHandle(func(event Event) error {
+		switch event.Name {
+		case PlayerConnected:
+			return lobby.ErrLobbyNotFound
+		case PlayerDisconnected:
+			attempts++
+			return errFailed
+		}
+		return nil
+	})
+	defer restore()
+	RetryDelay = 10 * time.Millisecond
+
+	acks := make(acknowledger, 1)
+	deliver := func(body string) string {
+		Consume(amqp.Delivery{Acknowledger: acks, Body: []byte(body)})
+		select {
+		case ack := <-acks:
+			return ack
+		case <-time.After(time.Second):
+			return ""
+		}
+	}
+
+	assert.Equal(t, "ack", deliver(`{"ID":"handled","Name":"test"}`))
+	//events about lobbies or players which don't exist aren't retried
+	assert.Equal(t, "ack", deliver(`{"ID":"notfound","Name":"playerConn","LobbyID":1000000}`))
+
+	//failed events are requeued after a delay, without blocking the consumer
+	body := `{"ID":"failing","Name":"playerDisc","LobbyID":1000000}`
+	for i := 1; i < MaxEventAttempts; i++ {
+		Consume(amqp.Delivery{Acknowledger: acks, Body: []byte(body)})
+		assert.Empty(t, acks)
+		assert.Equal(t, "requeue", <-acks)
+	}
+	assert.Equal(t, "ack", deliver(body))
+	assert.Equal(t, MaxEventAttempts, attempts)
+
+	var dead []*DeadLetterEvent
+	for _, event := range GetDeadLetterEvents() {
+		if event.Body == body {
+			dead = append(dead, event)
+		}
+	}
+	if assert.Len(t, dead, 1) {
+		assert.Equal(t, MaxEventAttempts, dead[0].Attempts)
+		assert.Equal(t, errFailed.Error(), dead[0].Error)
+	}
+}
+
+func TestHandleOnce(t *testing.T) {
+	t.Parallel()
+	lobby := testhelpers.CreateLobby()
+	player := testhelpers.CreatePlayer()
+	lobby.AddPlayer(player, 0, "")
+
+	now := time.Now()
+	conn := Event{ID: "conn", Timestamp: now, Name: PlayerConnected, SteamID: player.SteamID, LobbyID: lobby.ID}
+	assert.NoError(t, Handle(conn))
+	assert.True(t, lobby.IsPlayerInGame(player))
+
+	//redelivered events are skipped
+	lobby.SetNotInGame(player)
+	assert.NoError(t, Handle(conn))
+	assert.False(t, lobby.IsPlayerInGame(player))
+
+	lobby.SetInGame(player)
+	disc := Event{ID: "disc", Timestamp: now.Add(-time.Minute), Name: PlayerDisconnected, SteamID: player.SteamID, LobbyID: lobby.ID}
+	assert.NoError(t, Handle(disc))
+	assert.True(t, lobby.IsPlayerInGame(player), "events older than the last handled one are skipped")
+
+	lobby.Close(false, true, "test", 0)
+	lobby.SetNotInGame(player)
+	late := Event{ID: "late", Timestamp: now.Add(time.Minute), Name: PlayerConnected, SteamID: player.SteamID, LobbyID: lobby.ID}
+	assert.NoError(t, Handle(late))
+	assert.False(t, lobby.IsPlayerInGame(player), "events for ended lobbies are skipped")
+}
+
+func TestSubstituteOnce(t *testing.T) {
+	t.Parallel()
+	lob := testhelpers.CreateLobby()
+	player := testhelpers.CreatePlayer()
+	lob.AddPlayer(player, 0, "")
+
+	//the same substitution, redelivered after Helen restarted mid-handler
+	for _, id := range []string{"sub", ""} {
+		assert.NoError(t, Handle(Event{ID: id, Timestamp: time.Now(), Name: PlayerSubstituted, SteamID: player.SteamID, LobbyID: lob.ID, Self: true}))
+	}
+	assert.True(t, lob.SlotNeedsSubstitute(0))
+
+	db.DB.Preload("Stats").First(player, player.ID)
+	assert.Equal(t, 1, player.Stats.Substitutes)
+}
@@ -0,0 +1,15 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package event
+
+var Consume = consume
+
+//SetHandle replaces the function used to handle events from the queue,
+//returning a function which restores it
+func SetHandle(f func(Event) error) (restore func()) {
+	prev := handle
+	handle = f
+	return func() { handle = prev }
+}
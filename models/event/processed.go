@@ -0,0 +1,108 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package event
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	db "github.com/TF2Stadium/Helen/database"
+	lobbypackage "github.com/TF2Stadium/Helen/models/lobby"
+)
+
+//ProcessedEventRetention is how long the IDs of processed events are kept for.
+//Events redelivered after this are handled again.
+const ProcessedEventRetention = 7 * 24 * time.Hour
+
+//ProcessedEvent records an event which has been handled, so that it isn't
+//handled again if it's delivered more than once
+type ProcessedEvent struct {
+	ID        string `gorm:"primary_key"`
+	CreatedAt time.Time
+
+	Name       string
+	LobbyID    uint
+	SteamID    string
+	OccurredAt time.Time // the event's timestamp
+}
+
+//endedLobbyEvents are events about lobbies in progress, which are ignored
+//if they arrive after the lobby has ended
+var endedLobbyEvents = map[string]bool{
+	PlayerDisconnected:     true,
+	PlayerSubstituted:      true,
+	PlayerConnected:        true,
+	DisconnectedFromServer: true,
+	ReservationOver:        true,
+}
+
+//Handle handles the event, unless an event with the same ID has been handled
+//before, or it arrived after a later event which makes it obsolete.
+//Events without IDs (sent by older versions of Pauling) are always handled.
+//
+//Events are only recorded as processed after they've been handled, so that they're
+//handled again if Helen stops while handling them. Handlers have to be idempotent.
+func Handle(event Event) error {
+	if event.ID != "" && processed(event.ID) {
+		logrus.Debugf("Skipping duplicate event %s (%s)", event.ID, event.Name)
+		return nil
+	}
+
+	if reason := obsolete(event); reason != "" {
+		logrus.Debugf("Skipping event %s for lobby %d: %s", event.Name, event.LobbyID, reason)
+	} else if err := handleEvent(event); err != nil {
+		return err
+	}
+
+	if event.ID != "" {
+		//fails if the event was handled by another consumer at the same time
+		db.DB.Create(&ProcessedEvent{
+			ID:         event.ID,
+			Name:       event.Name,
+			LobbyID:    event.LobbyID,
+			SteamID:    event.SteamID,
+			OccurredAt: event.Timestamp,
+		})
+	}
+	return nil
+}
+
+//processed returns true if the event with the given ID has been handled
+func processed(id string) bool {
+	var count int
+	db.DB.Model(&ProcessedEvent{}).Where("id = ?", id).Count(&count)
+	return count != 0
+}
+
+//obsolete returns why the event shouldn't be handled, or an empty string if it should be
+func obsolete(event Event) string {
+	if endedLobbyEvents[event.Name] {
+		lobby, err := lobbypackage.GetLobbyByID(event.LobbyID)
+		if err == nil && lobby.State == lobbypackage.Ended {
+			return "lobby has ended"
+		}
+	}
+
+	if (event.Name == PlayerConnected || event.Name == PlayerDisconnected) && !event.Timestamp.IsZero() {
+		var count int
+		db.DB.Model(&ProcessedEvent{}).Where("lobby_id = ? AND steam_id = ? AND name IN (?) AND occurred_at > ? AND id <> ?",
+			event.LobbyID, event.SteamID, []string{PlayerConnected, PlayerDisconnected}, event.Timestamp, event.ID).Count(&count)
+		if count != 0 {
+			return "a later connection event has been handled"
+		}
+	}
+
+	return ""
+}
+
+//pruneProcessedEvents deletes processed events older than ProcessedEventRetention every hour
+func pruneProcessedEvents() {
+	ticker := time.NewTicker(time.Hour)
+
+	for {
+		db.DB.Where("created_at < ?", time.Now().Add(-ProcessedEventRetention)).Delete(&ProcessedEvent{})
+		<-ticker.C
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package gameserver
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	db "github.com/TF2Stadium/Helen/database"
+)
+
+const (
+	//HealthCheckInterval is how often unused stored servers are checked
+	HealthCheckInterval = time.Minute
+	//QuarantineFailures is the number of failed checks in a row after which a server is quarantined
+	QuarantineFailures = 3
+	//RecoverSuccesses is the number of successful checks in a row after which a quarantined
+	//server is used for lobbies again
+	RecoverSuccesses = 2
+	//HealthHistory is how long the results of checks are kept for
+	HealthHistory = 30 * 24 * time.Hour
+)
+
+//HealthCheckTimeout is how long checking a server can take
+var HealthCheckTimeout = 30 * time.Second
+
+var ErrCheckTimeout = errors.New("Server check timed out")
+
+//UncheckedError is returned by verify functions when the server couldn't be checked,
+//like when Pauling can't be reached, rather than when the server failed the check
+type UncheckedError struct {
+	Err error
+}
+
+func (e UncheckedError) Error() string {
+	return e.Err.Error()
+}
+
+//ServerHealthCheck is the result of checking a stored server
+type ServerHealthCheck struct {
+	ID             uint `gorm:"primary_key"`
+	StoredServerID uint `sql:"index"`
+	CreatedAt      time.Time
+
+	Success bool
+	Latency int64  // milliseconds
+	Error   string // why the check failed
+}
+
+//ServerUptime is the share of successful checks for a server in one day
+type ServerUptime struct {
+	Day       time.Time
+	Checks    int
+	Successes int
+}
+
+//Percent returns the percentage of successful checks
+func (u ServerUptime) Percent() float64 {
+	if u.Checks == 0 {
+		return 0
+	}
+	return float64(u.Successes) * 100 / float64(u.Checks)
+}
+
+//RunHealthChecker checks all unused stored servers every HealthCheckInterval
+//with verify, which should return an error if the server can't be used.
+func RunHealthChecker(verify func(ServerRecord) error) {
+	ticker := time.NewTicker(HealthCheckInterval)
+
+	for {
+		CheckServers(verify)
+		db.DB.Where("created_at < ?", time.Now().Add(-HealthHistory)).Delete(&ServerHealthCheck{})
+		<-ticker.C
+	}
+}
+
+//CheckServers checks all unused stored servers once. If none of the servers could
+//be checked (verify returned UncheckedError or timed out for all of them), the
+//results aren't recorded.
+func CheckServers(verify func(ServerRecord) error) {
+	var servers []*StoredServer
+	//servers used by lobbies are checked by them
+	db.DB.Model(&StoredServer{}).Where("used = FALSE").Find(&servers)
+
+	errs := make([]error, len(servers))
+	latencies := make([]time.Duration, len(servers))
+	checked := false
+	for i, server := range servers {
+		start := time.Now()
+		errs[i] = verifyTimeout(verify, ServerRecord{Host: server.Address, RconPassword: server.RCONPassword})
+		latencies[i] = time.Since(start)
+		checked = checked || !unchecked(errs[i])
+	}
+
+	if !checked && len(servers) != 0 {
+		logrus.Warningf("Couldn't check any stored server: %s", errs[0].Error())
+		return
+	}
+	for i, server := range servers {
+		server.recordCheck(errs[i], latencies[i])
+	}
+}
+
+//verifyTimeout calls verify, returning ErrCheckTimeout if it takes longer than HealthCheckTimeout
+func verifyTimeout(verify func(ServerRecord) error, info ServerRecord) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- verify(info)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(HealthCheckTimeout):
+		return ErrCheckTimeout
+	}
+}
+
+//unchecked returns true if the error means the server couldn't be checked
+func unchecked(err error) bool {
+	_, ok := err.(UncheckedError)
+	return ok || err == ErrCheckTimeout
+}
+
+//recordCheck saves the result of a check, and quarantines or restores the server
+func (s *StoredServer) recordCheck(err error, latency time.Duration) {
+	check := &ServerHealthCheck{
+		StoredServerID: s.ID,
+		Success:        err == nil,
+	}
+	s.LastChecked = time.Now()
+
+	if err != nil {
+		check.Error = err.Error()
+		s.FailureStreak++
+		s.SuccessStreak = 0
+
+		if !s.Quarantined && s.FailureStreak >= QuarantineFailures {
+			logrus.Warningf("Quarantining stored server %s (#%d): %s", s.Name, s.ID, err.Error())
+			s.Quarantined = true
+		}
+	} else {
+		check.Latency = int64(latency / time.Millisecond)
+		s.Latency = check.Latency
+		s.LastSuccess = s.LastChecked
+		s.SuccessStreak++
+		s.FailureStreak = 0
+
+		if s.Quarantined && s.SuccessStreak >= RecoverSuccesses {
+			logrus.Infof("Stored server %s (#%d) has recovered", s.Name, s.ID)
+			s.Quarantined = false
+		}
+	}
+
+	db.DB.Create(check)
+	db.DB.Model(&StoredServer{}).Where("id = ?", s.ID).UpdateColumns(map[string]interface{}{
+		"quarantined":    s.Quarantined,
+		"failure_streak": s.FailureStreak,
+		"success_streak": s.SuccessStreak,
+		"latency":        s.Latency,
+		"last_checked":   s.LastChecked,
+		"last_success":   s.LastSuccess,
+	})
+}
+
+//Uptime returns the percentage of successful checks for the server since the given time
+func (s *StoredServer) Uptime(since time.Time) float64 {
+	uptime := ServerUptime{}
+	db.DB.Model(&ServerHealthCheck{}).Where("stored_server_id = ? AND created_at >= ?", s.ID, since).Count(&uptime.Checks)
+	db.DB.Model(&ServerHealthCheck{}).Where("stored_server_id = ? AND created_at >= ? AND success = TRUE", s.ID, since).Count(&uptime.Successes)
+	return uptime.Percent()
+}
+
+//GetUptimeHistory returns the server's uptime for each day checks have been kept for, the latest first
+func (s *StoredServer) GetUptimeHistory() []ServerUptime {
+	var history []ServerUptime
+
+	rows, err := db.DB.Raw(`SELECT date_trunc('day', created_at) AS day, COUNT(*), SUM(CASE WHEN success THEN 1 ELSE 0 END)
+FROM server_health_checks WHERE stored_server_id = ? GROUP BY day ORDER BY day DESC`, s.ID).Rows()
+	if err != nil {
+		logrus.Error(err)
+		return history
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var uptime ServerUptime
+		rows.Scan(&uptime.Day, &uptime.Checks, &uptime.Successes)
+		history = append(history, uptime)
+	}
+	return history
+}
+
+//GetHealthChecks returns the server's latest checks
+func (s *StoredServer) GetHealthChecks(limit int) []*ServerHealthCheck {
+	var checks []*ServerHealthCheck
+	db.DB.Where("stored_server_id = ?", s.ID).Order("id desc").Limit(limit).Find(&checks)
+	return checks
+}
@@ -0,0 +1,143 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package gameserver
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/TF2Stadium/Helen/helpers"
+	"github.com/TF2Stadium/servemetf"
+)
+
+//Names of the providers which are always registered
+const (
+	ProviderServeme = "serveme"      // serveme.tf reservations
+	ProviderStored  = "storedServer" // servers added by admins
+	ProviderRcon    = "server"       // servers given by the lobby creator with their RCON password
+)
+
+//ServerStatus is the state of a server acquired from a provider
+type ServerStatus int
+
+const (
+	StatusPending ServerStatus = iota // the server isn't ready to be used yet
+	StatusReady
+	StatusEnded // the server can't be used anymore, like when a serveme reservation ends
+)
+
+var ErrNoProvider = errors.New("No such server provider")
+
+//ServerProvider gets game servers for lobbies. Lobbies record the name of the
+//provider their server came from, and use it to release the server.
+type ServerProvider interface {
+	//Acquire gets a server as described by req
+	Acquire(req ServerRequest) (*Server, error)
+	//Release frees the server, so that it can be used by other lobbies
+	Release(server *Server) error
+	//Status returns whether the server is ready to be used
+	Status(server *Server) (ServerStatus, error)
+	//Region returns the code and name of the region the server is in
+	Region(server *Server) (code, name string)
+}
+
+//ServerRequest describes the server wanted from a provider,
+//each provider only uses the fields it needs.
+type ServerRequest struct {
+	SteamID string // player the server is for
+	IPAddr  string // the player's IP address
+
+	Address      string // server address, for RCON servers
+	RconPassword string
+
+	StoredServerID uint                  // 0 to allocate a free stored server in Region
+	Region         string                // region code
+	Tags           []string              // names of the format, the server has to have one of them
+	Reservation    servemetf.Reservation // the serveme reservation to create
+}
+
+//Server is a game server acquired from a provider
+type Server struct {
+	Host          string
+	RconPassword  string
+	ReservationID int    // provider specific ID for the server, like the serveme reservation ID
+	SteamID       string // player the server was acquired for
+}
+
+var (
+	providers   = make(map[string]ServerProvider)
+	providersMu = new(sync.RWMutex)
+)
+
+func init() {
+	RegisterProvider(ProviderServeme, servemeProvider{})
+	RegisterProvider(ProviderStored, storedProvider{})
+	RegisterProvider(ProviderRcon, rconProvider{})
+}
+
+//RegisterProvider makes a provider available with the given name,
+//replacing any provider registered before with the same name.
+func RegisterProvider(name string, provider ServerProvider) {
+	providersMu.Lock()
+	providers[name] = provider
+	providersMu.Unlock()
+}
+
+//GetProvider returns the provider registered with the given name
+func GetProvider(name string) (ServerProvider, error) {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+
+	provider, ok := providers[name]
+	if !ok {
+		return nil, ErrNoProvider
+	}
+	return provider, nil
+}
+
+//rconProvider uses servers given by the lobby creator
+type rconProvider struct{}
+
+func (rconProvider) Acquire(req ServerRequest) (*Server, error) {
+	if req.RconPassword == "" {
+		return nil, errors.New("RCON Password cannot be empty")
+	}
+	if req.Address == "" {
+		return nil, errors.New("Server Address cannot be empty")
+	}
+
+	return &Server{Host: req.Address, RconPassword: req.RconPassword, SteamID: req.SteamID}, nil
+}
+
+func (rconProvider) Release(*Server) error                  { return nil }
+func (rconProvider) Status(*Server) (ServerStatus, error)   { return StatusReady, nil }
+func (rconProvider) Region(server *Server) (string, string) { return helpers.GetRegion(server.Host) }
+
+//storedProvider uses servers from the stored server pool
+type storedProvider struct{}
+
+func (storedProvider) Acquire(req ServerRequest) (*Server, error) {
+	var server *StoredServer
+	var err error
+
+	if req.StoredServerID == 0 {
+		server, err = AllocateStoredServer(req.Region, req.Tags...)
+	} else {
+		server, err = GetStoredServer(req.StoredServerID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{Host: server.Address, RconPassword: string(server.RCONPassword), SteamID: req.SteamID}, nil
+}
+
+func (storedProvider) Release(server *Server) error {
+	PutStoredServer(server.Host)
+	return nil
+}
+
+func (storedProvider) Status(*Server) (ServerStatus, error)   { return StatusReady, nil }
+func (storedProvider) Region(server *Server) (string, string) { return helpers.GetRegion(server.Host) }
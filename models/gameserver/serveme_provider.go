@@ -0,0 +1,129 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package gameserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TF2Stadium/Helen/config"
+	"github.com/TF2Stadium/Helen/helpers"
+)
+
+//servemeProvider creates serveme.tf reservations for the player creating the lobby.
+//Reservations are checked and ended over serveme's API at baseURL, or at the
+//serveme site for the server's region if it's empty.
+type servemeProvider struct {
+	baseURL string
+}
+
+//NewServemeProvider returns a serveme provider which checks and ends
+//reservations over the serveme API at baseURL (like "https://serveme.tf")
+func NewServemeProvider(baseURL string) ServerProvider {
+	return servemeProvider{baseURL: strings.TrimRight(baseURL, "/")}
+}
+
+//servemeReservation is the part of serveme's reservation JSON used to check reservations
+type servemeReservation struct {
+	Status string `json:"status"`
+	Ended  bool   `json:"ended"`
+}
+
+func (servemeProvider) Acquire(req ServerRequest) (*Server, error) {
+	context := helpers.GetServemeContextIP(req.IPAddr)
+	resp, err := context.Create(req.Reservation, req.SteamID)
+	if err != nil || resp.Reservation.Errors != nil {
+		if err != nil {
+			logrus.Error(err)
+		} else {
+			logrus.Error(resp.Reservation.Errors)
+		}
+
+		return nil, errors.New("Couldn't get serveme reservation")
+	}
+
+	return &Server{
+		Host:          resp.Reservation.Server.IPAndPort,
+		RconPassword:  req.Reservation.RCON,
+		ReservationID: resp.Reservation.ID,
+		SteamID:       req.SteamID,
+	}, nil
+}
+
+//reservationURL returns the API URL for the server's reservation
+func (p servemeProvider) reservationURL(server *Server) string {
+	base := p.baseURL
+	if base == "" {
+		base = "https://" + helpers.GetServemeContext(server.Host).Host
+	}
+
+	return fmt.Sprintf("%s/api/reservations/%d?api_key=%s&steam_uid=%s", base, server.ReservationID,
+		url.QueryEscape(config.Constants.ServemeAPIKey), url.QueryEscape(server.SteamID))
+}
+
+func (p servemeProvider) request(method string, server *Server) (*http.Response, error) {
+	req, err := http.NewRequest(method, p.reservationURL(server), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := helpers.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("serveme returned %s for reservation %d", resp.Status, server.ReservationID)
+	}
+	return resp, nil
+}
+
+//Release ends the reservation
+func (p servemeProvider) Release(server *Server) error {
+	if server.ReservationID == 0 {
+		return nil
+	}
+
+	//failed releases are retried by the lobby's stale reservation reconciler,
+	//callers shouldn't be held up here
+	resp, err := p.request("DELETE", server)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (p servemeProvider) Status(server *Server) (ServerStatus, error) {
+	resp, err := p.request("GET", server)
+	if err != nil {
+		return StatusPending, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Reservation servemeReservation `json:"reservation"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return StatusPending, err
+	}
+
+	switch {
+	case body.Reservation.Ended:
+		return StatusEnded, nil
+	case strings.EqualFold(body.Reservation.Status, "ready"):
+		return StatusReady, nil
+	}
+	return StatusPending, nil
+}
+
+func (servemeProvider) Region(server *Server) (string, string) {
+	return helpers.GetRegion(server.Host)
+}
@@ -0,0 +1,40 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package gameserver_test
+
+import (
+	"testing"
+
+	"github.com/TF2Stadium/Helen/internal/testhelpers"
+	. "github.com/TF2Stadium/Helen/models/gameserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServemeProvider(t *testing.T) {
+	t.Parallel()
+	serveme := testhelpers.NewFakeServeme()
+	defer serveme.Close()
+	provider := NewServemeProvider(serveme.URL)
+
+	server := &Server{Host: "127.0.0.1:27015", ReservationID: 1, SteamID: "76561198000000000"}
+	serveme.SetReservation(1, "Starting", false)
+	status, err := provider.Status(server)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPending, status)
+
+	serveme.SetReservation(1, "Ready", false)
+	status, err = provider.Status(server)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusReady, status)
+
+	assert.NoError(t, provider.Release(server))
+	assert.True(t, serveme.Deleted(1))
+	status, err = provider.Status(server)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusEnded, status)
+
+	_, err = provider.Status(&Server{ReservationID: 2})
+	assert.Error(t, err)
+}
@@ -1,9 +1,63 @@
 package gameserver
 
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	db "github.com/TF2Stadium/Helen/database"
+	"github.com/TF2Stadium/Helen/helpers/secret"
+)
+
 type ServerRecord struct {
 	ID             uint
 	Host           string
 	LogSecret      string
-	ServerPassword string // sv_password
-	RconPassword   string // rcon_password
+	ServerPassword secret.String `sql:"type:text"` // sv_password
+	RconPassword   secret.String `sql:"type:text"` // rcon_password
+}
+
+//EncryptPasswords encrypts RCON and server passwords saved before encryption was enabled.
+//Passwords encrypted with an older key are encrypted again with the current one, so this
+//should be run after keys are rotated.
+func EncryptPasswords() {
+	updateSecrets("stored_servers", "rcon_password")
+	updateSecrets("server_records", "rcon_password")
+	updateSecrets("server_records", "server_password")
+}
+
+func updateSecrets(table, column string) {
+	rows, err := db.DB.DB().Query(fmt.Sprintf("SELECT id, %s FROM %s", column, table))
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	values := make(map[uint]string)
+	for rows.Next() {
+		var id uint
+		var value sql.NullString
+
+		rows.Scan(&id, &value)
+		if secret.NeedsUpdate(value.String) {
+			values[id] = value.String
+		}
+	}
+	rows.Close()
+
+	for id, value := range values {
+		updated, err := secret.Update(value)
+		if err != nil {
+			logrus.Errorf("Couldn't encrypt %s.%s for #%d: %s", table, column, id, err.Error())
+			continue
+		}
+
+		//not changed if the row was saved again in the meantime
+		query := fmt.Sprintf("UPDATE %s SET %s = $1 WHERE id = $2 AND %s = $3", table, column, column)
+		db.DB.DB().Exec(query, updated, id, value)
+	}
+
+	if len(values) != 0 {
+		logrus.Infof("Encrypted %d values in %s.%s", len(values), table, column)
+	}
 }
@@ -2,23 +2,50 @@ package gameserver
 
 import (
 	"errors"
-	"sync"
+	"strings"
+	"time"
 
 	db "github.com/TF2Stadium/Helen/database"
+	"github.com/TF2Stadium/Helen/helpers"
+	"github.com/TF2Stadium/Helen/helpers/secret"
 )
 
 type StoredServer struct {
 	ID   uint   `gorm:"primary_key" json:"id"`
 	Name string `json:"name"`
 
-	Address      string `json:"-" sql:"unique"`
-	RCONPassword string `json:"-"`
-	Used         bool   `sql:"default:false" json:"-"`
+	Address      string        `json:"-" sql:"unique"`
+	RCONPassword secret.String `json:"-" sql:"type:text"`
+	Used         bool          `sql:"default:false" json:"-"`
+
+	Region      string `sql:"default:''" json:"region"`  // region code ("na", "eu", etc), found from the address if empty
+	Tags        string `sql:"default:''" json:"tags"`    // comma separated formats the server can host ("sixes,highlander"), empty for all
+	Priority    int    `sql:"default:0" json:"priority"` // servers with a higher priority are allocated first
+	Maintenance bool   `sql:"default:false" json:"-"`    // servers under maintenance aren't used for lobbies
+
+	// updated by the health checker
+	Quarantined   bool      `sql:"default:false" json:"-"` // quarantined servers aren't used for lobbies
+	FailureStreak int       `json:"-"`                     // number of failed checks in a row
+	SuccessStreak int       `json:"-"`
+	Latency       int64     `json:"-"` // milliseconds taken by the last successful check
+	LastChecked   time.Time `json:"-"`
+	LastSuccess   time.Time `json:"-"`
 }
 
+const (
+	//condition for servers which can be used by lobbies
+	freeServer = "used = FALSE AND maintenance = FALSE AND quarantined = FALSE"
+	//order in which servers are allocated. Servers added before priorities were
+	//stored can have a NULL priority, they come after the others.
+	byPriority = "priority DESC NULLS LAST, id"
+)
+
 var (
 	ErrServerUsed          = errors.New("server is being used")
 	ErrServerAlreadyExists = errors.New("server already exists")
+	ErrServerMaintenance   = errors.New("server is under maintenance")
+	ErrServerQuarantined   = errors.New("server is offline")
+	ErrNoFreeServer        = errors.New("No free server was found in the region")
 )
 
 func NewStoredServer(name, address, passwd string) (*StoredServer, error) {
@@ -31,43 +58,124 @@ func NewStoredServer(name, address, passwd string) (*StoredServer, error) {
 	server := &StoredServer{
 		Name:         name,
 		Address:      address,
-		RCONPassword: passwd,
+		RCONPassword: secret.String(passwd),
 	}
+	server.Region, _ = helpers.GetRegion(address)
 
 	db.DB.Save(server)
 	return server, nil
 }
 
+//Save saves the server's settings, the server's Used column isn't changed
+func (s *StoredServer) Save() error {
+	return db.DB.Model(&StoredServer{}).Where("id = ?", s.ID).Updates(map[string]interface{}{
+		"name":        s.Name,
+		"region":      s.Region,
+		"tags":        s.Tags,
+		"priority":    s.Priority,
+		"maintenance": s.Maintenance,
+	}).Error
+}
+
+//HasTag returns true if the server can host lobbies with any of the given
+//tags (the name and alias of a format, like "sixes" and "6s")
+func (s *StoredServer) HasTag(tags ...string) bool {
+	if s.Tags == "" {
+		return true
+	}
+
+	for _, t := range strings.Split(s.Tags, ",") {
+		for _, tag := range tags {
+			if strings.TrimSpace(t) == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func RemoveStoredServer(addr string) {
 	db.DB.Model(&StoredServer{}).Where("address = ?", addr).Delete(&StoredServer{})
 }
 
+//GetAvailableServers returns servers which are free to be used by lobbies,
+//the ones with the highest priority first
 func GetAvailableServers() []*StoredServer {
 	var servers []*StoredServer
-	db.DB.Model(&StoredServer{}).Where("used = FALSE").Find(&servers)
+	db.DB.Model(&StoredServer{}).Where(freeServer).Order(byPriority).Find(&servers)
 	return servers
 }
 
-var storeLock = new(sync.Mutex)
+//claim marks the server as used if it's free, returning false if
+//it's used by another lobby, under maintenance or quarantined
+func (s *StoredServer) claim() bool {
+	//a single update, so that two lobbies never get the same server
+	rows := db.DB.Model(&StoredServer{}).Where("id = ? AND "+freeServer, s.ID).
+		UpdateColumn("used", true).RowsAffected
+	return rows == 1
+}
 
+//GetStoredServer marks the server with the given ID as used, and returns it
 func GetStoredServer(id uint) (*StoredServer, error) {
-	storeLock.Lock()
-	defer storeLock.Unlock()
+	server, err := GetStoredServerByID(id)
+	if err != nil {
+		return nil, err
+	}
 
-	server := &StoredServer{}
-	err := db.DB.Model(&StoredServer{}).Where("id = ?", id).First(server).Error
-	if server.Used {
+	if !server.claim() {
+		if server.Maintenance {
+			return nil, ErrServerMaintenance
+		}
+		if server.Quarantined {
+			return nil, ErrServerQuarantined
+		}
 		return nil, ErrServerUsed
 	}
 
-	db.DB.First(server).UpdateColumn("used", true)
+	server.Used = true
+	return server, nil
+}
+
+//AllocateStoredServer marks the free server in the region which can host the
+//given tags (format) with the highest priority as used, and returns it
+func AllocateStoredServer(region string, tags ...string) (*StoredServer, error) {
+	setMissingRegions()
+
+	var servers []*StoredServer
+	db.DB.Model(&StoredServer{}).Where(freeServer+" AND region = ?", region).
+		Order(byPriority).Find(&servers)
+
+	for _, server := range servers {
+		if server.HasTag(tags...) && server.claim() {
+			server.Used = true
+			return server, nil
+		}
+	}
+
+	return nil, ErrNoFreeServer
+}
+
+//setMissingRegions finds the region for servers added before regions were stored
+func setMissingRegions() {
+	var servers []*StoredServer
+	db.DB.Model(&StoredServer{}).Where("region IS NULL OR region = ''").Find(&servers)
+
+	for _, server := range servers {
+		if region, _ := helpers.GetRegion(server.Address); region != "" {
+			db.DB.Model(&StoredServer{}).Where("id = ?", server.ID).UpdateColumn("region", region)
+		}
+	}
+}
+
+//GetStoredServerByID returns the server with the given ID, without marking it as used
+func GetStoredServerByID(id uint) (*StoredServer, error) {
+	server := &StoredServer{}
+	err := db.DB.Model(&StoredServer{}).Where("id = ?", id).First(server).Error
 	return server, err
 }
 
 func PutStoredServer(address string) {
-	storeLock.Lock()
 	db.DB.Model(&StoredServer{}).Where("address = ?", address).UpdateColumn("used", false)
-	storeLock.Unlock()
 }
 
 func GetAllStoredServers() []*StoredServer {
@@ -0,0 +1,209 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package gameserver_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	db "github.com/TF2Stadium/Helen/database"
+	"github.com/TF2Stadium/Helen/internal/testhelpers"
+	. "github.com/TF2Stadium/Helen/models/gameserver"
+	"github.com/TF2Stadium/Helen/models/lobby/format"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	testhelpers.CleanupDB()
+}
+
+func TestAllocateStoredServer(t *testing.T) {
+	t.Parallel()
+
+	low, err := NewStoredServer("low", "10.0.0.1:27015", "rcon")
+	assert.NoError(t, err)
+	high, err := NewStoredServer("high", "10.0.0.2:27015", "rcon")
+	assert.NoError(t, err)
+	hl, err := NewStoredServer("hl", "10.0.0.3:27015", "rcon")
+	assert.NoError(t, err)
+
+	for i, server := range []*StoredServer{low, high, hl} {
+		server.Region = "test"
+		server.Priority = i
+	}
+	hl.Tags = "highlander"
+	for _, server := range []*StoredServer{low, high, hl} {
+		assert.NoError(t, server.Save())
+	}
+
+	server, err := AllocateStoredServer("test", "sixes")
+	assert.NoError(t, err)
+	assert.Equal(t, high.ID, server.ID)
+
+	_, err = GetStoredServer(high.ID)
+	assert.Equal(t, ErrServerUsed, err)
+
+	low.Maintenance = true
+	assert.NoError(t, low.Save())
+	_, err = AllocateStoredServer("test", "sixes")
+	assert.Equal(t, ErrNoFreeServer, err)
+
+	PutStoredServer(high.Address)
+	// only one of the concurrent allocations gets the server
+	var wg sync.WaitGroup
+	results := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := AllocateStoredServer("test", "sixes")
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	var allocated int
+	for err := range results {
+		if err == nil {
+			allocated++
+		}
+	}
+	assert.Equal(t, 1, allocated)
+}
+
+func TestAllocateNullPriority(t *testing.T) {
+	t.Parallel()
+
+	old, err := NewStoredServer("old", "10.0.3.1:27015", "rcon")
+	assert.NoError(t, err)
+	added, err := NewStoredServer("new", "10.0.3.2:27015", "rcon")
+	assert.NoError(t, err)
+	for _, server := range []*StoredServer{old, added} {
+		server.Region = "nulls"
+		assert.NoError(t, server.Save())
+	}
+	// servers added before priorities were stored
+	db.DB.Exec("UPDATE stored_servers SET priority = NULL WHERE id = ?", old.ID)
+
+	server, err := AllocateStoredServer("nulls")
+	assert.NoError(t, err)
+	assert.Equal(t, added.ID, server.ID)
+	server, err = AllocateStoredServer("nulls")
+	assert.NoError(t, err)
+	assert.Equal(t, old.ID, server.ID)
+}
+
+func TestAcquireByFormat(t *testing.T) {
+	t.Parallel()
+
+	name, err := NewStoredServer("name", "10.0.2.1:27015", "rcon")
+	assert.NoError(t, err)
+	alias, err := NewStoredServer("alias", "10.0.2.2:27015", "rcon")
+	assert.NoError(t, err)
+	hl, err := NewStoredServer("hl", "10.0.2.3:27015", "rcon")
+	assert.NoError(t, err)
+
+	name.Tags = "sixes"
+	alias.Tags = "6s"
+	hl.Tags = "highlander"
+	for _, server := range []*StoredServer{name, alias, hl} {
+		server.Region = "tags"
+		assert.NoError(t, server.Save())
+	}
+
+	// the request made for "auto" lobbies and the queue
+	provider, _ := GetProvider(ProviderStored)
+	req := ServerRequest{Region: "tags", Tags: format.Sixes.Names()}
+
+	acquired := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		server, err := provider.Acquire(req)
+		if assert.NoError(t, err) {
+			acquired[server.Host] = true
+		}
+	}
+	assert.True(t, acquired[name.Address])
+	assert.True(t, acquired[alias.Address])
+
+	_, err = provider.Acquire(req)
+	assert.Equal(t, ErrNoFreeServer, err)
+}
+
+func TestHealthCheck(t *testing.T) {
+	server, err := NewStoredServer("health", "10.0.1.1:27015", "rcon")
+	assert.NoError(t, err)
+
+	var offline = true
+	verify := func(info ServerRecord) error {
+		if info.Host == server.Address && offline {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	for i := 0; i < QuarantineFailures; i++ {
+		CheckServers(verify)
+	}
+	server, _ = GetStoredServerByID(server.ID)
+	assert.True(t, server.Quarantined)
+	assert.Equal(t, QuarantineFailures, server.FailureStreak)
+	_, err = GetStoredServer(server.ID)
+	assert.Equal(t, ErrServerQuarantined, err)
+
+	offline = false
+	for i := 0; i < RecoverSuccesses; i++ {
+		CheckServers(verify)
+	}
+	server, _ = GetStoredServerByID(server.ID)
+	assert.False(t, server.Quarantined)
+	assert.False(t, server.LastSuccess.IsZero())
+
+	checks := QuarantineFailures + RecoverSuccesses
+	assert.Len(t, server.GetHealthChecks(100), checks)
+	history := server.GetUptimeHistory()
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, checks, history[0].Checks)
+		assert.Equal(t, RecoverSuccesses, history[0].Successes)
+	}
+	assert.InDelta(t, history[0].Percent(), server.Uptime(time.Now().Add(-time.Hour)), 0.01)
+}
+
+func TestHealthCheckUnchecked(t *testing.T) {
+	server, err := NewStoredServer("unchecked", "10.0.1.2:27015", "rcon")
+	assert.NoError(t, err)
+
+	//rounds in which no server could be checked (like when Pauling is down) aren't counted
+	CheckServers(func(ServerRecord) error {
+		return UncheckedError{errors.New("connection closed")}
+	})
+	HealthCheckTimeout = 10 * time.Millisecond
+	defer func() { HealthCheckTimeout = 30 * time.Second }()
+	CheckServers(func(ServerRecord) error {
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	})
+
+	server, _ = GetStoredServerByID(server.ID)
+	assert.Zero(t, server.FailureStreak)
+	assert.Empty(t, server.GetHealthChecks(10))
+
+	//when other servers could be checked, the server's check has failed
+	_, err = NewStoredServer("checked", "10.0.1.3:27015", "rcon")
+	assert.NoError(t, err)
+	CheckServers(func(info ServerRecord) error {
+		if info.Host == server.Address {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return nil
+	})
+	server, _ = GetStoredServerByID(server.ID)
+	assert.Equal(t, 1, server.FailureStreak)
+	if checks := server.GetHealthChecks(10); assert.Len(t, checks, 1) {
+		assert.Equal(t, ErrCheckTimeout.Error(), checks[0].Error)
+	}
+}
@@ -0,0 +1,13 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package lobby
+
+//SetSay replaces the function used to send chat messages to game servers,
+//returning a function which restores it
+func SetSay(f func(lobbyID uint, text string)) (restore func()) {
+	prev := say
+	say = f
+	return func() { say = prev }
+}
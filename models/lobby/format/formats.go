@@ -1,9 +1,19 @@
+//Package format contains the registry of lobby formats. Formats are defined in the
+//lobby settings file (assets/lobbySettingsData.json) and registered when it is loaded.
 package format
 
-import "errors"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
 
 type Format int
 
+// IDs of the formats which are referenced in code (mostly for stats),
+// these must match the "id" fields in the lobby settings file.
 const (
 	Sixes      Format = iota
 	Highlander        // lol
@@ -16,133 +26,307 @@ const (
 var (
 	teamMap  = map[string]int{"red": 0, "blu": 1}
 	teamList = []string{"red", "blu"}
+)
+
+//Class is a class (or position) which can be played in a format
+type Class struct {
+	Name     string `json:"name"`   // name of the class in the format ("scout1", "roamer")
+	TF2Class string `json:"class"`  // the TF2 class, used for stats ("scout", "soldier")
+	Mumble   string `json:"mumble"` // prefix for mumble usernames
+}
+
+//UnmarshalJSON allows classes to be given either as an object, or just as their name.
+//TF2Class defaults to the name without trailing numbers, Mumble to the uppercased name.
+func (c *Class) UnmarshalJSON(data []byte) error {
+	type class Class
+	var v class
+
+	if err := json.Unmarshal(data, &v.Name); err != nil {
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+	}
 
-	sixesClassMap = map[string]int{
-		"scout1":  0,
-		"scout2":  1,
-		"roamer":  2,
-		"pocket":  3,
-		"demoman": 4,
-		"medic":   5,
-	}
-	sixesClassList = []string{"scout1", "scout2", "roamer", "pocket", "demoman", "medic"}
-
-	hlClassMap = map[string]int{
-		"scout":    0,
-		"soldier":  1,
-		"pyro":     2,
-		"demoman":  3,
-		"heavy":    4,
-		"engineer": 5,
-		"medic":    6,
-		"sniper":   7,
-		"spy":      8,
-	}
-	hlClassList = []string{
-		"scout",
-		"soldier",
-		"pyro",
-		"demoman",
-		"heavy",
-		"engineer",
-		"medic",
-		"sniper",
-		"spy"}
-
-	debugClassMap = map[string]int{
-		"scout": 0,
-	}
-	debugClassList = []string{"scout"}
-
-	bballClassMap = map[string]int{
-		"soldier1": 0,
-		"soldier2": 1,
-	}
-	bballClassList = []string{"soldier1", "soldier2"}
-
-	ultiduoClassMap = map[string]int{
-		"soldier": 0,
-		"medic":   1,
-	}
-	ultiduoClassList = []string{"soldier", "medic"}
-
-	foursClassMap = map[string]int{
-		"scout":   0,
-		"soldier": 1,
-		"demoman": 2,
-		"medic":   3,
-	}
-	foursClassList = []string{"scout", "soldier", "demoman", "medic"}
-
-	typeClassMap = map[Format]map[string]int{
-		Highlander: hlClassMap,
-		Sixes:      sixesClassMap,
-		Fours:      foursClassMap,
-		Ultiduo:    ultiduoClassMap,
-		Bball:      bballClassMap,
-		Debug:      debugClassMap,
-	}
-
-	typeClassList = map[Format][]string{
-		Highlander: hlClassList,
-		Sixes:      sixesClassList,
-		Fours:      foursClassList,
-		Ultiduo:    ultiduoClassList,
-		Bball:      bballClassList,
-		Debug:      debugClassList,
-	}
-
-	NumberOfClassesMap = map[Format]int{
-		Highlander: 9,
-		Sixes:      6,
-		Fours:      4,
-		Ultiduo:    2,
-		Bball:      2,
-		Debug:      1,
+	if v.TF2Class == "" {
+		v.TF2Class = strings.TrimRight(v.Name, "0123456789")
+	}
+	if v.Mumble == "" {
+		v.Mumble = strings.ToUpper(v.Name)
 	}
+
+	*c = Class(v)
+	return nil
+}
+
+//Definition describes a lobby format
+type Definition struct {
+	Format     Format  `json:"id"`
+	Name       string  `json:"name"`       // name used in the lobby settings ("sixes")
+	Alias      string  `json:"alias"`      // name used by clients while creating lobbies ("6s")
+	Label      string  `json:"label"`      // name shown in lobby lists ("6s", "Highlander")
+	PrettyName string  `json:"prettyName"` // name shown in lobby creation ("6v6")
+	Teams      int     `json:"teams"`      // number of teams, lobbies always have 2
+	MaxSubs    int     `json:"maxSubs"`    // the lobby is closed when this many slots need substitutes
+	Classes    []Class `json:"classes"`
+}
+
+//Playable returns true if the definition has enough information for lobbies to be created with it.
+//The lobby settings can list formats which only have a name (for map/league data).
+func (d *Definition) Playable() bool {
+	return len(d.Classes) != 0
+}
+
+var (
+	mu      = new(sync.RWMutex)
+	formats = make(map[Format]*Definition)
+	names   = make(map[string]*Definition) // name and alias -> definition
 )
 
+//validate fills in the definition's defaults, and checks that lobbies can be created with it
+func (d *Definition) validate() error {
+	if !d.Playable() {
+		return fmt.Errorf("format %q doesn't have any classes", d.Name)
+	}
+	if d.Teams == 0 {
+		d.Teams = len(teamList)
+	}
+	//slots, balancing and drafts all assume a red and a blu team
+	if d.Teams != len(teamList) {
+		return fmt.Errorf("format %q must have %d teams", d.Name, len(teamList))
+	}
+	if d.Alias == "" {
+		d.Alias = d.Name
+	}
+	if d.Label == "" {
+		d.Label = d.Alias
+	}
+
+	seen := make(map[string]bool)
+	for _, class := range d.Classes {
+		if seen[class.Name] {
+			return fmt.Errorf("format %q has duplicate class %q", d.Name, class.Name)
+		}
+		seen[class.Name] = true
+	}
+
+	return nil
+}
+
+//RegisterAll replaces the registry with the given format definitions. If any of
+//them is invalid, an error is returned and the registry isn't changed.
+func RegisterAll(defs []Definition) error {
+	newFormats := make(map[Format]*Definition)
+	newNames := make(map[string]*Definition)
+
+	for i := range defs {
+		d := defs[i]
+		if err := d.validate(); err != nil {
+			return err
+		}
+
+		if prev, ok := newFormats[d.Format]; ok {
+			return fmt.Errorf("format ID %d is used by both %q and %q", int(d.Format), prev.Name, d.Name)
+		}
+		for _, name := range []string{d.Name, d.Alias} {
+			if _, ok := newNames[name]; ok {
+				return fmt.Errorf("format name %q is already used", name)
+			}
+		}
+
+		newFormats[d.Format] = &d
+		newNames[d.Name] = &d
+		newNames[d.Alias] = &d
+	}
+
+	mu.Lock()
+	formats, names = newFormats, newNames
+	mu.Unlock()
+	return nil
+}
+
+//Register adds the given format definition to the registry, replacing
+//any previous definition with the same ID and name.
+func Register(d Definition) error {
+	if err := d.validate(); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if prev, ok := formats[d.Format]; ok && prev.Name != d.Name {
+		return fmt.Errorf("format ID %d is already used by %q", int(d.Format), prev.Name)
+	}
+	if prev, ok := names[d.Name]; ok && prev.Format != d.Format {
+		return fmt.Errorf("format name %q is already used", d.Name)
+	}
+	if prev, ok := names[d.Alias]; ok && prev.Format != d.Format {
+		return fmt.Errorf("format name %q is already used", d.Alias)
+	}
+
+	if prev, ok := formats[d.Format]; ok {
+		delete(names, prev.Name)
+		delete(names, prev.Alias)
+	}
+
+	formats[d.Format] = &d
+	names[d.Name] = &d
+	names[d.Alias] = &d
+	return nil
+}
+
+//Get returns the definition for the given format
+func Get(f Format) (*Definition, bool) {
+	mu.RLock()
+	d, ok := formats[f]
+	mu.RUnlock()
+
+	return d, ok
+}
+
+//GetByName returns the format with the given name or alias
+func GetByName(name string) (Format, bool) {
+	mu.RLock()
+	d, ok := names[name]
+	mu.RUnlock()
+
+	if !ok {
+		return 0, false
+	}
+	return d.Format, true
+}
+
+//IsValidName returns true if name is the name or alias of a registered format
+func IsValidName(name string) bool {
+	_, ok := GetByName(name)
+	return ok
+}
+
+//String returns the name used by clients for the format ("6s", "highlander", etc)
+func (f Format) String() string {
+	if d, ok := Get(f); ok {
+		return d.Alias
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+//Names returns the name and alias of the format, which can both be used in
+//the tags of stored servers
+func (f Format) Names() []string {
+	d, ok := Get(f)
+	if !ok {
+		return nil
+	}
+	if d.Alias == d.Name {
+		return []string{d.Name}
+	}
+	return []string{d.Name, d.Alias}
+}
+
+//Label returns the name shown for the format in lobby lists
+func (f Format) Label() string {
+	if d, ok := Get(f); ok {
+		return d.Label
+	}
+	return f.String()
+}
+
+//NumberOfClasses returns the number of classes per team for the given format
+func NumberOfClasses(f Format) int {
+	d, ok := Get(f)
+	if !ok {
+		return 0
+	}
+	return len(d.Classes)
+}
+
+//NumberOfSlots returns the total number of slots in a lobby with the given format
+func NumberOfSlots(f Format) int {
+	d, ok := Get(f)
+	if !ok {
+		return 0
+	}
+	return d.Teams * len(d.Classes)
+}
+
+//MaxSubs returns the number of substitutes needed at once for a lobby with the given
+//format to be closed. Formats without a limit return 0.
+func MaxSubs(f Format) int {
+	d, ok := Get(f)
+	if !ok {
+		return 0
+	}
+	return d.MaxSubs
+}
+
 //GetSlot returns the slot number for given team, class strings and the
 //lobby format
 func GetSlot(lobbytype Format, teamStr string, classStr string) (int, error) {
-	team, ok := teamMap[teamStr]
+	d, ok := Get(lobbytype)
 	if !ok {
+		return -1, errors.New("Invalid format")
+	}
+
+	team, ok := teamMap[teamStr]
+	if !ok || team >= d.Teams {
 		return -1, errors.New("Invalid team")
 	}
 
-	class, ok := typeClassMap[lobbytype][classStr]
-	if !ok {
-		return -1, errors.New("Invalid class")
+	for i, class := range d.Classes {
+		if class.Name == classStr {
+			return team*len(d.Classes) + i, nil
+		}
 	}
 
-	return team*NumberOfClassesMap[lobbytype] + class, nil
+	return -1, errors.New("Invalid class")
 }
 
 //GetSlotTeamClass returns the team and class strings for a given slot number
 func GetSlotTeamClass(lobbytype Format, slot int) (team, class string, err error) {
-	classList := typeClassList[lobbytype]
-
-	teamI, classI, err := getSlotNums(lobbytype, slot)
+	c, teamI, err := getSlotClass(lobbytype, slot)
 	if err == nil {
-		team, class, err = teamList[teamI], classList[classI], nil
+		team, class = teamList[teamI], c.Name
 	}
 	return
 }
 
-//given a slot number, returns the numbers for the
-//slot's class and team for the given format
-func getSlotNums(lobbytype Format, slot int) (int, int, error) {
-	classList := typeClassList[lobbytype]
+//GetSlotTF2Class returns the TF2 class played in the given slot ("soldier" for a roamer slot)
+func GetSlotTF2Class(lobbytype Format, slot int) (string, error) {
+	c, _, err := getSlotClass(lobbytype, slot)
+	if err != nil {
+		return "", err
+	}
+	return c.TF2Class, nil
+}
 
-	if slot < len(classList) {
-		return 0, slot, nil
-	} else if slot < 2*len(classList) {
-		return 1, slot - len(classList), nil
-	} else {
-		return 0, 0, errors.New("Invalid slot")
+//GetSlotMumbleName returns the prefix used in mumble usernames for players in the given slot
+func GetSlotMumbleName(lobbytype Format, slot int) (string, error) {
+	c, _, err := getSlotClass(lobbytype, slot)
+	if err != nil {
+		return "", err
 	}
+	return c.Mumble, nil
+}
+
+//given a slot number, returns the slot's class and team number for the given format
+func getSlotClass(lobbytype Format, slot int) (Class, int, error) {
+	d, ok := Get(lobbytype)
+	if !ok || slot < 0 || slot >= d.Teams*len(d.Classes) {
+		return Class{}, 0, errors.New("Invalid slot")
+	}
+
+	return d.Classes[slot%len(d.Classes)], slot / len(d.Classes), nil
 }
 
 func GetClasses(format Format) []string {
-	return typeClassList[format]
+	d, ok := Get(format)
+	if !ok {
+		return nil
+	}
+
+	classes := make([]string, len(d.Classes))
+	for i, class := range d.Classes {
+		classes[i] = class.Name
+	}
+	return classes
 }
@@ -5,6 +5,7 @@
 package format_test
 
 import (
+	"encoding/json"
 	"testing"
 
 	_ "github.com/TF2Stadium/Helen/helpers"
@@ -12,6 +13,47 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+var testFormats = []byte(`[
+	{
+		"id": 0,
+		"name": "sixes",
+		"alias": "6s",
+		"maxSubs": 4,
+		"classes": [
+			"scout1",
+			"scout2",
+			{"name": "roamer", "class": "soldier"},
+			{"name": "pocket", "class": "soldier"},
+			"demoman",
+			"medic"
+		]
+	},
+	{
+		"id": 1,
+		"name": "highlander",
+		"classes": ["scout", "soldier", "pyro", "demoman", "heavy", "engineer", "medic", "sniper", "spy"]
+	},
+	{
+		"id": 100,
+		"name": "prolander",
+		"alias": "7v7",
+		"classes": ["scout", "soldier", "pyro", "demoman", "heavy", "engineer", "medic", "sniper", "spy"]
+	}
+]`)
+
+func init() {
+	var defs []Definition
+	if err := json.Unmarshal(testFormats, &defs); err != nil {
+		panic(err)
+	}
+
+	for _, d := range defs {
+		if err := Register(d); err != nil {
+			panic(err)
+		}
+	}
+}
+
 var slots = []struct {
 	n     int
 	class string
@@ -45,3 +87,62 @@ func TestClassMaps(t *testing.T) {
 		assert.Equal(t, team, "red")
 	}
 }
+
+func TestRegistry(t *testing.T) {
+	f, ok := GetByName("6s")
+	assert.True(t, ok)
+	assert.Equal(t, Sixes, f)
+	f, ok = GetByName("sixes")
+	assert.True(t, ok)
+	assert.Equal(t, Sixes, f)
+	_, ok = GetByName("arena-respawn")
+	assert.False(t, ok)
+
+	assert.Equal(t, 6, NumberOfClasses(Sixes))
+	assert.Equal(t, 12, NumberOfSlots(Sixes))
+	assert.Equal(t, 4, MaxSubs(Sixes))
+	assert.Equal(t, "6s", Sixes.String())
+
+	class, err := GetSlotTF2Class(Sixes, 9)
+	assert.NoError(t, err)
+	assert.Equal(t, "soldier", class)
+	mumble, err := GetSlotMumbleName(Sixes, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "SCOUT1", mumble)
+
+	_, err = GetSlotTF2Class(Sixes, 12)
+	assert.Error(t, err)
+}
+
+func TestRegisterNewFormat(t *testing.T) {
+	prolander, ok := GetByName("7v7")
+	assert.True(t, ok)
+
+	res, err := GetSlot(prolander, "blu", "medic")
+	assert.NoError(t, err)
+	assert.Equal(t, 15, res)
+
+	err = Register(Definition{Format: 101, Name: "empty"})
+	assert.Error(t, err)
+	err = Register(Definition{Format: 102, Name: "prolander", Classes: []Class{{Name: "scout"}}})
+	assert.Error(t, err)
+
+	// IDs can't be reused by other formats
+	err = Register(Definition{Format: Sixes, Name: "passtime", Classes: []Class{{Name: "scout"}}})
+	assert.Error(t, err)
+	assert.Equal(t, "6s", Sixes.String())
+
+	err = Register(Definition{Format: 103, Name: "ffa", Teams: 3, Classes: []Class{{Name: "scout"}}})
+	assert.Error(t, err)
+}
+
+func TestRegisterAllInvalid(t *testing.T) {
+	// the registry is only replaced if all definitions are valid
+	err := RegisterAll([]Definition{
+		{Format: 104, Name: "ultiduo", Classes: []Class{{Name: "soldier"}, {Name: "medic"}}},
+		{Format: 104, Name: "bball", Classes: []Class{{Name: "soldier1"}, {Name: "soldier2"}}},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, "6s", Sixes.String())
+	assert.False(t, IsValidName("ultiduo"))
+}
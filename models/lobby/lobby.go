@@ -9,20 +9,19 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/TF2Stadium/Helen/config"
 	"github.com/TF2Stadium/Helen/controllers/broadcaster"
+	"github.com/TF2Stadium/Helen/controllers/publisher"
 	db "github.com/TF2Stadium/Helen/database"
-	"github.com/TF2Stadium/Helen/helpers"
+	"github.com/TF2Stadium/Helen/helpers/secret"
 	"github.com/TF2Stadium/Helen/models/chat"
 	"github.com/TF2Stadium/Helen/models/gameserver"
 	"github.com/TF2Stadium/Helen/models/lobby/format"
 	"github.com/TF2Stadium/Helen/models/player"
 	"github.com/TF2Stadium/Helen/models/rpc"
-	"github.com/TF2Stadium/servemetf"
+	"github.com/TF2Stadium/Helen/models/timer"
 	"github.com/jinzhu/gorm"
 )
 
@@ -33,7 +32,9 @@ const (
 	Waiting      State = 1
 	ReadyingUp   State = 2
 	InProgress   State = 3
+	Drafting     State = 4
 	Ended        State = 5
+	Scheduled    State = 6
 )
 
 var (
@@ -48,6 +49,7 @@ var (
 	ErrReqHours       = errors.New("You don't have sufficient hours to join this lobby")
 	ErrReqLobbies     = errors.New("You haven't played sufficient lobbies to join this lobby")
 	ErrReqReliability = errors.New("You have insufficient reliability to join this lobby")
+	ErrReqRating      = errors.New("Your rating doesn't fit the requirements for this lobby")
 )
 
 // Represents an occupied player slot in a lobby
@@ -56,13 +58,14 @@ type LobbySlot struct {
 	CreatedAt time.Time
 	UpdatedAt time.Time
 
-	LobbyID  uint //ID of the player occupying the slot
-	PlayerID uint //Slot number
-	Slot     int  //Denotes if the player is ready
-	Ready    bool //Denotes if the player is in game
-	InGame   bool //true if the player is in the game server
-	InMumble bool //true if the player is in the mumble channel for the lobby
-	NeedsSub bool //true if the slot needs a subtitute player
+	LobbyID    uint //ID of the player occupying the slot
+	PlayerID   uint //Slot number
+	Slot       int  //Denotes if the player is ready
+	Ready      bool //Denotes if the player is in game
+	InGame     bool //true if the player is in the game server
+	InMumble   bool //true if the player is in the mumble channel for the lobby
+	NeedsSub   bool //true if the slot needs a subtitute player
+	Substitute bool //true if the player joined as a substitute
 }
 
 //DeleteUnusedServerRecords checks all server records in the DB and deletes them if
@@ -113,10 +116,12 @@ type Lobby struct {
 	Slots []LobbySlot `gorm:"ForeignKey:LobbyID"` // List of occupied slots
 
 	RegionLock        bool
+	AutoBalance       bool              // if true, teams are balanced by rating before readying up
 	PlayerWhitelist   string            // URL of steam group
 	TwitchChannel     string            // twitch channel, slots will be restricted
 	TwitchRestriction TwitchRestriction // restricted to either followers or subs
 	ServemeID         int               // if serveme was used to get this server, stores the server ID
+	ServerProvider    string            // name of the gameserver.ServerProvider the server was acquired from
 
 	// TF2 Server Info
 	ServerInfo   gameserver.ServerRecord `gorm:"ForeignKey:ServerInfoID"`
@@ -131,6 +136,19 @@ type Lobby struct {
 
 	ReadyUpTimestamp int64 // (Unix) Timestamp at which the ready up timeout started
 	MatchEnded       bool  // if true, the lobby ended with the match ending in the game server
+
+	Winner   string // team which won the match ("red", "blu" or "draw"), empty if unknown
+	RedScore int
+	BluScore int
+
+	Draft             bool   // if true, players are picked by two captains from the players who signed up
+	RedCaptainID      uint   // ID of RED's captain, 0 if the draft hasn't started
+	BluCaptainID      uint   // ID of BLU's captain, 0 if the draft hasn't started
+	DraftTurn         string // team making the next pick ("red" or "blu"), empty while no one can pick
+	DraftPickDeadline int64  // (Unix) Timestamp at which the current pick is made automatically
+
+	StartsAt  time.Time // time at which a scheduled lobby opens, zero if it wasn't scheduled
+	RematchID uint      // ID of the lobby started as a rematch of this one, 0 if none
 }
 
 func getGamemode(mapName string, lobbyType format.Format) string {
@@ -174,7 +192,6 @@ func MapRegionFormatExists(mapName, region string, lobbytype format.Format) bool
 }
 
 // Returns a new lobby object with the given parameters
-// Call CreateLock after saving this lobby.
 func NewLobby(mapName string, lobbyType format.Format, league string, serverInfo gameserver.ServerRecord, whitelist string, mumble bool, whitelistGroup string) *Lobby {
 	lobby := &Lobby{
 		Mode:            getGamemode(mapName, lobbyType),
@@ -196,25 +213,55 @@ func NewLobby(mapName string, lobbyType format.Format, league string, serverInfo
 //Closed lobbies aren't deleted, this function is used for
 //lobbies where the game server had an error while being setup.
 func (lobby *Lobby) Delete() {
-	var count int
-
-	db.DB.Model(&gameserver.ServerRecord{}).Where("host = ?", lobby.ServerInfo.Host).Count(&count)
-	if count != 0 {
-		gameserver.PutStoredServer(lobby.ServerInfo.Host)
+	//lobbies which haven't left the Initializing state haven't been published yet
+	if state := lobby.CurrentState(); state != Initializing && state != Ended {
+		publisher.Publish(publisher.LobbyClosed{LobbyID: lobby.ID, Reason: "deleted"})
 	}
+	lobby.releaseServer()
+	db.DB.Where("lobby_id = ?", lobby.ID).Delete(&PendingServer{})
+	db.DB.Delete(lobby)
+}
 
-	if lobby.ServemeID != 0 {
-		context := helpers.GetServemeContext(lobby.ServerInfo.Host)
-		err := context.Delete(lobby.ServemeID, lobby.CreatedBySteamID)
-		for err != nil {
-			err = context.Delete(lobby.ServemeID, lobby.CreatedBySteamID)
+//Provider returns the provider the lobby's game server was acquired from
+func (lobby *Lobby) Provider() (gameserver.ServerProvider, error) {
+	name := lobby.ServerProvider
+	if name == "" { // lobbies created before providers were recorded
+		name = gameserver.ProviderStored
+		if lobby.ServemeID != 0 {
+			name = gameserver.ProviderServeme
 		}
 	}
 
-	db.DB.Delete(lobby)
-	db.DB.Delete(&lobby.ServerInfo)
+	return gameserver.GetProvider(name)
+}
 
-	lobby.deleteLock()
+//Server returns the lobby's game server, as given to it's provider
+func (lobby *Lobby) Server() *gameserver.Server {
+	return &gameserver.Server{
+		Host:          lobby.ServerInfo.Host,
+		RconPassword:  string(lobby.ServerInfo.RconPassword),
+		ReservationID: lobby.ServemeID,
+		SteamID:       lobby.CreatedBySteamID,
+	}
+}
+
+//SetServer sets the lobby's game server to one acquired from the named provider.
+//The lobby has to be saved after this.
+func (lobby *Lobby) SetServer(provider string, server *gameserver.Server) {
+	lobby.ServerProvider = provider
+	lobby.ServerInfo.Host = server.Host
+	lobby.ServerInfo.RconPassword = secret.String(server.RconPassword)
+	lobby.ServemeID = server.ReservationID
+}
+
+//ServerStatus returns the status of the lobby's game server from it's provider
+func (lobby *Lobby) ServerStatus() (gameserver.ServerStatus, error) {
+	provider, err := lobby.Provider()
+	if err != nil {
+		return gameserver.StatusPending, err
+	}
+
+	return provider.Status(lobby.Server())
 }
 
 //GetWaitingLobbies returns a list of lobby objects that haven't been filled yet
@@ -232,43 +279,6 @@ func (l *Lobby) CurrentState() State {
 	return State(state)
 }
 
-func (l *Lobby) SetState(s State) {
-	db.DB.Model(&Lobby{}).Where("id = ?", l.ID).UpdateColumn("state", s)
-	l.State = s
-}
-
-//ServemeCheck checks the status of the serveme reservation for the lobby
-//(if any) every 10 seconds in a goroutine, and closes the lobby if it has ended
-func (l *Lobby) ServemeCheck(context *servemetf.Context) {
-	go func() {
-		for {
-			ended, err := context.Ended(l.ServemeID, l.CreatedBySteamID)
-			if err != nil {
-				logrus.Error(err)
-			}
-			if ended {
-				if l.CurrentState() != Ended {
-					chat.SendNotification("Lobby Closed (Serveme reservation ended.)", int(l.ID))
-					l.Close(true, false)
-				}
-				return
-			}
-			time.Sleep(10 * time.Second)
-		}
-	}()
-}
-
-func RestoreServemeChecks() {
-	var ids []uint
-	db.DB.Model(&Lobby{}).Where("state <> ? AND serveme_id <> 0", Ended).Pluck("id", &ids)
-
-	for _, id := range ids {
-		lobby, _ := GetLobbyByIDServer(id)
-		context := helpers.GetServemeContext(lobby.ServerInfo.Host)
-		lobby.ServemeCheck(context)
-	}
-}
-
 //GetPlayerSlotObj returns the LobbySlot object if the given player occupies a slot in the lobby.
 func (lobby *Lobby) GetPlayerSlotObj(player *player.Player) (*LobbySlot, error) {
 	slotObj := &LobbySlot{}
@@ -294,19 +304,37 @@ func (lobby *Lobby) GetPlayerIDBySlot(slot int) (uint, error) {
 	return uint(slotObj.PlayerID), err
 }
 
-//Save saves changes made to lobby object to the DB
+//Save saves changes made to lobby object to the DB.
+//The lobby's state isn't saved for existing lobbies, use SetState to change it.
 func (lobby *Lobby) Save() error {
 	var err error
 	if db.DB.NewRecord(lobby) {
 		err = db.DB.Create(lobby).Error
 	} else {
-		err = db.DB.Save(lobby).Error
+		err = db.DB.Omit("state").Save(lobby).Error
 	}
 
 	lobby.OnChange(true)
 	return err
 }
 
+//publishCreated publishes the lobby's creation, once it has left the Initializing state
+func (lobby *Lobby) publishCreated() {
+	lob, err := GetLobbyByID(lobby.ID)
+	if err != nil {
+		return
+	}
+
+	publisher.Publish(publisher.LobbyCreated{
+		LobbyID:   lob.ID,
+		Type:      lob.Type.Label(),
+		Map:       lob.MapName,
+		League:    lob.League,
+		Region:    lob.RegionCode,
+		CreatedBy: lob.CreatedBySteamID,
+	})
+}
+
 //GetLobbyByIdServer returns the lobby object, plus the ServerInfo object inside it
 func GetLobbyByIDServer(id uint) (*Lobby, error) {
 	lob := &Lobby{}
@@ -381,7 +409,7 @@ func (lobby *Lobby) AddPlayer(p *player.Player, slot int, password string) error
 		return ErrLobbyBan
 	}
 
-	if slot >= 2*format.NumberOfClassesMap[lobby.Type] || slot < 0 {
+	if slot >= format.NumberOfSlots(lobby.Type) || slot < 0 {
 		return ErrBadSlot
 	}
 
@@ -393,45 +421,24 @@ func (lobby *Lobby) AddPlayer(p *player.Player, slot int, password string) error
 	}
 
 	if lobby.HasSlotRequirement(slot) {
-		//check if player fits the requirements for the slot
-		if ok, err := lobby.FitsRequirements(p, slot); !ok {
-			return err
-		}
-
 		req, _ := lobby.GetSlotRequirement(slot)
 		if password != req.Password {
 			return ErrInvalidPassword
 		}
 	}
 
-	if config.Constants.SteamDevAPIKey != "" {
-		if time.Since(p.ProfileUpdatedAt) < time.Hour*time.Duration(150-p.GameHours) {
-			//update player info only if the number of hours needed > the number of hours
-			//passed since player info was last updated
-			p.UpdatePlayerInfo()
-		}
-		if p.GameHours < 150 {
-			return errors.New("You need at least 150 hours to join lobbies.")
-		}
+	if err := player.GetJoinPolicy().Check(p); err != nil {
+		return err
 	}
 
 	var slotChange bool
+	var curLobby *Lobby
 	//Check if the player is currently in another lobby
 	if currLobbyID, err := p.GetLobbyID(false); err == nil {
 		if currLobbyID != lobby.ID {
-			//if the player is in a different lobby, remove them from that lobby
-			//plus substitute them
-			curLobby, _ := GetLobbyByID(currLobbyID)
-
-			if curLobby.State == InProgress {
-				curLobby.Substitute(p)
-			} else {
-				curLobby.Lock()
-				db.DB.Where("player_id = ? AND lobby_id = ?", p.ID, curLobby.ID).Delete(&LobbySlot{})
-				curLobby.Unlock()
-
-			}
-
+			//if the player is in a different lobby, they're removed from it
+			//(or substituted) once they get the new slot
+			curLobby, _ = GetLobbyByID(currLobbyID)
 		} else { //player is in the same lobby, they're changing their slots
 			//assign the player to a new slot
 			if isSubstitution {
@@ -439,49 +446,78 @@ func (lobby *Lobby) AddPlayer(p *player.Player, slot int, password string) error
 				//so players already in the lobby cannot fill it.
 				return ErrNeedsSub
 			}
-			lobby.Lock()
-			db.DB.Where("player_id = ? AND lobby_id = ?", p.ID, lobby.ID).Delete(&LobbySlot{})
-			lobby.Unlock()
 
 			slotChange = true
 		}
 	}
 
+	//players changing slots have already met the rules for the whole lobby
+	//(steam group, twitch, region lock)
+	rules := lobby.slotRules(slot)
 	if !slotChange {
-		//check if the player is in the steam group whitelist
-		url := fmt.Sprintf(`http://steamcommunity.com/groups/%s/memberslistxml/?xml=1`,
-			lobby.PlayerWhitelist)
+		rules = lobby.Rules(slot)
+	}
+	if err := lobby.CheckRules(p, slot, rules); err != nil {
+		return err
+	}
+
+	var prevPlayer *player.Player
+	if isSubstitution {
+		//get previous slot, to kick them from game
+		prevPlayerID, _ := lobby.GetPlayerIDBySlot(slot)
+		prevPlayer, _ = player.GetPlayerByID(prevPlayerID)
+	}
+
+	newSlotObj := &LobbySlot{
+		PlayerID:   p.ID,
+		LobbyID:    lobby.ID,
+		Slot:       slot,
+		Substitute: isSubstitution,
+	}
 
-		if lobby.PlayerWhitelist != "" && !helpers.IsWhitelisted(p.SteamID, url) {
-			return ErrNotWhitelisted
+	//claim the slot. (lobby_id, slot) is unique, so only one player can get it,
+	//even if the slot was free when both checked it.
+	err := lobby.WithLock(func(tx *gorm.DB) error {
+		if slotChange {
+			tx.Where("player_id = ? AND lobby_id = ?", p.ID, lobby.ID).Delete(&LobbySlot{})
 		}
 
-		//check if player has been subbed to the twitch channel (if any)
-		//allow channel owners
-		if lobby.TwitchChannel != "" && p.TwitchName != lobby.TwitchChannel {
-			//check if player has connected their twitch account
-			if p.TwitchAccessToken == "" {
-				return errors.New("You need to connect your Twitch Account first to join the lobby.")
-			}
-			if lobby.TwitchRestriction == TwitchSubscribers && !p.IsSubscribed(lobby.TwitchChannel) {
-				return fmt.Errorf("You aren't subscribed to %s", lobby.TwitchChannel)
-			}
-			if lobby.TwitchRestriction == TwitchFollowers && !p.IsFollowing(lobby.TwitchChannel) {
-				return fmt.Errorf("You aren't following %s", lobby.TwitchChannel)
+		if isSubstitution {
+			//someone else might have filled the substitute slot already
+			if tx.Where("lobby_id = ? AND slot = ? AND needs_sub = TRUE", lobby.ID, slot).Delete(&LobbySlot{}).RowsAffected != 1 {
+				return ErrFilled
 			}
 		}
+
+		var reserved int
+		tx.Model(&SlotReservation{}).Where("lobby_id = ? AND slot = ? AND player_id <> ?", lobby.ID, slot, p.ID).Count(&reserved)
+		if reserved != 0 {
+			return ErrSlotReserved
+		}
+
+		if tx.Create(newSlotObj).Error != nil {
+			return ErrFilled
+		}
+		//the player's reserved slot (if any) is open to others now
+		return tx.Where("lobby_id = ? AND player_id = ?", lobby.ID, p.ID).Delete(&SlotReservation{}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	if curLobby != nil {
+		//remove the player from their previous lobby, plus substitute them
+		if curLobby.State == InProgress {
+			curLobby.Substitute(p)
+		} else {
+			curLobby.WithLock(func(tx *gorm.DB) error {
+				return tx.Where("player_id = ? AND lobby_id = ?", p.ID, curLobby.ID).Delete(&LobbySlot{}).Error
+			})
+		}
 	}
 
 	// Check if player is a substitute (the slot needs a subtitute)
 	if isSubstitution {
-		//get previous slot, to kick them from game
-		prevPlayerID, _ := lobby.GetPlayerIDBySlot(slot)
-		prevPlayer, _ := player.GetPlayerByID(prevPlayerID)
-
-		lobby.Lock()
-		db.DB.Where("lobby_id = ? AND slot = ?", lobby.ID, slot).Delete(&LobbySlot{})
-		lobby.Unlock()
-
 		go func() {
 			//kicks previous slot occupant if they're in-game, resets their !rep count, removes them from the lobby
 			rpc.DisallowPlayer(lobby.ID, prevPlayer.SteamID, prevPlayer.ID)
@@ -496,32 +532,33 @@ func (lobby *Lobby) AddPlayer(p *player.Player, slot int, password string) error
 	//try to remove them from spectators
 	lobby.RemoveSpectator(p, true)
 
-	newSlotObj := &LobbySlot{
-		PlayerID: p.ID,
-		LobbyID:  lobby.ID,
-		Slot:     slot,
-	}
-
-	lobby.Lock()
-	db.DB.Create(newSlotObj)
-	lobby.Unlock()
 	if !slotChange {
 		if p.TwitchName != "" {
 			rpc.TwitchBotAnnouce(p.TwitchName, lobby.ID)
 		}
 	}
 
+	lobby.reservationsDone()
 	lobby.OnChange(true)
 	p.SetMumbleUsername(lobby.Type, slot)
 
+	team, class, _ := format.GetSlotTeamClass(lobby.Type, slot)
+	publisher.Publish(publisher.PlayerJoinedSlot{
+		LobbyID: lobby.ID,
+		SteamID: p.SteamID,
+		Slot:    slot,
+		Team:    team,
+		Class:   class,
+	})
+
 	return nil
 }
 
 //RemovePlayer removes a given player from the lobby
 func (lobby *Lobby) RemovePlayer(player *player.Player) error {
-	lobby.Lock()
-	err := db.DB.Where("player_id = ? AND lobby_id = ?", player.ID, lobby.ID).Delete(&LobbySlot{}).Error
-	lobby.Unlock()
+	err := lobby.WithLock(func(tx *gorm.DB) error {
+		return tx.Where("player_id = ? AND lobby_id = ?", player.ID, lobby.ID).Delete(&LobbySlot{}).Error
+	})
 
 	if err != nil {
 		return err
@@ -529,6 +566,7 @@ func (lobby *Lobby) RemovePlayer(player *player.Player) error {
 
 	rpc.DisallowPlayer(lobby.ID, player.SteamID, player.ID)
 	lobby.OnChange(true)
+	publisher.Publish(publisher.PlayerLeft{LobbyID: lobby.ID, SteamID: player.SteamID})
 	return nil
 }
 
@@ -579,9 +617,9 @@ func (lobby *Lobby) RemoveUnreadyPlayers(spec bool) error {
 	}
 
 	//remove players which aren't ready
-	lobby.Lock()
-	err := db.DB.Where("lobby_id = ? AND ready = ?", lobby.ID, false).Delete(&LobbySlot{}).Error
-	lobby.Unlock()
+	err := lobby.WithLock(func(tx *gorm.DB) error {
+		return tx.Where("lobby_id = ? AND ready = ?", lobby.ID, false).Delete(&LobbySlot{}).Error
+	})
 
 	if spec {
 		for _, id := range playerids {
@@ -593,27 +631,42 @@ func (lobby *Lobby) RemoveUnreadyPlayers(spec bool) error {
 	return err
 }
 
-var (
-	inGameMu    = new(sync.Mutex)
-	inGameTimer = make(map[uint]*time.Timer)
-)
+//names of the timers registered with RegisterNotInGameFunc
+var notInGameTimers []string
 
-//AfterPlayerNotInGameFunc waits the duration to elapse, and if the given player
-//is still not in the game server, calls f in it's own goroutine.
-func (lobby *Lobby) AfterPlayerNotInGameFunc(player *player.Player, d time.Duration, f func()) {
-	helpers.GlobalWait.Add(1)
+//RegisterNotInGameFunc registers f to be called by timers with the given name
+//started with AfterPlayerNotInGameFunc, if the player still isn't in the game server.
+//Should be called from init functions.
+func RegisterNotInGameFunc(name string, f func(*Lobby, *player.Player)) {
+	notInGameTimers = append(notInGameTimers, name)
+
+	timer.Register(name, func(lobbyID, playerID uint) {
+		lobby, err := GetLobbyByID(lobbyID)
+		if err != nil {
+			return
+		}
+		p, err := player.GetPlayerByID(playerID)
+		if err != nil {
+			return
+		}
 
-	inGameMu.Lock()
-	inGameTimer[player.ID] = time.AfterFunc(d, func() {
 		var count int
-		db.DB.Model(&LobbySlot{}).Where("lobby_id = ? AND player_id = ? AND needs_sub = FALSE AND in_game = FALSE", lobby.ID, player.ID).Count(&count)
+		db.DB.Model(&LobbySlot{}).Where("lobby_id = ? AND player_id = ? AND needs_sub = FALSE AND in_game = FALSE", lobby.ID, p.ID).Count(&count)
 
 		if count != 0 && lobby.CurrentState() != Ended {
-			f()
+			f(lobby, p)
 		}
-		helpers.GlobalWait.Done()
 	})
-	inGameMu.Unlock()
+}
+
+//AfterPlayerNotInGameFunc starts the timer with the given name (registered with RegisterNotInGameFunc),
+//which runs after the duration has elapsed if the given player still isn't in the game server.
+//The timer is stored in the database, so it survives restarts.
+func (lobby *Lobby) AfterPlayerNotInGameFunc(player *player.Player, d time.Duration, name string) {
+	err := timer.AfterFunc(name, lobby.ID, player.ID, d)
+	if err != nil {
+		logrus.Error(err)
+	}
 }
 
 //IsPlayerInGame returns true if the player is in-game
@@ -638,9 +691,9 @@ func (lobby *Lobby) IsPlayerReady(player *player.Player) (bool, error) {
 
 //UnreadyAllPlayers unreadies all players in the lobby
 func (lobby *Lobby) UnreadyAllPlayers() error {
-	lobby.Lock()
-	err := db.DB.Model(&LobbySlot{}).Where("lobby_id = ?", lobby.ID).UpdateColumn("ready", false).Error
-	lobby.Unlock()
+	err := lobby.WithLock(func(tx *gorm.DB) error {
+		return tx.Model(&LobbySlot{}).Where("lobby_id = ?", lobby.ID).UpdateColumn("ready", false).Error
+	})
 
 	lobby.OnChange(false)
 	return err
@@ -657,7 +710,7 @@ func (lobby *Lobby) IsEveryoneReady() bool {
 	readyPlayers := 0
 	db.DB.Model(&LobbySlot{}).Where("lobby_id = ? AND ready = ?", lobby.ID, true).Count(&readyPlayers)
 
-	return readyPlayers == 2*format.NumberOfClassesMap[lobby.Type]
+	return readyPlayers == format.NumberOfSlots(lobby.Type)
 }
 
 //AddSpectator adds a given player as a lobby spectator
@@ -695,7 +748,7 @@ func (lobby *Lobby) GetPlayerNumber() int {
 
 //IsFull returns whether all lobby spots have been filled
 func (lobby *Lobby) IsFull() bool {
-	return lobby.GetPlayerNumber() == 2*format.NumberOfClassesMap[lobby.Type]
+	return lobby.GetPlayerNumber() == format.NumberOfSlots(lobby.Type)
 }
 
 //IsSlotFilled returns whether the given slot (by number) is occupied by a player
@@ -734,18 +787,24 @@ func (lobby *Lobby) SetupServer() error {
 //  The corresponding ServerRecord is deleted
 //
 //If rpc == true, the log listener in Pauling for the corresponding server is stopped, this is
-//used when the lobby is closed manually by a player
-func (lobby *Lobby) Close(doRPC, matchEnded bool) {
-	var count int
-
-	db.DB.Preload("ServerInfo").First(lobby, lobby.ID)
-	db.DB.Model(&gameserver.ServerRecord{}).Where("host = ?", lobby.ServerInfo.Host).Count(&count)
-	if count != 0 {
-		gameserver.PutStoredServer(lobby.ServerInfo.Host)
+//used when the lobby is closed manually by a player.
+//cause and actorID are recorded in the lobby's state history. Lobbies which have already been
+//closed are left untouched.
+func (lobby *Lobby) Close(doRPC, matchEnded bool, cause string, actorID uint) {
+	if err := lobby.SetState(Ended, cause, actorID); err != nil {
+		logrus.Warningf("Couldn't close lobby %d: %s", lobby.ID, err.Error())
+		return
 	}
+	publisher.Publish(publisher.LobbyClosed{LobbyID: lobby.ID, Reason: cause, MatchEnded: matchEnded})
 
-	lobby.SetState(Ended)
+	db.DB.Preload("ServerInfo").First(lobby, lobby.ID)
 	db.DB.First(lobby).UpdateColumn("match_ended", matchEnded)
+	db.DB.Where("lobby_id = ?", lobby.ID).Delete(&DraftSignup{})
+	db.DB.Where("lobby_id = ?", lobby.ID).Delete(&SlotReservation{})
+	db.DB.Where("lobby_id = ?", lobby.ID).Delete(&PendingServer{})
+	lobby.clearChatRelays()
+	timer.Stop("expireReservations", lobby.ID, 0)
+	timer.Stop("openScheduledLobby", lobby.ID, 0)
 	//db.DB.Exec("DELETE FROM spectators_players_lobbies WHERE lobby_id = ?", lobby.ID)
 	if doRPC {
 		rpc.End(lobby.ID)
@@ -753,12 +812,14 @@ func (lobby *Lobby) Close(doRPC, matchEnded bool) {
 	if matchEnded {
 		lobby.UpdateStats()
 	}
-	if lobby.ServemeID != 0 {
-		context := helpers.GetServemeContext(lobby.ServerInfo.Host)
-		err := context.Delete(lobby.ServemeID, lobby.CreatedBySteamID)
-		if err != nil {
+	//the leader can start a rematch on the same server for a while, so it's kept till then
+	if matchEnded && lobby.CreatedBySteamID != "" {
+		if err := timer.AfterFunc("releaseRematchServer", lobby.ID, 0, RematchWindow); err != nil {
 			logrus.Error(err)
+			lobby.releaseServer()
 		}
+	} else {
+		lobby.releaseServer()
 	}
 
 	privateRoom := fmt.Sprintf("%d_private", lobby.ID)
@@ -767,12 +828,10 @@ func (lobby *Lobby) Close(doRPC, matchEnded bool) {
 	publicRoom := fmt.Sprintf("%d_public", lobby.ID)
 	broadcaster.SendMessageToRoom(publicRoom, "lobbyClosed", DecorateLobbyClosed(lobby))
 
-	db.DB.Model(&gameserver.ServerRecord{}).Where("id = ?", lobby.ServerInfoID).Delete(&gameserver.ServerRecord{})
 	BroadcastSubList()
 	BroadcastLobby(lobby)
 	BroadcastLobbyList() // has to be done manually for now
 	rpc.FumbleLobbyEnded(lobby.ID)
-	lobby.deleteLock()
 }
 
 //UpdateStats updates the PlayerStats records for all players in the lobby
@@ -800,15 +859,9 @@ func (lobby *Lobby) setInGameStatus(player *player.Player, inGame bool) error {
 
 //SetInGame sets the in-game status of the given player to true
 func (lobby *Lobby) SetInGame(player *player.Player) error {
-	inGameMu.Lock()
-	timer, ok := inGameTimer[player.ID]
-	if ok {
-		if timer.Stop() {
-			helpers.GlobalWait.Done()
-		}
-		delete(inGameTimer, player.ID)
+	for _, name := range notInGameTimers {
+		timer.Stop(name, lobby.ID, player.ID)
 	}
-	inGameMu.Unlock()
 
 	return lobby.setInGameStatus(player, true)
 }
@@ -837,16 +890,13 @@ func (lobby *Lobby) SetNotInMumble(player *player.Player) error {
 
 //Start sets lobby.State to LobbyStateInProgress, calls SubNotInGamePlayers after 5 minutes
 func (lobby *Lobby) Start() {
-	lobby.Lock()
-	if lobby.State == InProgress {
-		lobby.Unlock()
+	//SetState only changes the state if it hasn't been changed by someone else
+	if err := lobby.SetState(InProgress, "all players ready", 0); err != nil {
 		return
 	}
 
-	db.DB.Model(&Lobby{}).Where("id = ?", lobby.ID).Update("state", InProgress)
-	lobby.Unlock()
-
 	rpc.ReExecConfig(lobby.ID, false)
+	publisher.Publish(publisher.LobbyStarted{LobbyID: lobby.ID})
 	// var playerids []uint
 	// db.DB.Model(&LobbySlot{}).Where("lobby_id = ?", lobby.ID).Pluck("player_id", &playerids)
 
@@ -861,11 +911,16 @@ func (lobby *Lobby) Start() {
 //OnChange broadcasts the given lobby to other players. If base is true, broadcasts the lobby list too.
 func (lobby *Lobby) OnChange(base bool) {
 	switch lobby.State {
-	case Waiting, InProgress, ReadyingUp:
+	case Waiting, Drafting, InProgress, ReadyingUp:
 		BroadcastLobby(lobby)
 		if base {
 			BroadcastLobbyList()
 		}
+	case Scheduled:
+		BroadcastLobby(lobby)
+		if base {
+			BroadcastUpcomingLobbyList()
+		}
 	}
 }
 
@@ -888,27 +943,27 @@ func BroadcastLobbyList() {
 		"lobbyListData", DecorateLobbyListData(GetWaitingLobbies(), false))
 }
 
-var maxSubs = map[format.Format]int{
-	format.Highlander: 5,
-	format.Sixes:      4,
-	format.Bball:      2,
-	format.Ultiduo:    2,
-	format.Debug:      2,
-	format.Fours:      2,
-}
-
 //Substitute sets the needs_sub column of the given slot to true, and broadcasts the new
 //substitute list
 func (lobby *Lobby) Substitute(player *player.Player) {
-	lobby.Lock()
-	db.DB.Model(&LobbySlot{}).Where("lobby_id = ? AND player_id = ?", lobby.ID, player.ID).UpdateColumn("needs_sub", true)
-	lobby.Unlock()
+	slot, _ := lobby.GetPlayerSlot(player)
+	lobby.WithLock(func(tx *gorm.DB) error {
+		return tx.Model(&LobbySlot{}).Where("lobby_id = ? AND player_id = ?", lobby.ID, player.ID).UpdateColumn("needs_sub", true).Error
+	})
+
+	team, class, _ := format.GetSlotTeamClass(lobby.Type, slot)
+	publisher.Publish(publisher.SubstituteNeeded{
+		LobbyID: lobby.ID,
+		SteamID: player.SteamID,
+		Team:    team,
+		Class:   class,
+	})
 
 	var count int
 	db.DB.Model(&LobbySlot{}).Where("lobby_id = ? AND needs_sub = TRUE", lobby.ID).Count(&count)
-	if count == maxSubs[lobby.Type] {
+	if count == format.MaxSubs(lobby.Type) {
 		chat.SendNotification("Lobby closed (Too many subs).", int(lobby.ID))
-		lobby.Close(true, false)
+		lobby.Close(true, false, "too many substitutes", 0)
 	}
 
 	db.DB.Preload("Stats").First(player, player.ID)
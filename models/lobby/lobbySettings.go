@@ -10,6 +10,7 @@ import (
 	"fmt"
 
 	"github.com/TF2Stadium/Helen/assets"
+	"github.com/TF2Stadium/Helen/models/lobby/format"
 	"github.com/bitly/go-simplejson"
 )
 
@@ -126,9 +127,9 @@ func LoadLobbySettingsFromFile(fileName string) error {
 func LoadLobbySettings(data []byte) error {
 	var args struct {
 		Formats []struct {
-			Name       string `json:"name"`
-			PrettyName string `json:"prettyName"`
-			Important  bool   `json:"important"`
+			format.Definition
+			ID        *format.Format `json:"id"` // required for playable formats
+			Important bool           `json:"important"`
 		} `json:"formats"`
 		Maps []struct {
 			Name    string         `json:"name"`
@@ -153,28 +154,46 @@ func LoadLobbySettings(data []byte) error {
 		return err
 	}
 
-	// formats
-	LobbyFormats = make([]LobbyFormat, len(args.Formats))
-	lobbyFormatFromName = make(map[string]int)
-	for i, format := range args.Formats {
-		LobbyFormats[i] = LobbyFormat{
-			Name:       format.Name,
-			PrettyName: format.PrettyName,
-			Important:  format.Important,
+	// formats, a playable format without an id would replace the one with ID 0
+	var defs []format.Definition
+	lobbyFormats := make([]LobbyFormat, len(args.Formats))
+	formatFromName := make(map[string]int)
+	for i, f := range args.Formats {
+		if f.ID != nil {
+			f.Format = *f.ID
+		} else if f.Playable() {
+			return fmt.Errorf("format %q doesn't have an id", f.Name)
+		}
+
+		lobbyFormats[i] = LobbyFormat{
+			Name:       f.Name,
+			PrettyName: f.PrettyName,
+			Important:  f.Important,
+		}
+		formatFromName[f.Name] = i
+
+		// formats without classes are only used for listing maps and leagues
+		if f.Playable() {
+			defs = append(defs, f.Definition)
 		}
-		lobbyFormatFromName[format.Name] = i
+	}
+	getFormat := func(name string) (*LobbyFormat, bool) {
+		if i, ok := formatFromName[name]; ok {
+			return &lobbyFormats[i], true
+		}
+		return nil, false
 	}
 
 	// maps
-	LobbyMaps = make([]LobbyMap, len(args.Maps))
-	lobbyMapFromName = make(map[string]int)
+	lobbyMaps := make([]LobbyMap, len(args.Maps))
+	mapFromName := make(map[string]int)
 	for i, amap := range args.Maps {
 		lobbyMap := LobbyMap{
 			Name:    amap.Name,
 			Formats: make([]*LobbyMapFormat, 0, len(amap.Formats)),
 		}
 		for name, importance := range amap.Formats {
-			if lobbyFormat, ok := GetLobbyFormat(name); ok {
+			if lobbyFormat, ok := getFormat(name); ok {
 				lobbyMap.Formats = append(lobbyMap.Formats, &LobbyMapFormat{
 					Format:     lobbyFormat,
 					Importance: importance,
@@ -184,13 +203,13 @@ func LoadLobbySettings(data []byte) error {
 			}
 		}
 
-		LobbyMaps[i] = lobbyMap
-		lobbyMapFromName[amap.Name] = i
+		lobbyMaps[i] = lobbyMap
+		mapFromName[amap.Name] = i
 	}
 
 	// leagues
-	LobbyLeagues = make([]LobbyLeague, len(args.Leagues))
-	lobbyLeagueFromName = make(map[string]int)
+	lobbyLeagues := make([]LobbyLeague, len(args.Leagues))
+	leagueFromName := make(map[string]int)
 	for i, league := range args.Leagues {
 		lobbyLeague := LobbyLeague{
 			Name:         league.Name,
@@ -206,7 +225,7 @@ func LoadLobbySettings(data []byte) error {
 			lobbyLeague.Descriptions = append(lobbyLeague.Descriptions, lobbyLeagueDescription)
 		}
 		for name, used := range league.Formats {
-			if lobbyFormat, ok := GetLobbyFormat(name); ok {
+			if lobbyFormat, ok := getFormat(name); ok {
 				lobbyLeagueFormat := &LobbyLeagueFormat{
 					Format: lobbyFormat,
 					Used:   used,
@@ -217,25 +236,25 @@ func LoadLobbySettings(data []byte) error {
 			}
 		}
 
-		LobbyLeagues[i] = lobbyLeague
-		lobbyLeagueFromName[league.Name] = i
+		lobbyLeagues[i] = lobbyLeague
+		leagueFromName[league.Name] = i
 	}
 
 	// whitelists
-	LobbyWhitelists = make([]LobbyWhitelist, len(args.Whitelists))
-	lobbyWhitelistFromID = make(map[int]int)
+	lobbyWhitelists := make([]LobbyWhitelist, len(args.Whitelists))
+	whitelistFromID := make(map[int]int)
 	for i, whitelist := range args.Whitelists {
-		if lobbyLeague, ok := GetLobbyLeague(whitelist.League); ok {
-			if lobbyFormat, ok := GetLobbyFormat(whitelist.Format); ok {
+		if l, ok := leagueFromName[whitelist.League]; ok {
+			if lobbyFormat, ok := getFormat(whitelist.Format); ok {
 				lobbyWhitelist := LobbyWhitelist{
 					ID:         whitelist.ID,
 					PrettyName: whitelist.PrettyName,
-					League:     lobbyLeague,
+					League:     &lobbyLeagues[l],
 					Format:     lobbyFormat,
 				}
 
-				LobbyWhitelists[i] = lobbyWhitelist
-				lobbyWhitelistFromID[whitelist.ID] = i
+				lobbyWhitelists[i] = lobbyWhitelist
+				whitelistFromID[whitelist.ID] = i
 			} else {
 				return errors.New(fmt.Sprintf("Referenced a non existing format %q", whitelist.Format))
 			}
@@ -244,6 +263,16 @@ func LoadLobbySettings(data []byte) error {
 		}
 	}
 
+	// nothing is changed till the whole file is known to be valid,
+	// formats which aren't in the file anymore are removed
+	if err := format.RegisterAll(defs); err != nil {
+		return err
+	}
+
+	LobbyFormats, lobbyFormatFromName = lobbyFormats, formatFromName
+	LobbyMaps, lobbyMapFromName = lobbyMaps, mapFromName
+	LobbyLeagues, lobbyLeagueFromName = lobbyLeagues, leagueFromName
+	LobbyWhitelists, lobbyWhitelistFromID = lobbyWhitelists, whitelistFromID
 	return nil
 }
 
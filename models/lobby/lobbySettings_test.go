@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	. "github.com/TF2Stadium/Helen/models/lobby"
+	"github.com/TF2Stadium/Helen/models/lobby/format"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -63,6 +64,8 @@ var testSettingsData = []byte(`
 
 func TestSettingsLoad(t *testing.T) {
 	assert := assert.New(t)
+	// the test settings don't have any playable formats
+	defer LoadLobbySettingsFromFile("assets/lobbySettingsData.json")
 
 	err := LoadLobbySettings(testSettingsData)
 
@@ -115,4 +118,18 @@ func TestSettingsLoad(t *testing.T) {
 		_, err := LobbySettingsToJSON().Encode()
 		assert.NoError(err)
 	}
+
+	// playable formats need an id
+	err = LoadLobbySettings([]byte(`{"formats": [{"name": "passtime", "classes": ["scout"]}]}`))
+	assert.Error(err)
+	assert.Equal(3, len(LobbyFormats))
+
+	// nothing is loaded from invalid files
+	err = LoadLobbySettings([]byte(`{
+		"formats": [{"id": 200, "name": "passtime", "classes": ["scout"]}],
+		"whitelists": [{"id": 1, "league": "ugc", "format": "passtime"}]
+	}`))
+	assert.Error(err)
+	assert.Equal(3, len(LobbyFormats))
+	assert.False(format.IsValidName("passtime"))
 }
@@ -0,0 +1,112 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package lobby
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	db "github.com/TF2Stadium/Helen/database"
+	"github.com/TF2Stadium/Helen/models/player"
+	"github.com/TF2Stadium/Helen/models/rpc"
+)
+
+const (
+	//ChatRelayPrefix is put before messages relayed to the game server
+	ChatRelayPrefix = "[TF2Stadium]"
+	//ChatRelayInterval is the minimum time between two messages relayed for a player
+	ChatRelayInterval = 2 * time.Second
+)
+
+//ChatRelay records that a player wants their messages in the lobby's chat room
+//to be relayed to the game server
+type ChatRelay struct {
+	ID       uint `gorm:"primary_key"`
+	LobbyID  uint
+	PlayerID uint
+}
+
+//say sends text to the lobby's game server, replaced in tests
+var say = rpc.Say
+
+var (
+	lastRelayed   = make(map[string]time.Time) // "lobbyID_playerID" -> time of the last relayed message
+	lastRelayedMu = new(sync.Mutex)
+)
+
+//SetChatRelay enables or disables relaying the player's messages to the game server
+func (lobby *Lobby) SetChatRelay(playerID uint, enabled bool) {
+	if !enabled {
+		db.DB.Where("lobby_id = ? AND player_id = ?", lobby.ID, playerID).Delete(&ChatRelay{})
+		return
+	}
+
+	db.DB.FirstOrCreate(&ChatRelay{}, &ChatRelay{LobbyID: lobby.ID, PlayerID: playerID})
+}
+
+//ChatRelayEnabled returns true if the player's messages are relayed to the game server
+func (lobby *Lobby) ChatRelayEnabled(playerID uint) bool {
+	var count int
+	db.DB.Model(&ChatRelay{}).Where("lobby_id = ? AND player_id = ?", lobby.ID, playerID).Count(&count)
+	return count != 0
+}
+
+//hasServer returns true if the lobby's game server has been setup, and the lobby hasn't ended yet
+func (lobby *Lobby) hasServer() bool {
+	switch lobby.CurrentState() {
+	case Waiting, ReadyingUp, InProgress, Drafting:
+		return true
+	}
+	return false
+}
+
+//RelayChat sends a message the player sent in the lobby's chat room to the game server,
+//if they've enabled it. Returns false if the message wasn't relayed, like when the
+//player has sent another message less than ChatRelayInterval ago.
+func (lobby *Lobby) RelayChat(p *player.Player, message string) bool {
+	if !lobby.ChatRelayEnabled(p.ID) || !lobby.hasServer() {
+		return false
+	}
+
+	key := fmt.Sprintf("%d_%d", lobby.ID, p.ID)
+	lastRelayedMu.Lock()
+	if time.Since(lastRelayed[key]) < ChatRelayInterval {
+		lastRelayedMu.Unlock()
+		return false
+	}
+	lastRelayed[key] = time.Now()
+	lastRelayedMu.Unlock()
+
+	say(lobby.ID, fmt.Sprintf("%s %s: %s", ChatRelayPrefix, sanitizeChat(p.Alias()), sanitizeChat(message)))
+	return true
+}
+
+//sanitizeChat removes characters which could be used to run other commands
+//through the say command on the game server (control characters, ; and ")
+func sanitizeChat(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == ';' || r == '"' {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+//clearChatRelays removes the chat relay settings for the lobby
+func (lobby *Lobby) clearChatRelays() {
+	db.DB.Where("lobby_id = ?", lobby.ID).Delete(&ChatRelay{})
+
+	lastRelayedMu.Lock()
+	prefix := fmt.Sprintf("%d_", lobby.ID)
+	for key := range lastRelayed {
+		if strings.HasPrefix(key, prefix) {
+			delete(lastRelayed, key)
+		}
+	}
+	lastRelayedMu.Unlock()
+}
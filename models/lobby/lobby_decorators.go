@@ -7,6 +7,7 @@ package lobby
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/TF2Stadium/Helen/config"
 	"github.com/TF2Stadium/Helen/controllers/broadcaster"
@@ -22,8 +23,11 @@ type SlotDetails struct {
 	Ready        *bool          `json:"ready,omitempty"`
 	InGame       *bool          `json:"ingame,omitempty"`
 	InMumble     *bool          `json:"inmumble,omitempty"`
+	Rating       *int           `json:"rating,omitempty"` // player's rating for the lobby's format
 	Requirements *Requirement   `json:"requirements,omitempty"`
+	Rules        []*SlotRule    `json:"rules,omitempty"` // includes rules for all slots
 	Password     bool           `json:"password"`
+	Reserved     bool           `json:"reserved"` // reserved for a player from the previous lobby
 }
 
 type ClassDetails struct {
@@ -49,8 +53,11 @@ type LobbyData struct {
 	TwitchChannel     string `json:"twitchChannel"`
 	TwitchRestriction string `json:"twitchRestriction"`
 
-	RegionLock bool   `json:"regionLock"`
-	SteamGroup string `json:"steamGroup"`
+	RegionLock  bool   `json:"regionLock"`
+	AutoBalance bool   `json:"autoBalance"`
+	Draft       bool   `json:"draft"`
+	SteamGroup  string `json:"steamGroup"`
+	StartsAt    int64  `json:"startsAt,omitempty"` // (Unix) time at which a scheduled lobby opens
 
 	Region struct {
 		Name string `json:"name"`
@@ -64,7 +71,32 @@ type LobbyData struct {
 	State       int           `json:"state"`
 	WhitelistID string        `json:"whitelistId"`
 
-	Spectators []SpecDetails `json:"spectators,omitempty"`
+	Spectators  []SpecDetails    `json:"spectators,omitempty"`
+	DraftInfo   *DraftData       `json:"draftInfo,omitempty"`
+	Reservation *ReservationData `json:"reservation,omitempty"` // only for lobbies with a reservation
+}
+
+type ReservationData struct {
+	Status    string `json:"status"`
+	CheckedAt int64  `json:"checkedAt,omitempty"` // (Unix) time of the last check
+}
+
+type DraftSignupData struct {
+	Player  *player.Player `json:"player"`
+	Classes []string       `json:"classes"`
+	Captain bool           `json:"captain"`
+	Rating  int            `json:"rating"`
+}
+
+type DraftData struct {
+	Captains struct {
+		Red string `json:"red,omitempty"`
+		Blu string `json:"blu,omitempty"`
+	} `json:"captains"`
+
+	Turn    string            `json:"turn,omitempty"` // team making the next pick
+	Timeout int64             `json:"timeout"`        // seconds left for the current pick
+	Signups []DraftSignupData `json:"signups"`
 }
 
 type LobbyListData struct {
@@ -115,7 +147,38 @@ type LobbyEvent struct {
 	NotReady bool `json:"notReady,omitempty"` // true if player removed for not being ready
 }
 
-func decorateSlotDetails(lobby *Lobby, slot int, playerInfo bool) SlotDetails {
+//slotExtras holds the rules and reservations for all slots in a lobby,
+//so that they're loaded once for the whole lobby
+type slotExtras struct {
+	rules    []*SlotRule
+	reserved map[int]bool
+}
+
+func getSlotExtras(lobby *Lobby) slotExtras {
+	extras := slotExtras{reserved: make(map[int]bool)}
+	db.DB.Where("lobby_id = ?", lobby.ID).Order("id").Find(&extras.rules)
+
+	var reserved []int
+	db.DB.Model(&SlotReservation{}).Where("lobby_id = ?", lobby.ID).Pluck("slot", &reserved)
+	for _, slot := range reserved {
+		extras.reserved[slot] = true
+	}
+
+	return extras
+}
+
+//slotRules returns the same rules as GetSlotRules
+func (e slotExtras) slotRules(slot int) []*SlotRule {
+	var rules []*SlotRule
+	for _, rule := range e.rules {
+		if rule.Slot == slot || rule.Slot == -1 {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func decorateSlotDetails(lobby *Lobby, slot int, playerInfo bool, extras slotExtras) SlotDetails {
 	playerId, err := lobby.GetPlayerIDBySlot(slot)
 	needsSub := lobby.SlotNeedsSubstitute(slot)
 
@@ -135,6 +198,9 @@ func decorateSlotDetails(lobby *Lobby, slot int, playerInfo bool) SlotDetails {
 
 		inmumble := lobby.IsPlayerInMumble(p)
 		slotDetails.InMumble = &inmumble
+
+		rating := int(p.GetRating(lobby.Type, "").Rating)
+		slotDetails.Rating = &rating
 	}
 
 	if lobby.HasSlotRequirement(slot) {
@@ -145,23 +211,21 @@ func decorateSlotDetails(lobby *Lobby, slot int, playerInfo bool) SlotDetails {
 		}
 	}
 
+	slotDetails.Rules = extras.slotRules(slot)
+	if !slotDetails.Filled {
+		slotDetails.Reserved = extras.reserved[slot]
+	}
+
 	return slotDetails
 }
 
 var (
 	stateString = map[State]string{
 		Waiting:    "Waiting For Players",
+		Drafting:   "Drafting Players",
 		InProgress: "Lobby in Progress",
 		Ended:      "Lobby Ended",
-	}
-
-	formatMap = map[format.Format]string{
-		format.Sixes:      "6s",
-		format.Highlander: "Highlander",
-		format.Fours:      "4v4",
-		format.Ultiduo:    "Ultiduo",
-		format.Bball:      "Bball",
-		format.Debug:      "Debug",
+		Scheduled:  "Scheduled",
 	}
 )
 
@@ -169,7 +233,7 @@ func DecorateLobbyData(lobby *Lobby, playerInfo bool) LobbyData {
 	lobbyData := LobbyData{
 		ID:                lobby.ID,
 		Mode:              lobby.Mode,
-		Type:              formatMap[lobby.Type],
+		Type:              lobby.Type.Label(),
 		Players:           lobby.GetPlayerNumber(),
 		Map:               lobby.MapName,
 		League:            lobby.League,
@@ -177,22 +241,37 @@ func DecorateLobbyData(lobby *Lobby, playerInfo bool) LobbyData {
 		TwitchChannel:     lobby.TwitchChannel,
 		TwitchRestriction: lobby.TwitchRestriction.String(),
 		RegionLock:        lobby.RegionLock,
+		AutoBalance:       lobby.AutoBalance,
+		Draft:             lobby.Draft,
 
 		SteamGroup: lobby.PlayerWhitelist,
 	}
 
+	if !lobby.StartsAt.IsZero() {
+		lobbyData.StartsAt = lobby.StartsAt.Unix()
+	}
+
+	if lobby.ServemeID != 0 {
+		status, checkedAt := ReservationStatus(lobby.ID)
+		lobbyData.Reservation = &ReservationData{Status: status}
+		if !checkedAt.IsZero() {
+			lobbyData.Reservation.CheckedAt = checkedAt.Unix()
+		}
+	}
+
 	lobbyData.Region.Name = lobby.RegionName
 	lobbyData.Region.Code = lobby.RegionCode
 
 	classList := format.GetClasses(lobby.Type)
 
 	classes := make([]ClassDetails, len(classList))
-	lobbyData.MaxPlayers = format.NumberOfClassesMap[lobby.Type] * 2
+	lobbyData.MaxPlayers = format.NumberOfSlots(lobby.Type)
 
+	extras := getSlotExtras(lobby)
 	for slot, className := range classList {
 		class := ClassDetails{
-			Red:   decorateSlotDetails(lobby, slot, playerInfo),
-			Blu:   decorateSlotDetails(lobby, slot+format.NumberOfClassesMap[lobby.Type], playerInfo),
+			Red:   decorateSlotDetails(lobby, slot, playerInfo, extras),
+			Blu:   decorateSlotDetails(lobby, slot+format.NumberOfClasses(lobby.Type), playerInfo, extras),
 			Class: className,
 		}
 
@@ -233,9 +312,49 @@ func DecorateLobbyData(lobby *Lobby, playerInfo bool) LobbyData {
 
 	lobbyData.Spectators = spectators
 
+	if lobby.Draft {
+		lobbyData.DraftInfo = decorateDraft(lobby)
+	}
+
 	return lobbyData
 }
 
+func decorateDraft(lobby *Lobby) *DraftData {
+	draft := &DraftData{Turn: lobby.DraftTurn}
+
+	if lobby.RedCaptainID != 0 {
+		if p, err := player.GetPlayerByID(lobby.RedCaptainID); err == nil {
+			draft.Captains.Red = p.SteamID
+		}
+	}
+	if lobby.BluCaptainID != 0 {
+		if p, err := player.GetPlayerByID(lobby.BluCaptainID); err == nil {
+			draft.Captains.Blu = p.SteamID
+		}
+	}
+	if lobby.DraftTurn != "" {
+		draft.Timeout = lobby.DraftPickDeadline - time.Now().Unix()
+	}
+
+	draft.Signups = []DraftSignupData{}
+	for _, signup := range lobby.GetSignups() {
+		p, err := player.GetPlayerByID(signup.PlayerID)
+		if err != nil {
+			continue
+		}
+		p.SetPlayerSummary()
+
+		draft.Signups = append(draft.Signups, DraftSignupData{
+			Player:  p,
+			Classes: signup.GetClasses(),
+			Captain: signup.Captain,
+			Rating:  int(p.GetRating(lobby.Type, "").Rating),
+		})
+	}
+
+	return draft
+}
+
 func (l LobbyData) Send() {
 	broadcaster.SendMessageToRoom(fmt.Sprintf("%d_public", l.ID), "lobbyData", l)
 }
@@ -259,7 +378,7 @@ func DecorateLobbyConnect(lob *Lobby, player *player.Player, slot int) LobbyConn
 	l := LobbyConnectData{}
 	l.ID = lob.ID
 	l.Time = lob.CreatedAt.Unix()
-	l.Pass = lob.ServerInfo.ServerPassword
+	l.Pass = string(lob.ServerInfo.ServerPassword)
 	l.Game.Host = lob.ServerInfo.Host
 
 	l.Mumble.Address = config.Constants.MumbleAddr
@@ -282,7 +401,7 @@ func DecorateSubstitute(slot *LobbySlot) SubstituteData {
 
 	substitute := SubstituteData{
 		LobbyID:       lobby.ID,
-		Format:        formatMap[lobby.Type],
+		Format:        lobby.Type.Label(),
 		MapName:       lobby.MapName,
 		Mumble:        lobby.Mumble,
 		TwitchChannel: lobby.TwitchChannel,
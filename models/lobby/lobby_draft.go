@@ -0,0 +1,412 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package lobby
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	db "github.com/TF2Stadium/Helen/database"
+	"github.com/TF2Stadium/Helen/models/lobby/format"
+	"github.com/TF2Stadium/Helen/models/player"
+	"github.com/TF2Stadium/Helen/models/timer"
+)
+
+//DraftPickTimeout is the time a captain has to make a pick, after which the
+//highest rated player who signed up is picked for them
+const DraftPickTimeout = 30 * time.Second
+
+var (
+	ErrNotDraft         = errors.New("Players aren't drafted in this lobby")
+	ErrSignupClosed     = errors.New("Sign ups for this lobby are closed")
+	ErrNotSignedUp      = errors.New("You haven't signed up for this lobby")
+	ErrNotCaptain       = errors.New("You aren't a captain in this lobby")
+	ErrNotYourTurn      = errors.New("It isn't your turn to pick")
+	ErrPlayerNotInDraft = errors.New("This player hasn't signed up for this lobby")
+	ErrNoClasses        = errors.New("You need to pick at least one class")
+)
+
+//DraftSignup represents a player who has signed up to be picked in a draft lobby
+type DraftSignup struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+
+	LobbyID  uint `sql:"index"`
+	PlayerID uint
+	Classes  string // comma separated list of classes the player wants to play
+	Captain  bool   // true if the player volunteered to be a captain
+}
+
+//GetClasses returns the classes the player signed up for
+func (s *DraftSignup) GetClasses() []string {
+	return strings.Split(s.Classes, ",")
+}
+
+//afterDraftPick is called after the draft puts a player in a slot, set with OnDraftPick
+var afterDraftPick = func(*Lobby, *player.Player) {}
+
+//OnDraftPick sets f to be called after a player has been put in a slot by the draft
+//(captains, picked players and automatic picks), once the lobby has been broadcasted.
+func OnDraftPick(f func(*Lobby, *player.Player)) {
+	afterDraftPick = f
+}
+
+func init() {
+	timer.Register("draftPickTimeout", func(lobbyID, _ uint) {
+		lobby, err := GetLobbyByID(lobbyID)
+		if err != nil {
+			return
+		}
+
+		if err := lobby.AutoPick(); err != nil {
+			logrus.Errorf("Couldn't pick a player for lobby %d: %s", lobby.ID, err.Error())
+		}
+	})
+}
+
+//SignUp signs the player up to be picked in the lobby, for the given classes,
+//replacing any existing sign up. If captain is true, the player can be picked as a captain.
+//The draft starts once enough players have signed up.
+func (lobby *Lobby) SignUp(p *player.Player, classes []string, captain bool) error {
+	if !lobby.Draft {
+		return ErrNotDraft
+	}
+	lobby.State = lobby.CurrentState()
+	if lobby.State != Waiting && lobby.State != Drafting && lobby.State != Scheduled {
+		return ErrSignupClosed
+	}
+	if lobby.IsPlayerBanned(p) {
+		return ErrLobbyBan
+	}
+	if _, err := p.GetLobbyID(false); err == nil {
+		return errors.New("You're already in a lobby")
+	}
+	if err := player.GetJoinPolicy().Check(p); err != nil {
+		return err
+	}
+
+	if len(classes) == 0 {
+		return ErrNoClasses
+	}
+	for _, class := range classes {
+		if _, err := format.GetSlot(lobby.Type, "red", class); err != nil {
+			return fmt.Errorf("%s isn't a class in %s", class, lobby.Type)
+		}
+	}
+
+	db.DB.Where("lobby_id = ? AND player_id = ?", lobby.ID, p.ID).Delete(&DraftSignup{})
+	err := db.DB.Create(&DraftSignup{
+		LobbyID:  lobby.ID,
+		PlayerID: p.ID,
+		Classes:  strings.Join(classes, ","),
+		Captain:  captain,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	if lobby.State == Waiting {
+		if err := lobby.startDraft(); err != nil {
+			logrus.Errorf("Couldn't start draft for lobby %d: %s", lobby.ID, err.Error())
+		}
+	}
+
+	lobby.OnChange(false)
+	return nil
+}
+
+//WithdrawSignup removes the player's sign up for the lobby
+func (lobby *Lobby) WithdrawSignup(p *player.Player) error {
+	if db.DB.Where("lobby_id = ? AND player_id = ?", lobby.ID, p.ID).Delete(&DraftSignup{}).RowsAffected == 0 {
+		return ErrNotSignedUp
+	}
+
+	lobby.OnChange(false)
+	return nil
+}
+
+//GetSignups returns all players who have signed up for the lobby and haven't been picked yet,
+//in the order they signed up
+func (lobby *Lobby) GetSignups() []*DraftSignup {
+	var signups []*DraftSignup
+	db.DB.Where("lobby_id = ?", lobby.ID).Order("id").Find(&signups)
+	return signups
+}
+
+func (lobby *Lobby) getSignup(p *player.Player) (*DraftSignup, error) {
+	signup := &DraftSignup{}
+	err := db.DB.Where("lobby_id = ? AND player_id = ?", lobby.ID, p.ID).First(signup).Error
+	if err != nil {
+		return nil, ErrPlayerNotInDraft
+	}
+	return signup, nil
+}
+
+//GetCaptain returns the ID of the captain for the given team
+func (lobby *Lobby) GetCaptain(team string) uint {
+	if team == "red" {
+		return lobby.RedCaptainID
+	}
+	return lobby.BluCaptainID
+}
+
+func (lobby *Lobby) setCaptain(team string, id uint) {
+	column := team + "_captain_id"
+	db.DB.Model(&Lobby{}).Where("id = ?", lobby.ID).UpdateColumn(column, id)
+	if team == "red" {
+		lobby.RedCaptainID = id
+	} else {
+		lobby.BluCaptainID = id
+	}
+}
+
+//freeClasses returns the classes which don't have a player on the given team
+func (lobby *Lobby) freeClasses(team string) []string {
+	var free []string
+	for _, class := range format.GetClasses(lobby.Type) {
+		slot, _ := format.GetSlot(lobby.Type, team, class)
+		if !lobby.IsSlotOccupied(slot) {
+			free = append(free, class)
+		}
+	}
+	return free
+}
+
+//hasCaptain returns true if the team's captain is still playing on it
+func (lobby *Lobby) hasCaptain(team string) bool {
+	id := lobby.GetCaptain(team)
+	if id == 0 {
+		return false
+	}
+
+	p, err := player.GetPlayerByID(id)
+	if err != nil {
+		return false
+	}
+	slot, err := lobby.GetPlayerSlot(p)
+	if err != nil {
+		return false
+	}
+	slotTeam, _, _ := format.GetSlotTeamClass(lobby.Type, slot)
+	return slotTeam == team
+}
+
+//place puts the player who signed up in a slot for one of their classes on the given team
+func (lobby *Lobby) place(signup *DraftSignup, team string, classes []string) (*player.Player, error) {
+	p, err := player.GetPlayerByID(signup.PlayerID)
+	if err != nil {
+		return nil, err
+	}
+	//players can't be taken out of other lobbies
+	if id, err := p.GetLobbyID(false); err == nil && id != lobby.ID {
+		db.DB.Delete(signup)
+		return nil, errors.New("This player is already in a lobby")
+	}
+
+	err = ErrFilled
+	for _, class := range classes {
+		slot, _ := format.GetSlot(lobby.Type, team, class)
+		if err = lobby.AddPlayer(p, slot, ""); err == nil {
+			db.DB.Delete(signup)
+			return p, nil
+		}
+	}
+
+	return nil, err
+}
+
+//startDraft starts picking players if enough players have signed up to fill the lobby,
+//and there are captains for both teams. Volunteers who signed up first become captains
+//for teams which don't have one.
+func (lobby *Lobby) startDraft() error {
+	//players in a rematch get their reserved slots first
+	if lobby.hasReservations() {
+		return nil
+	}
+
+	signups := lobby.GetSignups()
+	free := format.NumberOfSlots(lobby.Type) - lobby.GetPlayerNumber()
+	if len(signups) < free {
+		return nil
+	}
+
+	captains := make(map[string]*DraftSignup)
+	next := 0
+	for _, team := range []string{"red", "blu"} {
+		if lobby.hasCaptain(team) {
+			continue
+		}
+		for next < len(signups) && !signups[next].Captain {
+			next++
+		}
+		if next == len(signups) {
+			return nil
+		}
+		captains[team] = signups[next]
+		next++
+	}
+
+	if err := lobby.SetState(Drafting, "draft started", 0); err != nil {
+		return err
+	}
+
+	var placed []*player.Player
+	for team, signup := range captains {
+		p, err := lobby.place(signup, team, signup.GetClasses())
+		if err != nil {
+			db.DB.Delete(signup)
+			lobby.SetState(Waiting, "captain couldn't be placed", 0)
+			return err
+		}
+
+		lobby.setCaptain(team, p.ID)
+		placed = append(placed, p)
+	}
+
+	for _, p := range placed {
+		afterDraftPick(lobby, p)
+	}
+
+	lobby.setTurn("red")
+	return nil
+}
+
+//setTurn lets the given team make the next pick, and starts the timeout for it
+func (lobby *Lobby) setTurn(team string) {
+	lobby.DraftTurn = team
+	lobby.DraftPickDeadline = time.Now().Add(DraftPickTimeout).Unix()
+	db.DB.Model(&Lobby{}).Where("id = ?", lobby.ID).UpdateColumns(map[string]interface{}{
+		"draft_turn":          lobby.DraftTurn,
+		"draft_pick_deadline": lobby.DraftPickDeadline,
+	})
+
+	if err := timer.AfterFunc("draftPickTimeout", lobby.ID, 0, DraftPickTimeout); err != nil {
+		logrus.Error(err)
+	}
+	lobby.OnChange(false)
+}
+
+//claimTurn makes sure only one pick is made at a time, returns false if it isn't the
+//given team's turn to pick
+func (lobby *Lobby) claimTurn(team string) bool {
+	res := db.DB.Model(&Lobby{}).Where("id = ? AND state = ? AND draft_turn = ?", lobby.ID, Drafting, team).UpdateColumn("draft_turn", "")
+	if res.RowsAffected != 1 {
+		return false
+	}
+
+	lobby.DraftTurn = ""
+	timer.Stop("draftPickTimeout", lobby.ID, 0)
+	return true
+}
+
+//afterPick passes the turn to the other team, unless their side is already full.
+//The draft ends once all slots have been filled.
+func (lobby *Lobby) afterPick(team string, p *player.Player) {
+	afterDraftPick(lobby, p)
+	if lobby.IsFull() {
+		return
+	}
+
+	other := "blu"
+	if team == "blu" {
+		other = "red"
+	}
+	if len(lobby.freeClasses(other)) == 0 {
+		other = team
+	}
+	lobby.setTurn(other)
+}
+
+//DraftPick puts the given player in the slot for class on the captain's team.
+//Only the captain of the team whose turn it is can pick, and only players who signed up can be picked.
+func (lobby *Lobby) DraftPick(captain, p *player.Player, class string) error {
+	var team string
+	switch captain.ID {
+	case lobby.RedCaptainID:
+		team = "red"
+	case lobby.BluCaptainID:
+		team = "blu"
+	default:
+		return ErrNotCaptain
+	}
+
+	signup, err := lobby.getSignup(p)
+	if err != nil {
+		return err
+	}
+	if _, err := format.GetSlot(lobby.Type, team, class); err != nil {
+		return err
+	}
+
+	if !lobby.claimTurn(team) {
+		return ErrNotYourTurn
+	}
+
+	if _, err := lobby.place(signup, team, []string{class}); err != nil {
+		lobby.setTurn(team)
+		return err
+	}
+
+	lobby.afterPick(team, p)
+	return nil
+}
+
+//sign ups, highest rated player first
+type byRating struct {
+	signups []*DraftSignup
+	ratings map[uint]float64 // player ID -> rating
+}
+
+func (s byRating) Len() int { return len(s.signups) }
+func (s byRating) Less(i, j int) bool {
+	return s.ratings[s.signups[i].PlayerID] > s.ratings[s.signups[j].PlayerID]
+}
+func (s byRating) Swap(i, j int) { s.signups[i], s.signups[j] = s.signups[j], s.signups[i] }
+
+//AutoPick makes the pick for the team whose turn it is. The highest rated player
+//who signed up is picked, for the first of their classes which is free on the team
+//(or any free class if none of them are). If no one can be picked, the draft is stopped
+//until more players sign up.
+func (lobby *Lobby) AutoPick() error {
+	team := lobby.DraftTurn
+	if team == "" || !lobby.claimTurn(team) {
+		return ErrNotYourTurn
+	}
+
+	signups := byRating{lobby.GetSignups(), make(map[uint]float64)}
+	for _, signup := range signups.signups {
+		if p, err := player.GetPlayerByID(signup.PlayerID); err == nil {
+			signups.ratings[signup.PlayerID] = p.GetRating(lobby.Type, "").Rating
+		}
+	}
+	sort.Stable(signups)
+
+	free := lobby.freeClasses(team)
+	for _, signup := range signups.signups {
+		var classes []string
+		for _, class := range signup.GetClasses() {
+			for _, f := range free {
+				if class == f {
+					classes = append(classes, class)
+				}
+			}
+		}
+		classes = append(classes, free...)
+
+		p, err := lobby.place(signup, team, classes)
+		if err == nil {
+			lobby.afterPick(team, p)
+			return nil
+		}
+	}
+
+	lobby.SetState(Waiting, "not enough players signed up", 0)
+	lobby.OnChange(true)
+	return errors.New("No players left to pick")
+}
@@ -0,0 +1,151 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package lobby
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	db "github.com/TF2Stadium/Helen/database"
+)
+
+//MaxPresets is the number of presets each player can save
+const MaxPresets = 20
+
+var (
+	ErrPresetNotFound = errors.New("Couldn't find preset with given ID")
+	ErrPresetName     = errors.New("Preset names have to be between 1 and 32 characters long")
+	ErrPresetArgs     = errors.New("Preset arguments have to be a JSON object")
+	ErrTooManyPresets = fmt.Errorf("You can't save more than %d presets", MaxPresets)
+)
+
+//unsavedPresetArgs are LobbyCreate arguments which aren't saved in presets, the
+//server's RCON password, and ones which are only valid for a single lobby.
+//They're matched case-insensitively, like JSON field names are when decoding.
+var unsavedPresetArgs = []string{"rconpwd", "serveme", "startsAt"}
+
+//unsavedPresetArg returns true if the field isn't saved in presets
+func unsavedPresetArg(field string) bool {
+	for _, name := range unsavedPresetArgs {
+		if strings.EqualFold(field, name) {
+			return true
+		}
+	}
+	return false
+}
+
+//LobbyPreset is a named set of LobbyCreate arguments saved by a player,
+//used to create the same lobby again
+type LobbyPreset struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+
+	PlayerID uint   `sql:"index" json:"-"`
+	Name     string `json:"name"`
+	Args     string `sql:"type:text" json:"-"` // JSON encoded LobbyCreate arguments
+}
+
+//MarshalJSON sends the preset's arguments as a JSON object
+func (p *LobbyPreset) MarshalJSON() ([]byte, error) {
+	type lobbyPreset LobbyPreset
+	return json.Marshal(struct {
+		*lobbyPreset
+		Args json.RawMessage `json:"args"`
+	}{(*lobbyPreset)(p), json.RawMessage(p.Args)})
+}
+
+func decodeArgs(args []byte) (map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	if len(args) == 0 || string(args) == "null" {
+		return fields, nil
+	}
+	if err := json.Unmarshal(args, &fields); err != nil || fields == nil {
+		return nil, ErrPresetArgs
+	}
+	return fields, nil
+}
+
+//SavePreset saves args as the player's preset with the given name, replacing the
+//arguments of an existing preset with the same name. The RCON password, serveme
+//reservation and start time aren't saved.
+func SavePreset(playerID uint, name string, args json.RawMessage) (*LobbyPreset, error) {
+	if len(name) == 0 || len(name) > 32 {
+		return nil, ErrPresetName
+	}
+	fields, err := decodeArgs(args)
+	if err != nil {
+		return nil, ErrPresetArgs
+	}
+	for field := range fields {
+		if unsavedPresetArg(field) {
+			delete(fields, field)
+		}
+	}
+	if len(fields) == 0 {
+		return nil, ErrPresetArgs
+	}
+	saved, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	preset := &LobbyPreset{}
+	err = db.DB.Where("player_id = ? AND name = ?", playerID, name).First(preset).Error
+	if err != nil {
+		var count int
+		db.DB.Model(&LobbyPreset{}).Where("player_id = ?", playerID).Count(&count)
+		if count >= MaxPresets {
+			return nil, ErrTooManyPresets
+		}
+
+		preset = &LobbyPreset{PlayerID: playerID, Name: name}
+	}
+
+	preset.Args = string(saved)
+	return preset, db.DB.Save(preset).Error
+}
+
+//GetPresets returns all presets saved by the player, ordered by name
+func GetPresets(playerID uint) []*LobbyPreset {
+	var presets []*LobbyPreset
+	db.DB.Where("player_id = ?", playerID).Order("name").Find(&presets)
+	return presets
+}
+
+//GetPreset returns the player's preset with the given ID
+func GetPreset(playerID, id uint) (*LobbyPreset, error) {
+	preset := &LobbyPreset{}
+	if err := db.DB.Where("player_id = ? AND id = ?", playerID, id).First(preset).Error; err != nil {
+		return nil, ErrPresetNotFound
+	}
+	return preset, nil
+}
+
+//Delete deletes the preset
+func (p *LobbyPreset) Delete() error {
+	return db.DB.Delete(p).Error
+}
+
+//Merge returns the preset's arguments with the fields in override replacing
+//those in the preset. override can be empty.
+func (p *LobbyPreset) Merge(override json.RawMessage) (json.RawMessage, error) {
+	fields, err := decodeArgs([]byte(p.Args))
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := decodeArgs(override)
+	if err != nil {
+		return nil, err
+	}
+
+	for field, value := range overrides {
+		fields[field] = value
+	}
+	return json.Marshal(fields)
+}
@@ -0,0 +1,212 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package lobby
+
+import (
+	"errors"
+
+	db "github.com/TF2Stadium/Helen/database"
+	"github.com/TF2Stadium/Helen/models/lobby/format"
+	"github.com/TF2Stadium/Helen/models/player"
+	"github.com/TF2Stadium/Helen/models/rating"
+	"github.com/jinzhu/gorm"
+)
+
+var ErrInvalidResult = errors.New("Invalid match result")
+
+//RecordResult saves the result of the match played in the lobby, and updates the ratings
+//of the players who finished it. winner is either "red", "blu" or "draw".
+func (lobby *Lobby) RecordResult(winner string, redScore, bluScore int) error {
+	switch winner {
+	case "red", "blu", "draw":
+	default:
+		return ErrInvalidResult
+	}
+
+	lobby.Winner = winner
+	lobby.RedScore = redScore
+	lobby.BluScore = bluScore
+	err := db.DB.Model(&Lobby{}).Where("id = ?", lobby.ID).UpdateColumns(map[string]interface{}{
+		"winner":    winner,
+		"red_score": redScore,
+		"blu_score": bluScore,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	lobby.updateRatings()
+	return nil
+}
+
+type ratedPlayer struct {
+	team        string
+	formatRated *player.PlayerRating
+	classRated  *player.PlayerRating
+}
+
+//updateRatings updates the format and class ratings of all players in the lobby,
+//using the average rating of the other team as the opponent.
+func (lobby *Lobby) updateRatings() {
+	var slots []LobbySlot
+	db.DB.Where("lobby_id = ? AND needs_sub = FALSE", lobby.ID).Find(&slots)
+
+	var players []ratedPlayer
+	formatRatings := make(map[string][]rating.Rating) // team -> ratings for the format
+	classRatings := make(map[string][]rating.Rating)  // team -> ratings for each player's class
+
+	for _, slot := range slots {
+		p, err := player.GetPlayerByID(slot.PlayerID)
+		if err != nil {
+			continue
+		}
+		team, _, err := format.GetSlotTeamClass(lobby.Type, slot.Slot)
+		if err != nil {
+			continue
+		}
+		class, _ := format.GetSlotTF2Class(lobby.Type, slot.Slot)
+
+		rp := ratedPlayer{
+			team:        team,
+			formatRated: p.GetRating(lobby.Type, ""),
+			classRated:  p.GetRating(lobby.Type, class),
+		}
+		players = append(players, rp)
+		formatRatings[team] = append(formatRatings[team], rp.formatRated.Get())
+		classRatings[team] = append(classRatings[team], rp.classRated.Get())
+	}
+
+	// ratings are calculated from the ratings players had before the match
+	for _, rp := range players {
+		opponent := "red"
+		if rp.team == "red" {
+			opponent = "blu"
+		}
+
+		score := rating.Draw
+		switch lobby.Winner {
+		case rp.team:
+			score = rating.Win
+		case opponent:
+			score = rating.Loss
+		}
+
+		rp.formatRated.Update(rp.formatRated.Get().Update([]rating.Result{
+			{Opponent: rating.Team(formatRatings[opponent]), Score: score},
+		}))
+		rp.classRated.Update(rp.classRated.Get().Update([]rating.Result{
+			{Opponent: rating.Team(classRatings[opponent]), Score: score},
+		}))
+	}
+}
+
+//strengths returns how strong each of the given players are, used for balancing teams.
+//Ratings for the lobby's format are used if any of the players has played a rated match
+//in it, otherwise TF2 hours are used.
+func (lobby *Lobby) strengths(players []*player.Player) []float64 {
+	strengths := make([]float64, len(players))
+	rated := false
+
+	for i, p := range players {
+		r := p.GetRating(lobby.Type, "")
+		strengths[i] = r.Rating
+		rated = rated || r.Matches != 0
+	}
+
+	if !rated {
+		for i, p := range players {
+			strengths[i] = float64(p.GameHours)
+		}
+	}
+
+	return strengths
+}
+
+//Balance swaps players playing the same class between RED and BLU, so that the teams
+//are as even as possible. Returns true if any players were moved.
+func (lobby *Lobby) Balance() bool {
+	classes := format.NumberOfClasses(lobby.Type)
+	var moved []*LobbySlot
+
+	lobby.WithLock(func(tx *gorm.DB) error {
+		var slots []*LobbySlot
+		tx.Where("lobby_id = ? AND needs_sub = FALSE", lobby.ID).Find(&slots)
+
+		bySlot := make(map[int]*LobbySlot)
+		for _, slot := range slots {
+			bySlot[slot.Slot] = slot
+		}
+
+		// only classes with players in both teams can be swapped
+		var pairs [][2]*LobbySlot
+		var players []*player.Player
+		for class := 0; class < classes; class++ {
+			red, blu := bySlot[class], bySlot[class+classes]
+			if red == nil || blu == nil {
+				continue
+			}
+
+			redPlayer, err := player.GetPlayerByID(red.PlayerID)
+			if err != nil {
+				continue
+			}
+			bluPlayer, err := player.GetPlayerByID(blu.PlayerID)
+			if err != nil {
+				continue
+			}
+
+			pairs = append(pairs, [2]*LobbySlot{red, blu})
+			players = append(players, redPlayer, bluPlayer)
+		}
+
+		strengths := lobby.strengths(players)
+		red := make([]float64, len(pairs))
+		blu := make([]float64, len(pairs))
+		for i := range pairs {
+			red[i], blu[i] = strengths[2*i], strengths[2*i+1]
+		}
+
+		for i, swap := range rating.Balance(red, blu) {
+			if !swap {
+				continue
+			}
+
+			redSlot, bluSlot := pairs[i][0], pairs[i][1]
+			// (lobby_id, slot) is unique, so the red player is moved out of the way first
+			for _, move := range []struct {
+				slot     *LobbySlot
+				from, to int
+			}{
+				{redSlot, redSlot.Slot, -1},
+				{bluSlot, bluSlot.Slot, redSlot.Slot},
+				{redSlot, -1, bluSlot.Slot},
+			} {
+				err := tx.Model(&LobbySlot{}).Where("lobby_id = ? AND slot = ?", lobby.ID, move.from).UpdateColumn("slot", move.to).Error
+				if err != nil {
+					moved = nil
+					return err
+				}
+			}
+
+			redSlot.Slot, bluSlot.Slot = bluSlot.Slot, redSlot.Slot
+			moved = append(moved, redSlot, bluSlot)
+		}
+
+		return nil
+	})
+
+	if len(moved) == 0 {
+		return false
+	}
+
+	for _, slot := range moved {
+		if p, err := player.GetPlayerByID(slot.PlayerID); err == nil {
+			p.SetMumbleUsername(lobby.Type, slot.Slot)
+		}
+	}
+
+	lobby.OnChange(true)
+	return true
+}
@@ -0,0 +1,276 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package lobby
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TF2Stadium/Helen/controllers/broadcaster"
+	db "github.com/TF2Stadium/Helen/database"
+	"github.com/TF2Stadium/Helen/models/gameserver"
+	"github.com/TF2Stadium/Helen/models/lobby/format"
+	"github.com/TF2Stadium/Helen/models/player"
+	"github.com/TF2Stadium/Helen/models/timer"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	//RematchWindow is how long the leader of a lobby can start a rematch after the match ends.
+	//The lobby's game server is kept till then.
+	RematchWindow = 2 * time.Minute
+	//ReservationTimeout is how long players from the previous lobby have to claim their slot
+	//in a rematch, before it's open to everyone
+	ReservationTimeout = 2 * time.Minute
+)
+
+var (
+	ErrNoRematch      = errors.New("Rematches can only be started after the match has ended")
+	ErrRematchExpired = errors.New("It's too late to start a rematch for this lobby")
+	ErrRematchStarted = errors.New("A rematch has already been started for this lobby")
+	ErrSlotReserved   = errors.New("This slot is reserved for a player from the previous lobby")
+)
+
+//SlotReservation reserves a slot in a rematch for a player from the previous lobby
+type SlotReservation struct {
+	ID        uint `gorm:"primary_key"`
+	LobbyID   uint `sql:"index"`
+	Slot      int
+	PlayerID  uint
+	ExpiresAt time.Time
+}
+
+func init() {
+	timer.Register("releaseRematchServer", func(lobbyID, _ uint) {
+		lobby, err := GetLobbyByIDServer(lobbyID)
+		if err != nil {
+			return
+		}
+
+		//the timer's row is gone, so rematches can't be started anymore once the
+		//lock is released. The server is released outside the lock, as serveme can be slow.
+		var rematched bool
+		lobby.WithLock(func(tx *gorm.DB) error {
+			//the server is used by the rematch now
+			rematched = lobby.getRematchID(tx) != 0
+			return nil
+		})
+		if !rematched {
+			lobby.releaseServer()
+		}
+	})
+
+	timer.Register("expireReservations", func(lobbyID, _ uint) {
+		db.DB.Where("lobby_id = ?", lobbyID).Delete(&SlotReservation{})
+		if lobby, err := GetLobbyByID(lobbyID); err == nil {
+			lobby.reservationsDone()
+			lobby.OnChange(true)
+		}
+	})
+}
+
+func (lobby *Lobby) getRematchID(tx *gorm.DB) uint {
+	var id uint
+	tx.Raw("SELECT rematch_id FROM lobbies WHERE id = ?", lobby.ID).Row().Scan(&id)
+	return id
+}
+
+//releaseServer frees the lobby's game server with it's provider, so that stored servers
+//can be used by other lobbies and serveme reservations are ended. The server record is deleted.
+func (lobby *Lobby) releaseServer() {
+	provider, err := lobby.Provider()
+	if err == nil {
+		err = provider.Release(lobby.Server())
+	}
+	if err != nil {
+		logrus.Errorf("Couldn't release server %s for lobby %d: %s", lobby.ServerInfo.Host, lobby.ID, err.Error())
+		if lobby.ServemeID != 0 {
+			//released later by the reservation reconciler
+			lobby.addStaleReservation(err)
+		}
+	}
+
+	db.DB.Model(&gameserver.ServerRecord{}).Where("id = ?", lobby.ServerInfoID).Delete(&gameserver.ServerRecord{})
+}
+
+//IsSlotReserved returns true if the slot is reserved for a player from the previous lobby
+func (lobby *Lobby) IsSlotReserved(slot int) bool {
+	var count int
+	db.DB.Model(&SlotReservation{}).Where("lobby_id = ? AND slot = ?", lobby.ID, slot).Count(&count)
+	return count != 0
+}
+
+//IsSlotReservedFor returns true if the slot is reserved for the given player
+func (lobby *Lobby) IsSlotReservedFor(slot int, playerID uint) bool {
+	var count int
+	db.DB.Model(&SlotReservation{}).Where("lobby_id = ? AND slot = ? AND player_id = ?", lobby.ID, slot, playerID).Count(&count)
+	return count != 0
+}
+
+//hasReservations returns true if slots in the lobby are still reserved
+func (lobby *Lobby) hasReservations() bool {
+	var count int
+	db.DB.Model(&SlotReservation{}).Where("lobby_id = ?", lobby.ID).Count(&count)
+	return count != 0
+}
+
+//reservationsDone starts the draft in a draft rematch once all reservations
+//have been claimed or have expired
+func (lobby *Lobby) reservationsDone() {
+	if !lobby.Draft || lobby.hasReservations() || lobby.CurrentState() != Waiting {
+		return
+	}
+
+	if err := lobby.startDraft(); err != nil {
+		logrus.Errorf("Couldn't start draft for lobby %d: %s", lobby.ID, err.Error())
+	}
+}
+
+//Rematch creates a new lobby with the same settings, requirements and rules as the lobby
+//on the same game server, and reserves slots in it for the lobby's players for
+//ReservationTimeout. Players keep their class, and change teams if swap is true.
+//Draft rematches start drafting the remaining slots once the reservations are over.
+//Rematches can only be started within RematchWindow after the lobby's match ended.
+func (lobby *Lobby) Rematch(actorID uint, swap bool) (*Lobby, error) {
+	db.DB.Preload("ServerInfo").First(lobby, lobby.ID)
+	if lobby.State != Ended || !lobby.MatchEnded {
+		return nil, ErrNoRematch
+	}
+
+	if status, err := lobby.ServerStatus(); err != nil || status == gameserver.StatusEnded {
+		return nil, ErrRematchExpired
+	}
+
+	var rematch *Lobby
+	err := lobby.WithLock(func(tx *gorm.DB) error {
+		if lobby.getRematchID(tx) != 0 {
+			return ErrRematchStarted
+		}
+
+		//the server is released once the timer expires
+		var held bool
+		for _, t := range timer.GetPending(lobby.ID) {
+			held = held || t.Name == "releaseRematchServer"
+		}
+		if !held {
+			return ErrRematchExpired
+		}
+
+		rematch = lobby.copySettings()
+		timer.Stop("releaseRematchServer", lobby.ID, 0)
+		return tx.Model(&Lobby{}).Where("id = ?", lobby.ID).UpdateColumn("rematch_id", rematch.ID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	//the rematch has it's own record for the server
+	db.DB.Model(&gameserver.ServerRecord{}).Where("id = ?", lobby.ServerInfoID).Delete(&gameserver.ServerRecord{})
+
+	if err := rematch.SetupServer(); err != nil {
+		rematch.Delete()
+		return nil, err
+	}
+	if err := rematch.SetState(Waiting, "rematch", actorID); err != nil {
+		return nil, err
+	}
+
+	expires := time.Now().Add(ReservationTimeout)
+	for _, slot := range lobby.GetAllSlots() {
+		if slot.NeedsSub {
+			continue
+		}
+
+		s := slot.Slot
+		if swap {
+			s = otherTeamSlot(lobby.Type, s)
+		}
+		db.DB.Create(&SlotReservation{
+			LobbyID:   rematch.ID,
+			Slot:      s,
+			PlayerID:  slot.PlayerID,
+			ExpiresAt: expires,
+		})
+	}
+	if err := timer.AfterFunc("expireReservations", rematch.ID, 0, ReservationTimeout); err != nil {
+		logrus.Error(err)
+	}
+
+	rematch.notifyReservations(lobby.ID)
+	rematch.OnChange(true)
+	return rematch, nil
+}
+
+//copySettings saves a new lobby using the lobby's server, settings, requirements and rules
+func (lobby *Lobby) copySettings() *Lobby {
+	info := gameserver.ServerRecord{
+		Host:           lobby.ServerInfo.Host,
+		RconPassword:   lobby.ServerInfo.RconPassword,
+		ServerPassword: lobby.ServerInfo.ServerPassword,
+	}
+
+	rematch := NewLobby(lobby.MapName, lobby.Type, lobby.League, info, lobby.Whitelist, lobby.Mumble, lobby.PlayerWhitelist)
+	rematch.RegionCode = lobby.RegionCode
+	rematch.RegionName = lobby.RegionName
+	rematch.RegionLock = lobby.RegionLock
+	rematch.AutoBalance = lobby.AutoBalance
+	rematch.Draft = lobby.Draft
+	rematch.TwitchChannel = lobby.TwitchChannel
+	rematch.TwitchRestriction = lobby.TwitchRestriction
+	rematch.ServemeID = lobby.ServemeID
+	rematch.ServerProvider = lobby.ServerProvider
+	rematch.CreatedBySteamID = lobby.CreatedBySteamID
+	rematch.Save()
+
+	var reqs []*Requirement
+	db.DB.Where("lobby_id = ?", lobby.ID).Find(&reqs)
+	for _, req := range reqs {
+		req.ID = 0
+		req.LobbyID = rematch.ID
+		req.Save()
+	}
+
+	var rules []*SlotRule
+	db.DB.Where("lobby_id = ?", lobby.ID).Find(&rules)
+	for _, rule := range rules {
+		rule.ID = 0
+		rule.LobbyID = rematch.ID
+		db.DB.Create(rule)
+	}
+
+	return rematch
+}
+
+//otherTeamSlot returns the slot for the same class on the other team
+func otherTeamSlot(f format.Format, slot int) int {
+	classes := format.NumberOfClasses(f)
+	if slot < classes {
+		return slot + classes
+	}
+	return slot - classes
+}
+
+//notifyReservations tells players which slot they have been reserved in the rematch
+func (lobby *Lobby) notifyReservations(previousID uint) {
+	var reservations []*SlotReservation
+	db.DB.Where("lobby_id = ?", lobby.ID).Find(&reservations)
+
+	for _, r := range reservations {
+		p, err := player.GetPlayerByID(r.PlayerID)
+		if err != nil {
+			continue
+		}
+
+		team, class, _ := format.GetSlotTeamClass(lobby.Type, r.Slot)
+		broadcaster.SendMessage(p.SteamID, "lobbyRematch", struct {
+			ID         uint   `json:"id"`         // ID of the rematch
+			PreviousID uint   `json:"previousId"` // ID of the lobby that ended
+			Team       string `json:"team"`
+			Class      string `json:"class"`
+			Timeout    int64  `json:"timeout"` // seconds left to join the reserved slot
+		}{lobby.ID, previousID, team, class, int64(r.ExpiresAt.Sub(time.Now()).Seconds())})
+	}
+}
@@ -1,8 +1,6 @@
 package lobby
 
 import (
-	"time"
-
 	db "github.com/TF2Stadium/Helen/database"
 	"github.com/TF2Stadium/Helen/models/player"
 )
@@ -17,6 +15,8 @@ type Requirement struct {
 	Hours       int     `json:"hours"`       // minimum hours needed
 	Lobbies     int     `json:"lobbies"`     // minimum lobbies played
 	Reliability float64 `json:"reliability"` // minimum reliability needed
+	MinRating   int     `json:"minRating"`   // minimum rating for the lobby's format, 0 if none
+	MaxRating   int     `json:"maxRating"`   // maximum rating for the lobby's format, 0 if none
 	Password    string  `json:"-"`           // Slot password, if any
 }
 
@@ -54,31 +54,29 @@ func (lobby *Lobby) HasRequirements() bool {
 	return count != 0
 }
 
-//FitsRequirements checks if the player fits the requirement to be added to the given slot in the lobby
-func (l *Lobby) FitsRequirements(player *player.Player, slot int) (bool, error) {
-	//BUG(vibhavp): FitsRequirements doesn't check reliability
-	var req *Requirement
+//Rules returns the rules the requirement consists of
+func (r *Requirement) Rules() []Rule {
+	var rules []Rule
 
-	slotReq, err := l.GetSlotRequirement(slot)
-	if err == nil {
-		req = slotReq
+	if r.Hours != 0 {
+		rules = append(rules, &HoursRule{Min: r.Hours})
 	}
-
-	db.DB.Preload("Stats").First(player, player.ID)
-
-	if time.Since(player.ProfileUpdatedAt) < time.Hour*time.Duration(req.Hours-player.GameHours) {
-		//update player info only if the number of hours needed > the number of hours
-		//passed since player info was last updated
-		player.UpdatePlayerInfo()
+	if r.Lobbies != 0 {
+		rules = append(rules, &LobbiesRule{Min: r.Lobbies})
 	}
-
-	if player.GameHours < req.Hours {
-		return false, ErrReqHours
+	if r.Reliability != 0 {
+		rules = append(rules, &ReliabilityRule{Min: r.Reliability})
 	}
-
-	if player.Stats.TotalLobbies() < req.Lobbies {
-		return false, ErrReqLobbies
+	if r.MinRating != 0 || r.MaxRating != 0 {
+		rules = append(rules, &RatingRule{Min: r.MinRating, Max: r.MaxRating})
 	}
 
-	return true, nil
+	return rules
+}
+
+//FitsRequirements checks if the player meets all rules for the given slot in the lobby.
+//The error is a *RuleError describing the rule which wasn't met.
+func (l *Lobby) FitsRequirements(player *player.Player, slot int) (bool, error) {
+	err := l.CheckRules(player, slot, l.Rules(slot))
+	return err == nil, err
 }
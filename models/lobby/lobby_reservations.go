@@ -0,0 +1,244 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package lobby
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	db "github.com/TF2Stadium/Helen/database"
+	"github.com/TF2Stadium/Helen/models/chat"
+	"github.com/TF2Stadium/Helen/models/gameserver"
+)
+
+const (
+	//ReconcileInterval is how often the reservations of all active lobbies are checked
+	ReconcileInterval = 10 * time.Second
+	//MaxReconcileBackoff is the longest a lobby isn't checked for after it's checks failed
+	MaxReconcileBackoff = 5 * time.Minute
+	//StaleInitializingTimeout is how long a lobby can be initializing for before it's
+	//considered failed (like when Helen was restarted while the lobby was being created)
+	StaleInitializingTimeout = 15 * time.Minute
+	//StaleReservationExpiry is how long releasing a stale reservation is retried for
+	StaleReservationExpiry = 24 * time.Hour
+)
+
+//ReconcileRequestDelay is the minimum time between two requests to server providers
+var ReconcileRequestDelay = 200 * time.Millisecond
+
+//Reservation states reported to clients
+const (
+	ReservationUnknown = "unknown" // not checked yet, or the last check failed
+	ReservationPending = "pending"
+	ReservationReady   = "ready"
+	ReservationEnded   = "ended"
+)
+
+//StaleReservation is a reservation which couldn't be released when it's lobby was
+//closed or deleted. The reconciler keeps trying to release it.
+type StaleReservation struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+
+	LobbyID       uint
+	Provider      string
+	Host          string
+	ReservationID int
+	SteamID       string
+
+	Attempts  int
+	LastError string
+}
+
+//reservationState is the result of the last checks of a lobby's reservation
+type reservationState struct {
+	status    string
+	checkedAt time.Time
+	failures  int       // checks failed in a row
+	next      time.Time // the reservation isn't checked before this
+}
+
+var (
+	reservations   = make(map[uint]*reservationState)
+	reservationsMu = new(sync.RWMutex)
+
+	lastRequest   time.Time
+	lastRequestMu = new(sync.Mutex)
+)
+
+//waitRequest blocks until another request can be sent to a server provider
+func waitRequest() {
+	lastRequestMu.Lock()
+	defer lastRequestMu.Unlock()
+
+	if wait := lastRequest.Add(ReconcileRequestDelay).Sub(time.Now()); wait > 0 {
+		time.Sleep(wait)
+	}
+	lastRequest = time.Now()
+}
+
+//ReservationStatus returns the state of the lobby's reservation, and when it was last checked
+func ReservationStatus(lobbyID uint) (string, time.Time) {
+	reservationsMu.RLock()
+	defer reservationsMu.RUnlock()
+
+	state, ok := reservations[lobbyID]
+	if !ok {
+		return ReservationUnknown, time.Time{}
+	}
+	return state.status, state.checkedAt
+}
+
+//RunReservationReconciler checks the reservations of all active lobbies every
+//ReconcileInterval, closing lobbies whose reservations have ended, and releases
+//reservations left behind by deleted or failed lobbies.
+func RunReservationReconciler() {
+	ticker := time.NewTicker(ReconcileInterval)
+
+	for {
+		ReconcileReservations()
+		<-ticker.C
+	}
+}
+
+//ReconcileReservations checks all reservations once
+func ReconcileReservations() {
+	var lobbies []*Lobby
+	//initializing lobbies wait for their server while they're being created
+	db.DB.Preload("ServerInfo").Where("state <> ? AND state <> ? AND serveme_id <> 0", Ended, Initializing).Find(&lobbies)
+
+	active := make(map[uint]bool)
+	for _, lobby := range lobbies {
+		active[lobby.ID] = true
+		lobby.checkReservation()
+	}
+
+	reservationsMu.Lock()
+	for id := range reservations {
+		if !active[id] {
+			delete(reservations, id)
+		}
+	}
+	reservationsMu.Unlock()
+
+	deleteFailedLobbies()
+	releaseStaleReservations()
+}
+
+//checkReservation gets the status of the lobby's reservation, and closes the lobby if it has ended
+func (lobby *Lobby) checkReservation() {
+	reservationsMu.RLock()
+	state, ok := reservations[lobby.ID]
+	reservationsMu.RUnlock()
+	if !ok {
+		state = &reservationState{status: ReservationUnknown}
+	} else if time.Now().Before(state.next) {
+		return
+	}
+
+	waitRequest()
+	status, err := lobby.ServerStatus()
+	now := time.Now()
+
+	reservationsMu.Lock()
+	state.checkedAt = now
+	if err != nil {
+		logrus.Errorf("Couldn't check reservation for lobby %d: %s", lobby.ID, err.Error())
+		state.status = ReservationUnknown
+		state.failures++
+
+		backoff := ReconcileInterval << uint(state.failures)
+		if backoff > MaxReconcileBackoff || backoff <= 0 {
+			backoff = MaxReconcileBackoff
+		}
+		state.next = now.Add(backoff)
+	} else {
+		state.failures = 0
+		state.next = time.Time{}
+		switch status {
+		case gameserver.StatusReady:
+			state.status = ReservationReady
+		case gameserver.StatusEnded:
+			state.status = ReservationEnded
+		default:
+			state.status = ReservationPending
+		}
+	}
+	reservations[lobby.ID] = state
+	reservationsMu.Unlock()
+
+	if err == nil && status == gameserver.StatusEnded && lobby.CurrentState() != Ended {
+		chat.SendNotification("Lobby Closed (Serveme reservation ended.)", int(lobby.ID))
+		lobby.Close(true, false, "serveme reservation ended", 0)
+	}
+}
+
+//deleteFailedLobbies deletes lobbies which have been initializing for too long,
+//releasing their servers with their providers
+func deleteFailedLobbies() {
+	var lobbies []*Lobby
+	db.DB.Preload("ServerInfo").Where("state = ? AND created_at < ?",
+		Initializing, time.Now().Add(-StaleInitializingTimeout)).Find(&lobbies)
+
+	for _, lobby := range lobbies {
+		logrus.Warningf("Deleting lobby %d, which has been initializing since %s", lobby.ID, lobby.CreatedAt)
+		lobby.Delete()
+	}
+}
+
+//addStaleReservation records the lobby's reservation after it couldn't be released
+func (lobby *Lobby) addStaleReservation(err error) {
+	stale := &StaleReservation{
+		LobbyID:       lobby.ID,
+		Provider:      lobby.ServerProvider,
+		Host:          lobby.ServerInfo.Host,
+		ReservationID: lobby.ServemeID,
+		SteamID:       lobby.CreatedBySteamID,
+		Attempts:      1,
+		LastError:     err.Error(),
+	}
+	if stale.Provider == "" {
+		stale.Provider = gameserver.ProviderServeme
+	}
+
+	db.DB.Create(stale)
+}
+
+//releaseStaleReservations tries to release reservations which couldn't be released before
+func releaseStaleReservations() {
+	for _, reservation := range GetStaleReservations() {
+		provider, err := gameserver.GetProvider(reservation.Provider)
+		if err == nil {
+			waitRequest()
+			err = provider.Release(&gameserver.Server{
+				Host:          reservation.Host,
+				ReservationID: reservation.ReservationID,
+				SteamID:       reservation.SteamID,
+			})
+		}
+
+		switch {
+		case err == nil:
+			logrus.Infof("Released stale reservation %d for lobby %d", reservation.ReservationID, reservation.LobbyID)
+			db.DB.Delete(reservation)
+		case time.Since(reservation.CreatedAt) > StaleReservationExpiry:
+			logrus.Errorf("Giving up on releasing reservation %d for lobby %d: %s", reservation.ReservationID, reservation.LobbyID, err.Error())
+			db.DB.Delete(reservation)
+		default:
+			db.DB.Model(reservation).UpdateColumns(map[string]interface{}{
+				"attempts":   reservation.Attempts + 1,
+				"last_error": err.Error(),
+			})
+		}
+	}
+}
+
+//GetStaleReservations returns reservations which still have to be released
+func GetStaleReservations() []*StaleReservation {
+	var stale []*StaleReservation
+	db.DB.Order("id").Find(&stale)
+	return stale
+}
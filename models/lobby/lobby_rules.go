@@ -0,0 +1,370 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package lobby
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	db "github.com/TF2Stadium/Helen/database"
+	"github.com/TF2Stadium/Helen/helpers"
+	"github.com/TF2Stadium/Helen/models/lobby/format"
+	"github.com/TF2Stadium/Helen/models/player"
+)
+
+var (
+	ErrUnknownRule = errors.New("Unknown rule type")
+	ErrRegion      = errors.New("This slot isn't open to players from your region")
+	ErrActiveBan   = errors.New("You can't join this slot while you have active bans")
+)
+
+//Rule is a condition players have to meet to join a lobby slot
+type Rule interface {
+	//Name returns the name the rule type was registered with
+	Name() string
+	//Check returns an error describing why the player can't join the slot, or nil
+	Check(l *Lobby, p *player.Player, slot int) error
+}
+
+//RuleError is returned when a player doesn't meet one of the rules for a slot
+type RuleError struct {
+	Rule   string `json:"rule"` // name of the rule type
+	Slot   int    `json:"slot"`
+	Reason string `json:"reason"`
+	Err    error  `json:"-"` // error returned by the rule, like ErrReqHours
+}
+
+func (e *RuleError) Error() string {
+	return e.Reason
+}
+
+//Details is sent to clients along with the error message
+func (e *RuleError) Details() interface{} {
+	return e
+}
+
+var ruleTypes = make(map[string]func() Rule)
+
+//RegisterRule registers a rule type, new returns an empty rule which stored
+//parameters are decoded into. Should be called from init functions.
+func RegisterRule(name string, new func() Rule) {
+	if _, ok := ruleTypes[name]; ok {
+		panic("lobby: rule " + name + " registered twice")
+	}
+	ruleTypes[name] = new
+}
+
+func init() {
+	RegisterRule("hours", func() Rule { return &HoursRule{} })
+	RegisterRule("lobbies", func() Rule { return &LobbiesRule{} })
+	RegisterRule("classLobbies", func() Rule { return &ClassLobbiesRule{} })
+	RegisterRule("accountAge", func() Rule { return &AccountAgeRule{} })
+	RegisterRule("region", func() Rule { return &RegionRule{} })
+	RegisterRule("steamGroup", func() Rule { return &SteamGroupRule{} })
+	RegisterRule("twitch", func() Rule { return &TwitchRule{} })
+	RegisterRule("rating", func() Rule { return &RatingRule{} })
+	RegisterRule("reliability", func() Rule { return &ReliabilityRule{} })
+	RegisterRule("noBans", func() Rule { return &NoBansRule{} })
+}
+
+//SlotRule stores a rule for a lobby slot
+type SlotRule struct {
+	ID      uint `gorm:"primary_key" json:"id"`
+	LobbyID uint `sql:"index" json:"-"`
+
+	Slot   int    `json:"slot"` // if -1, applies to all slots
+	Type   string `json:"type"` // name the rule type was registered with
+	Params string `json:"-"`    // JSON encoded parameters for the rule
+}
+
+//MarshalJSON sends the rule's parameters as a JSON object
+func (r *SlotRule) MarshalJSON() ([]byte, error) {
+	type slotRule SlotRule
+	params := json.RawMessage(r.Params)
+	if len(params) == 0 {
+		params = json.RawMessage("{}")
+	}
+
+	return json.Marshal(struct {
+		*slotRule
+		Params json.RawMessage `json:"params"`
+	}{(*slotRule)(r), params})
+}
+
+//Rule decodes the stored rule
+func (r *SlotRule) Rule() (Rule, error) {
+	return parseRule(r.Type, []byte(r.Params))
+}
+
+func parseRule(ruleType string, params []byte) (Rule, error) {
+	new, ok := ruleTypes[ruleType]
+	if !ok {
+		return nil, ErrUnknownRule
+	}
+
+	rule := new()
+	if len(params) != 0 {
+		if err := json.Unmarshal(params, rule); err != nil {
+			return nil, fmt.Errorf("Invalid parameters for %s: %s", ruleType, err.Error())
+		}
+	}
+	return rule, nil
+}
+
+//AddRule stores a rule of the given type for the slot (-1 for all slots) in the lobby
+func (lobby *Lobby) AddRule(slot int, ruleType string, params json.RawMessage) (*SlotRule, error) {
+	if slot < -1 || slot >= format.NumberOfSlots(lobby.Type) {
+		return nil, ErrBadSlot
+	}
+	if _, err := parseRule(ruleType, params); err != nil {
+		return nil, err
+	}
+
+	r := &SlotRule{
+		LobbyID: lobby.ID,
+		Slot:    slot,
+		Type:    ruleType,
+		Params:  string(params),
+	}
+	return r, db.DB.Create(r).Error
+}
+
+//RemoveRule removes the stored rule with the given ID from the lobby
+func (lobby *Lobby) RemoveRule(id uint) error {
+	if db.DB.Where("lobby_id = ? AND id = ?", lobby.ID, id).Delete(&SlotRule{}).RowsAffected == 0 {
+		return errors.New("Couldn't find rule with given ID")
+	}
+	return nil
+}
+
+//GetSlotRules returns the rules stored for the slot, including those for all slots
+func (lobby *Lobby) GetSlotRules(slot int) []*SlotRule {
+	var rules []*SlotRule
+	db.DB.Where("lobby_id = ? AND slot IN (?)", lobby.ID, []int{slot, -1}).Order("id").Find(&rules)
+	return rules
+}
+
+//lobbyRules returns the rules following from the lobby's settings, which apply to all slots
+func (lobby *Lobby) lobbyRules() []Rule {
+	var rules []Rule
+
+	if lobby.PlayerWhitelist != "" {
+		rules = append(rules, &SteamGroupRule{Group: lobby.PlayerWhitelist})
+	}
+	if lobby.TwitchChannel != "" {
+		rules = append(rules, &TwitchRule{
+			Channel:   lobby.TwitchChannel,
+			Followers: lobby.TwitchRestriction == TwitchFollowers,
+		})
+	}
+	if lobby.RegionLock {
+		rules = append(rules, &RegionRule{Regions: []string{lobby.RegionCode}})
+	}
+
+	return rules
+}
+
+//slotRules returns the rules for the given slot, from it's requirement and stored rules
+func (lobby *Lobby) slotRules(slot int) []Rule {
+	var rules []Rule
+
+	if req, err := lobby.GetSlotRequirement(slot); err == nil {
+		rules = append(rules, req.Rules()...)
+	}
+
+	for _, r := range lobby.GetSlotRules(slot) {
+		rule, err := r.Rule()
+		if err != nil {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+//Rules returns all rules players have to meet to join the slot
+func (lobby *Lobby) Rules(slot int) []Rule {
+	return append(lobby.lobbyRules(), lobby.slotRules(slot)...)
+}
+
+//CheckRules checks the player against the given rules for slot,
+//and returns a *RuleError for the first rule they don't meet
+func (lobby *Lobby) CheckRules(p *player.Player, slot int, rules []Rule) error {
+	for _, rule := range rules {
+		if err := rule.Check(lobby, p, slot); err != nil {
+			return &RuleError{
+				Rule:   rule.Name(),
+				Slot:   slot,
+				Reason: err.Error(),
+				Err:    err,
+			}
+		}
+	}
+
+	return nil
+}
+
+//HoursRule requires players to have played TF2 for a minimum number of hours
+type HoursRule struct {
+	Min int `json:"min"`
+}
+
+func (HoursRule) Name() string { return "hours" }
+
+func (r *HoursRule) Check(_ *Lobby, p *player.Player, _ int) error {
+	if p.GameHours < r.Min {
+		//the player might have played more since, check again in the background
+		p.RefreshProfile(player.RecheckInterval)
+		return ErrReqHours
+	}
+	return nil
+}
+
+//LobbiesRule requires players to have played a minimum number of lobbies
+type LobbiesRule struct {
+	Min int `json:"min"`
+}
+
+func (LobbiesRule) Name() string { return "lobbies" }
+
+func (r *LobbiesRule) Check(_ *Lobby, p *player.Player, _ int) error {
+	db.DB.Preload("Stats").First(p, p.ID)
+	if p.Stats.TotalLobbies() < r.Min {
+		return ErrReqLobbies
+	}
+	return nil
+}
+
+//ClassLobbiesRule requires players to have played a minimum number of lobbies as a TF2 class
+type ClassLobbiesRule struct {
+	Class string `json:"class"` // TF2 class ("medic", "soldier", etc)
+	Min   int    `json:"min"`
+}
+
+func (ClassLobbiesRule) Name() string { return "classLobbies" }
+
+func (r *ClassLobbiesRule) Check(_ *Lobby, p *player.Player, _ int) error {
+	db.DB.Preload("Stats").First(p, p.ID)
+	if p.Stats.ClassCount(r.Class) < r.Min {
+		return fmt.Errorf("You need to have played %d lobbies as %s to join this slot", r.Min, r.Class)
+	}
+	return nil
+}
+
+//AccountAgeRule requires players to have signed up on the site a minimum number of days ago
+type AccountAgeRule struct {
+	Days int `json:"days"`
+}
+
+func (AccountAgeRule) Name() string { return "accountAge" }
+
+func (r *AccountAgeRule) Check(_ *Lobby, p *player.Player, _ int) error {
+	if time.Since(p.CreatedAt) < time.Duration(r.Days)*24*time.Hour {
+		return fmt.Errorf("Your account needs to be at least %d days old to join this slot", r.Days)
+	}
+	return nil
+}
+
+//RegionRule only allows players connecting from the given regions
+type RegionRule struct {
+	Regions []string `json:"regions"` // region codes ("na", "eu", etc)
+}
+
+func (RegionRule) Name() string { return "region" }
+
+func (r *RegionRule) Check(_ *Lobby, p *player.Player, _ int) error {
+	for _, region := range r.Regions {
+		if strings.EqualFold(region, p.Region) {
+			return nil
+		}
+	}
+	return ErrRegion
+}
+
+//SteamGroupRule only allows members of a steam group
+type SteamGroupRule struct {
+	Group string `json:"group"`
+}
+
+func (SteamGroupRule) Name() string { return "steamGroup" }
+
+func (r *SteamGroupRule) Check(_ *Lobby, p *player.Player, _ int) error {
+	url := fmt.Sprintf(`http://steamcommunity.com/groups/%s/memberslistxml/?xml=1`, r.Group)
+	if !helpers.IsWhitelisted(p.SteamID, url) {
+		return ErrNotWhitelisted
+	}
+	return nil
+}
+
+//TwitchRule only allows subscribers (or followers) of a twitch channel, and it's owner
+type TwitchRule struct {
+	Channel   string `json:"channel"`
+	Followers bool   `json:"followers"` // if true, followers are allowed too
+}
+
+func (TwitchRule) Name() string { return "twitch" }
+
+func (r *TwitchRule) Check(_ *Lobby, p *player.Player, _ int) error {
+	if p.TwitchName == r.Channel {
+		return nil
+	}
+	//check if player has connected their twitch account
+	if p.TwitchAccessToken == "" {
+		return errors.New("You need to connect your Twitch Account first to join the lobby.")
+	}
+	if !r.Followers && !p.IsSubscribed(r.Channel) {
+		return fmt.Errorf("You aren't subscribed to %s", r.Channel)
+	}
+	if r.Followers && !p.IsFollowing(r.Channel) {
+		return fmt.Errorf("You aren't following %s", r.Channel)
+	}
+	return nil
+}
+
+//RatingRule requires player's ratings for the lobby's format to be in a band
+type RatingRule struct {
+	Min int `json:"min"` // 0 if none
+	Max int `json:"max"` // 0 if none
+}
+
+func (RatingRule) Name() string { return "rating" }
+
+func (r *RatingRule) Check(l *Lobby, p *player.Player, _ int) error {
+	rating := p.GetRating(l.Type, "").Rating
+	if (r.Min != 0 && rating < float64(r.Min)) || (r.Max != 0 && rating > float64(r.Max)) {
+		return ErrReqRating
+	}
+	return nil
+}
+
+//ReliabilityRule requires players to have a minimum reliability score
+type ReliabilityRule struct {
+	Min float64 `json:"min"`
+}
+
+func (ReliabilityRule) Name() string { return "reliability" }
+
+func (r *ReliabilityRule) Check(_ *Lobby, p *player.Player, _ int) error {
+	if p.GetReliability() < r.Min {
+		return ErrReqReliability
+	}
+	return nil
+}
+
+//NoBansRule only allows players who don't have any active bans
+type NoBansRule struct{}
+
+func (NoBansRule) Name() string { return "noBans" }
+
+func (NoBansRule) Check(_ *Lobby, p *player.Player, _ int) error {
+	if bans, _ := p.GetActiveBans(); len(bans) != 0 {
+		return ErrActiveBan
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package lobby
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TF2Stadium/Helen/controllers/broadcaster"
+	db "github.com/TF2Stadium/Helen/database"
+	"github.com/TF2Stadium/Helen/helpers"
+	"github.com/TF2Stadium/Helen/helpers/secret"
+	"github.com/TF2Stadium/Helen/models/chat"
+	"github.com/TF2Stadium/Helen/models/gameserver"
+	"github.com/TF2Stadium/Helen/models/player"
+	"github.com/TF2Stadium/Helen/models/timer"
+)
+
+const (
+	//MaxScheduleAhead is how far in the future lobbies can be scheduled
+	MaxScheduleAhead = 7 * 24 * time.Hour
+	//ScheduledSetupTimeout is how long a scheduled lobby waits for it's serveme
+	//reservation to be ready after it's start time, before it's closed
+	ScheduledSetupTimeout = 5 * time.Minute
+)
+
+var (
+	ErrStartTime    = errors.New("Lobbies can only be scheduled up to a week in advance")
+	ErrNotScheduled = errors.New("This lobby isn't scheduled")
+	ErrServerNotUp  = errors.New("The serveme reservation for this lobby wasn't ready in time")
+)
+
+//PendingServer is the server request of a scheduled lobby. Only serveme reservations
+//are made in advance, servers from other providers are acquired when the lobby opens,
+//so that other lobbies can use them till then.
+type PendingServer struct {
+	ID      uint `gorm:"primary_key"`
+	LobbyID uint `sql:"unique"`
+
+	Provider       string
+	SteamID        string
+	Address        string
+	RconPassword   secret.String `sql:"type:text"`
+	StoredServerID uint
+	Region         string
+	Tags           string // comma separated
+}
+
+//afterScheduledOpen is called after a scheduled lobby opens, set with OnScheduledOpen
+var afterScheduledOpen = func(*Lobby) {}
+
+//OnScheduledOpen sets f to be called after a scheduled lobby has been opened to players
+//(with the lobby in the Waiting state), so that it can ready up if it's already full.
+func OnScheduledOpen(f func(*Lobby)) {
+	afterScheduledOpen = f
+}
+
+func init() {
+	timer.Register("openScheduledLobby", func(lobbyID, _ uint) {
+		lobby, err := GetLobbyByIDServer(lobbyID)
+		if err != nil {
+			return
+		}
+
+		if err := lobby.Open(); err != nil {
+			logrus.Errorf("Couldn't open scheduled lobby %d: %s", lobby.ID, err.Error())
+		}
+	})
+}
+
+//GetScheduledLobbies returns lobbies which haven't opened yet, the earliest first
+func GetScheduledLobbies() (lobbies []*Lobby) {
+	db.DB.Where("state = ?", Scheduled).Order("starts_at, id").Find(&lobbies)
+	return
+}
+
+//BroadcastUpcomingLobbyList broadcasts the list of scheduled lobbies to all users
+func BroadcastUpcomingLobbyList() {
+	broadcaster.SendMessageToRoom(
+		"0_public",
+		"upcomingLobbyListData", DecorateLobbyListData(GetScheduledLobbies(), false))
+}
+
+//Schedule moves an initializing lobby to the Scheduled state, in which players can join
+//slots or sign up, but the lobby doesn't ready up. The lobby is opened at startsAt.
+func (lobby *Lobby) Schedule(startsAt time.Time, actorID uint) error {
+	wait := startsAt.Sub(time.Now())
+	if wait <= 0 || wait > MaxScheduleAhead {
+		return ErrStartTime
+	}
+
+	lobby.StartsAt = startsAt
+	db.DB.Model(&Lobby{}).Where("id = ?", lobby.ID).UpdateColumn("starts_at", startsAt)
+	if err := lobby.SetState(Scheduled, "scheduled", actorID); err != nil {
+		return err
+	}
+
+	return timer.AfterFunc("openScheduledLobby", lobby.ID, 0, wait)
+}
+
+//SetPendingServer saves the request for the server the lobby gets from the named
+//provider when it opens. The lobby's region is set from the request till then.
+func (lobby *Lobby) SetPendingServer(provider string, req gameserver.ServerRequest) error {
+	pending := &PendingServer{
+		LobbyID:        lobby.ID,
+		Provider:       provider,
+		SteamID:        req.SteamID,
+		Address:        req.Address,
+		RconPassword:   secret.String(req.RconPassword),
+		StoredServerID: req.StoredServerID,
+		Region:         req.Region,
+		Tags:           strings.Join(req.Tags, ","),
+	}
+	if err := db.DB.Create(pending).Error; err != nil {
+		return err
+	}
+
+	switch {
+	case req.Address != "":
+		lobby.RegionCode, lobby.RegionName = helpers.GetRegion(req.Address)
+	case req.StoredServerID != 0:
+		if server, err := gameserver.GetStoredServerByID(req.StoredServerID); err == nil {
+			lobby.RegionCode, lobby.RegionName = helpers.GetRegion(server.Address)
+		}
+	default:
+		lobby.RegionCode = req.Region
+	}
+	return db.DB.Model(&Lobby{}).Where("id = ?", lobby.ID).UpdateColumns(map[string]interface{}{
+		"region_code": lobby.RegionCode,
+		"region_name": lobby.RegionName,
+	}).Error
+}
+
+//acquirePendingServer gets the server requested with SetPendingServer, if the lobby has one
+func (lobby *Lobby) acquirePendingServer() error {
+	pending := &PendingServer{}
+	if err := db.DB.Where("lobby_id = ?", lobby.ID).First(pending).Error; err != nil {
+		return nil // the lobby got it's server when it was created
+	}
+
+	provider, err := gameserver.GetProvider(pending.Provider)
+	if err != nil {
+		return err
+	}
+	req := gameserver.ServerRequest{
+		SteamID:        pending.SteamID,
+		Address:        pending.Address,
+		RconPassword:   string(pending.RconPassword),
+		StoredServerID: pending.StoredServerID,
+		Region:         pending.Region,
+	}
+	if pending.Tags != "" {
+		req.Tags = strings.Split(pending.Tags, ",")
+	}
+
+	server, err := provider.Acquire(req)
+	if err != nil {
+		return err
+	}
+
+	lobby.SetServer(pending.Provider, server)
+	lobby.RegionCode, lobby.RegionName = provider.Region(server)
+	//saved before checking the server, so that it's released when the lobby is closed
+	db.DB.Save(&lobby.ServerInfo)
+	lobby.Save()
+	db.DB.Delete(pending)
+
+	var count int
+	db.DB.Model(&gameserver.ServerRecord{}).Where("host = ? AND id <> ?", lobby.ServerInfo.Host, lobby.ServerInfo.ID).Count(&count)
+	if count != 0 {
+		return errors.New("A lobby is already using this server.")
+	}
+	return nil
+}
+
+//Open gets and sets up the game server for a scheduled lobby, and moves it to the Waiting state.
+//Players who joined the lobby or signed up for it are notified. If the lobby's serveme
+//reservation isn't ready yet, Open is tried again later, till ScheduledSetupTimeout.
+func (lobby *Lobby) Open() error {
+	if lobby.CurrentState() != Scheduled {
+		return ErrNotScheduled
+	}
+
+	if err := lobby.acquirePendingServer(); err != nil {
+		chat.SendNotification("Lobby closed (couldn't get a server).", int(lobby.ID))
+		lobby.Close(false, false, "couldn't get a server", 0)
+		return err
+	}
+
+	status, err := lobby.ServerStatus()
+	if err != nil {
+		logrus.Error(err)
+	}
+	if status != gameserver.StatusReady {
+		if status == gameserver.StatusPending && time.Since(lobby.StartsAt) < ScheduledSetupTimeout {
+			return timer.AfterFunc("openScheduledLobby", lobby.ID, 0, 10*time.Second)
+		}
+
+		chat.SendNotification("Lobby closed (serveme reservation wasn't ready).", int(lobby.ID))
+		lobby.Close(false, false, "serveme reservation not ready", 0)
+		return ErrServerNotUp
+	}
+	if err := lobby.SetupServer(); err != nil {
+		chat.SendNotification("Lobby closed (couldn't setup the server).", int(lobby.ID))
+		lobby.Close(false, false, "server setup failed", 0)
+		return err
+	}
+
+	if err := lobby.SetState(Waiting, "scheduled start", 0); err != nil {
+		return err
+	}
+
+	lobby.notifyOpen()
+	if lobby.Draft {
+		if err := lobby.startDraft(); err != nil {
+			logrus.Errorf("Couldn't start draft for lobby %d: %s", lobby.ID, err.Error())
+		}
+	}
+
+	lobby.OnChange(true)
+	BroadcastUpcomingLobbyList()
+	afterScheduledOpen(lobby)
+	return nil
+}
+
+//notifyOpen tells players in the lobby (and those who signed up for the draft) that it has opened
+func (lobby *Lobby) notifyOpen() {
+	var ids []uint
+	db.DB.Model(&LobbySlot{}).Where("lobby_id = ?", lobby.ID).Pluck("player_id", &ids)
+	for _, signup := range lobby.GetSignups() {
+		ids = append(ids, signup.PlayerID)
+	}
+
+	data := DecorateLobbyData(lobby, false)
+	for _, id := range ids {
+		if p, err := player.GetPlayerByID(id); err == nil {
+			broadcaster.SendMessage(p.SteamID, "lobbyOpened", data)
+		}
+	}
+
+	chat.SendNotification("Lobby is now open!", int(lobby.ID))
+}
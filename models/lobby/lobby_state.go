@@ -0,0 +1,145 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package lobby
+
+import (
+	"fmt"
+	"time"
+
+	db "github.com/TF2Stadium/Helen/database"
+)
+
+var stateNames = map[State]string{
+	Initializing: "Initializing",
+	Waiting:      "Waiting",
+	Drafting:     "Drafting",
+	ReadyingUp:   "ReadyingUp",
+	InProgress:   "InProgress",
+	Ended:        "Ended",
+	Scheduled:    "Scheduled",
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+//transitions lists the states a lobby can move to from each state.
+//Ended lobbies can't change state anymore.
+var transitions = map[State][]State{
+	Initializing: {Waiting, Scheduled, Ended},
+	Scheduled:    {Waiting, Ended},
+	Waiting:      {Drafting, ReadyingUp, Ended},
+	Drafting:     {Waiting, ReadyingUp, Ended},
+	ReadyingUp:   {Waiting, InProgress, Ended},
+	InProgress:   {Ended},
+}
+
+//CanTransition returns true if a lobby can move from state from to state to
+func CanTransition(from, to State) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+//TransitionError is returned when a lobby is asked to make an illegal state transition
+type TransitionError struct {
+	From, To State
+}
+
+func (e TransitionError) Error() string {
+	return fmt.Sprintf("Lobby can't go from %s to %s", e.From, e.To)
+}
+
+//LobbyStateTransition records a change in a lobby's state
+type LobbyStateTransition struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+
+	LobbyID   uint `sql:"index"`
+	FromState State
+	ToState   State
+	Cause     string // why the state was changed ("lobby full", "closed by leader", etc)
+	ActorID   uint   // ID of the player who caused the change, 0 if it wasn't caused by a player
+}
+
+//SetState moves the lobby to the given state, and records the transition with the given
+//cause and actor (0 if the transition wasn't caused by a player). A TransitionError is
+//returned if the lobby can't make the transition from it's current state.
+//The state is only changed if the transition could be recorded.
+func (l *Lobby) SetState(s State, cause string, actorID uint) error {
+	for {
+		var from State
+		err := db.DB.DB().QueryRow("SELECT state FROM lobbies WHERE id = $1", l.ID).Scan(&from)
+		if err != nil {
+			return ErrLobbyNotFound
+		}
+
+		if !CanTransition(from, s) {
+			l.State = from
+			return TransitionError{from, s}
+		}
+
+		changed, err := l.changeState(from, s, cause, actorID)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+
+		l.State = s
+		//published once the lobby's state has been committed, so
+		//that consumers reading the lobby see it
+		if from == Initializing && s != Ended {
+			l.publishCreated()
+		}
+		return nil
+	}
+}
+
+//changeState updates the lobby's state and records the transition in one transaction,
+//returning false if the lobby isn't in the state from anymore
+func (l *Lobby) changeState(from, to State, cause string, actorID uint) (bool, error) {
+	tx := db.DB.Begin()
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+
+	// only update the state if it hasn't been changed since we read it
+	res := tx.Model(&Lobby{}).Where("id = ? AND state = ?", l.ID, from).UpdateColumn("state", to)
+	if res.Error != nil || res.RowsAffected == 0 {
+		tx.Rollback()
+		return false, res.Error
+	}
+
+	err := tx.Create(&LobbyStateTransition{
+		LobbyID:   l.ID,
+		FromState: from,
+		ToState:   to,
+		Cause:     cause,
+		ActorID:   actorID,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	err = tx.Commit().Error
+	return err == nil, err
+}
+
+//GetStateHistory returns all state transitions for the lobby, oldest first
+func (l *Lobby) GetStateHistory() []*LobbyStateTransition {
+	var history []*LobbyStateTransition
+	db.DB.Where("lobby_id = ?", l.ID).Order("id").Find(&history)
+	return history
+}
@@ -5,7 +5,9 @@
 package lobby_test
 
 import (
+	"errors"
 	"testing"
+	"time"
 
 	db "github.com/TF2Stadium/Helen/database"
 	_ "github.com/TF2Stadium/Helen/helpers"
@@ -15,6 +17,7 @@ import (
 	. "github.com/TF2Stadium/Helen/models/lobby"
 	"github.com/TF2Stadium/Helen/models/lobby/format"
 	. "github.com/TF2Stadium/Helen/models/player"
+	"github.com/TF2Stadium/Helen/models/timer"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -22,11 +25,19 @@ func init() {
 	testhelpers.CleanupDB()
 }
 
+//ruleErr returns the error returned by the rule which failed
+func ruleErr(err error) error {
+	if e, ok := err.(*RuleError); ok {
+		return e.Err
+	}
+	return err
+}
+
 func TestDeleteUnusedServerRecords(t *testing.T) {
 	var count int
 
 	lobby := testhelpers.CreateLobby()
-	lobby.Close(false, true)
+	lobby.Close(false, true, "test", 0)
 	db.DB.Save(&gameserver.ServerRecord{})
 
 	DeleteUnusedServers()
@@ -39,7 +50,7 @@ func TestDeleteUnusedServerRecords(t *testing.T) {
 func TestLobbyCreation(t *testing.T) {
 	t.Parallel()
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
 	lobby.Save()
 
 	lobby2, _ := GetLobbyByIDServer(lobby.ID)
@@ -74,7 +85,7 @@ func TestLobbyClose(t *testing.T) {
 	}
 
 	req.Save()
-	lobby.Close(false, true)
+	lobby.Close(false, true, "test", 0)
 	for _, p := range players {
 		db.DB.Preload("Stats").First(p, p.ID)
 		assert.Equal(t, p.Stats.TotalLobbies(), 1)
@@ -91,7 +102,7 @@ func TestLobbyClose(t *testing.T) {
 func TestLobbyAdd(t *testing.T) {
 	t.Parallel()
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
 	lobby.Save()
 
 	var players []*Player
@@ -134,13 +145,14 @@ func TestLobbyAdd(t *testing.T) {
 	assert.NotNil(t, err)
 
 	lobby2 := testhelpers.CreateLobby()
-	defer lobby2.Close(false, true)
+	defer lobby2.Close(false, true, "test", 0)
 	lobby2.Save()
 
 	// try to add a player while they're in another lobby
 	//player should be substituted
-	lobby.State = InProgress
-	lobby.Save()
+	lobby.SetState(Waiting, "test", 0)
+	lobby.SetState(ReadyingUp, "test", 0)
+	lobby.SetState(InProgress, "test", 0)
 	err = lobby2.AddPlayer(players[0], 1, "")
 	assert.Nil(t, err)
 
@@ -149,10 +161,39 @@ func TestLobbyAdd(t *testing.T) {
 	assert.Equal(t, count, 1)
 }
 
+func TestLobbyAddConcurrent(t *testing.T) {
+	t.Parallel()
+	lob := testhelpers.CreateLobby()
+	defer lob.Close(false, true, "test", 0)
+
+	// several players try to join the same slot at once,
+	// each with their own lobby object (like separate requests)
+	errs := make(chan error)
+	for i := 0; i < 5; i++ {
+		p := testhelpers.CreatePlayer()
+		go func() {
+			l, _ := GetLobbyByID(lob.ID)
+			errs <- l.AddPlayer(p, 0, "")
+		}()
+	}
+
+	var joined int
+	for i := 0; i < 5; i++ {
+		if err := <-errs; err == nil {
+			joined++
+		} else {
+			assert.Equal(t, ErrFilled, err)
+		}
+	}
+
+	assert.Equal(t, 1, joined)
+	assert.Len(t, lob.GetAllSlots(), 1)
+}
+
 func TestLobbyRemove(t *testing.T) {
 	t.Parallel()
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
 	lobby.Save()
 
 	player := testhelpers.CreatePlayer()
@@ -177,7 +218,7 @@ func TestLobbyRemove(t *testing.T) {
 func TestLobbyBan(t *testing.T) {
 	t.Parallel()
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
 	lobby.Save()
 
 	player := testhelpers.CreatePlayer()
@@ -201,7 +242,7 @@ func TestReadyPlayer(t *testing.T) {
 	player := testhelpers.CreatePlayer()
 
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
 	lobby.Save()
 	lobby.AddPlayer(player, 0, "")
 
@@ -222,7 +263,7 @@ func TestSetInGame(t *testing.T) {
 	player := testhelpers.CreatePlayer()
 
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
 	lobby.Save()
 	lobby.AddPlayer(player, 0, "")
 	lobby.SetInGame(player)
@@ -237,7 +278,7 @@ func TestSetNotInGame(t *testing.T) {
 	player := testhelpers.CreatePlayer()
 
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
 	lobby.Save()
 	lobby.AddPlayer(player, 0, "")
 	lobby.SetInGame(player)
@@ -253,7 +294,7 @@ func TestIsPlayerInGame(t *testing.T) {
 	player := testhelpers.CreatePlayer()
 
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
 	lobby.Save()
 	lobby.AddPlayer(player, 0, "")
 	lobby.SetInGame(player)
@@ -267,7 +308,7 @@ func TestIsEveryoneReady(t *testing.T) {
 	player := testhelpers.CreatePlayer()
 
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
 	lobby.Save()
 	lobby.AddPlayer(player, 0, "")
 	lobby.ReadyPlayer(player)
@@ -287,7 +328,7 @@ func TestUnreadyPlayer(t *testing.T) {
 
 	player.Save()
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
 	lobby.Save()
 	lobby.AddPlayer(player, 0, "")
 
@@ -306,7 +347,7 @@ func TestSpectators(t *testing.T) {
 	player2 := testhelpers.CreatePlayer()
 
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
 	lobby.Save()
 
 	err := lobby.AddSpectator(player)
@@ -348,7 +389,7 @@ func TestUnreadyAllPlayers(t *testing.T) {
 	t.Parallel()
 
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
 	lobby.Save()
 
 	for i := 0; i < 12; i++ {
@@ -366,7 +407,7 @@ func TestUnreadyAllPlayers(t *testing.T) {
 func TestRemoveUnreadyPlayers(t *testing.T) {
 	t.Parallel()
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
 	lobby.Save()
 
 	var players []*Player
@@ -393,7 +434,7 @@ func TestRemoveUnreadyPlayers(t *testing.T) {
 func TestUpdateStats(t *testing.T) {
 	t.Parallel()
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, false)
+	defer lobby.Close(false, false, "test", 0)
 	var players []*Player
 
 	for i := 0; i < 6; i++ {
@@ -414,7 +455,7 @@ func TestUpdateStats(t *testing.T) {
 func TestSlotRequirements(t *testing.T) {
 	t.Parallel()
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
 	player := testhelpers.CreatePlayer()
 	req := &Requirement{
 		LobbyID: lobby.ID,
@@ -426,13 +467,13 @@ func TestSlotRequirements(t *testing.T) {
 
 	assert.True(t, lobby.HasSlotRequirement(0))
 	err := lobby.AddPlayer(player, 0, "")
-	assert.Equal(t, err, ErrReqHours)
+	assert.Equal(t, ruleErr(err), ErrReqHours)
 
 	player.GameHours = 2
 	player.Save()
 
 	err = lobby.AddPlayer(player, 0, "")
-	assert.Equal(t, err, ErrReqLobbies)
+	assert.Equal(t, ruleErr(err), ErrReqLobbies)
 
 	player, _ = GetPlayerWithStats(player.SteamID)
 	player.Stats.PlayedCountIncrease(lobby.Type)
@@ -452,10 +493,203 @@ func TestSlotRequirements(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestRatingRequirement(t *testing.T) {
+	t.Parallel()
+	lobby := testhelpers.CreateLobby()
+	defer lobby.Close(false, true, "test", 0)
+	player := testhelpers.CreatePlayer()
+
+	req := &Requirement{LobbyID: lobby.ID, Slot: 0, MinRating: 1600}
+	req.Save()
+	req = &Requirement{LobbyID: lobby.ID, Slot: 1, MaxRating: 1400}
+	req.Save()
+	req = &Requirement{LobbyID: lobby.ID, Slot: 2, MinRating: 1400, MaxRating: 1600}
+	req.Save()
+
+	// new players have a rating of 1500
+	assert.Equal(t, ErrReqRating, ruleErr(lobby.AddPlayer(player, 0, "")))
+	assert.Equal(t, ErrReqRating, ruleErr(lobby.AddPlayer(player, 1, "")))
+	assert.NoError(t, lobby.AddPlayer(player, 2, ""))
+}
+
+func TestReliabilityRequirement(t *testing.T) {
+	t.Parallel()
+	lobby := testhelpers.CreateLobby()
+	defer lobby.Close(false, true, "test", 0)
+	player := testhelpers.CreatePlayer()
+
+	req := &Requirement{LobbyID: lobby.ID, Slot: 0, Reliability: 0.9}
+	req.Save()
+
+	assert.NoError(t, lobby.AddPlayer(player, 0, ""))
+	lobby.RemovePlayer(player)
+
+	player.NewReport(Vote, lobby.ID)
+	assert.Equal(t, ErrReqReliability, ruleErr(lobby.AddPlayer(player, 0, "")))
+}
+
+func TestSlotRules(t *testing.T) {
+	t.Parallel()
+	lobby := testhelpers.CreateLobby()
+	defer lobby.Close(false, true, "test", 0)
+	player := testhelpers.CreatePlayer()
+	player.Region = "na"
+	player.Save()
+
+	medic, _ := format.GetSlot(lobby.Type, "red", "medic")
+	_, err := lobby.AddRule(medic, "classLobbies", []byte(`{"class": "medic", "min": 50}`))
+	assert.NoError(t, err)
+	_, err = lobby.AddRule(-1, "region", []byte(`{"regions": ["eu"]}`))
+	assert.NoError(t, err)
+	_, err = lobby.AddRule(0, "noSuchRule", nil)
+	assert.Equal(t, ErrUnknownRule, err)
+
+	assert.Len(t, lobby.GetSlotRules(medic), 2)
+	assert.Len(t, lobby.GetSlotRules(0), 1)
+
+	// rules for all slots are checked first
+	err = lobby.AddPlayer(player, medic, "")
+	if assert.IsType(t, &RuleError{}, err) {
+		assert.Equal(t, "region", err.(*RuleError).Rule)
+		assert.Equal(t, medic, err.(*RuleError).Slot)
+	}
+
+	player.Region = "eu"
+	player.Save()
+	err = lobby.AddPlayer(player, medic, "")
+	if assert.IsType(t, &RuleError{}, err) {
+		assert.Equal(t, "classLobbies", err.(*RuleError).Rule)
+	}
+	assert.NoError(t, lobby.AddPlayer(player, 0, ""))
+}
+
+func TestRecordResult(t *testing.T) {
+	t.Parallel()
+	lobby := testhelpers.CreateLobby()
+	defer lobby.Close(false, true, "test", 0)
+
+	red := testhelpers.CreatePlayer()
+	blu := testhelpers.CreatePlayer()
+	lobby.AddPlayer(red, 0, "")
+	lobby.AddPlayer(blu, format.NumberOfClasses(lobby.Type), "")
+
+	assert.Equal(t, ErrInvalidResult, lobby.RecordResult("green", 1, 0))
+	assert.NoError(t, lobby.RecordResult("red", 3, 1))
+
+	lobby, _ = GetLobbyByID(lobby.ID)
+	assert.Equal(t, "red", lobby.Winner)
+	assert.Equal(t, 3, lobby.RedScore)
+	assert.Equal(t, 1, lobby.BluScore)
+
+	redRating := red.GetRating(lobby.Type, "")
+	bluRating := blu.GetRating(lobby.Type, "")
+	assert.True(t, redRating.Rating > 1500)
+	assert.True(t, bluRating.Rating < 1500)
+	assert.Equal(t, 1, redRating.Matches)
+
+	class, _ := format.GetSlotTF2Class(lobby.Type, 0)
+	assert.Equal(t, 1, red.GetRating(lobby.Type, class).Matches)
+	assert.Len(t, red.GetRatings(), 2)
+}
+
+func TestBalance(t *testing.T) {
+	t.Parallel()
+	lobby := testhelpers.CreateLobby()
+	defer lobby.Close(false, true, "test", 0)
+
+	classes := format.NumberOfClasses(lobby.Type)
+	hours := map[int]int{0: 1000, 1: 900, classes: 100, classes + 1: 100}
+	players := make(map[int]*Player)
+	for slot, h := range hours {
+		p := testhelpers.CreatePlayer()
+		p.GameHours = h
+		p.Save()
+		lobby.AddPlayer(p, slot, "")
+		players[slot] = p
+	}
+
+	// nobody has a rating yet, so hours are used
+	assert.True(t, lobby.Balance())
+
+	slot, _ := lobby.GetPlayerSlot(players[0])
+	assert.Equal(t, classes, slot)
+	slot, _ = lobby.GetPlayerSlot(players[classes])
+	assert.Equal(t, 0, slot)
+	slot, _ = lobby.GetPlayerSlot(players[1])
+	assert.Equal(t, 1, slot)
+
+	// already balanced
+	assert.False(t, lobby.Balance())
+}
+
+func TestDraft(t *testing.T) {
+	t.Parallel()
+	lobby := testhelpers.CreateLobby()
+	defer lobby.Close(false, true, "test", 0)
+	lobby.Draft = true
+	lobby.Save()
+	lobby.SetState(Waiting, "test", 0)
+
+	classes := format.GetClasses(lobby.Type)
+	var players []*Player
+	for i := 0; i < format.NumberOfSlots(lobby.Type); i++ {
+		p := testhelpers.CreatePlayer()
+		// the first two players volunteer as captains
+		assert.NoError(t, lobby.SignUp(p, classes, i < 2))
+		players = append(players, p)
+		if i == 0 {
+			assert.Error(t, lobby.SignUp(p, []string{"sniper9"}, true))
+		}
+	}
+
+	// the last sign up started the draft
+	assert.Equal(t, Drafting, lobby.CurrentState())
+	assert.Equal(t, players[0].ID, lobby.RedCaptainID)
+	assert.Equal(t, players[1].ID, lobby.BluCaptainID)
+	assert.Equal(t, 2, lobby.GetPlayerNumber())
+	assert.Len(t, lobby.GetSignups(), len(players)-2)
+	assert.Equal(t, "red", lobby.DraftTurn)
+
+	assert.Equal(t, ErrNotYourTurn, lobby.DraftPick(players[1], players[2], classes[1]))
+	assert.Equal(t, ErrNotCaptain, lobby.DraftPick(players[2], players[3], classes[1]))
+	assert.NoError(t, lobby.DraftPick(players[0], players[2], classes[1]))
+	assert.Equal(t, ErrPlayerNotInDraft, lobby.DraftPick(players[1], players[2], classes[1]))
+
+	slot, err := lobby.GetPlayerSlot(players[2])
+	assert.NoError(t, err)
+	assert.Equal(t, 1, slot)
+	assert.Equal(t, "blu", lobby.DraftTurn)
+
+	// players who signed up first are picked first when ratings are equal,
+	// and get the first free class they signed up for
+	assert.NoError(t, lobby.AutoPick())
+	slot, err = lobby.GetPlayerSlot(players[3])
+	assert.NoError(t, err)
+	assert.Equal(t, len(classes)+1, slot)
+	assert.Equal(t, "red", lobby.DraftTurn)
+	assert.Len(t, lobby.GetSignups(), len(players)-4)
+}
+
+func TestDecorateDraftMissingCaptain(t *testing.T) {
+	t.Parallel()
+	lobby := testhelpers.CreateLobby()
+	defer lobby.Close(false, true, "test", 0)
+	captain := testhelpers.CreatePlayer()
+
+	lobby.Draft = true
+	lobby.RedCaptainID = captain.ID
+	lobby.BluCaptainID = captain.ID + 1000 // deleted player
+	data := DecorateLobbyData(lobby, false)
+	if assert.NotNil(t, data.DraftInfo) {
+		assert.Equal(t, captain.SteamID, data.DraftInfo.Captains.Red)
+		assert.Empty(t, data.DraftInfo.Captains.Blu)
+	}
+}
+
 func TestHasPlayer(t *testing.T) {
 	t.Parallel()
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
 	player := testhelpers.CreatePlayer()
 
 	lobby.AddPlayer(player, 1, "")
@@ -471,7 +705,7 @@ func TestHasPlayer(t *testing.T) {
 func TestSlotNeedsSubstitute(t *testing.T) {
 	t.Parallel()
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
 	player := testhelpers.CreatePlayer()
 
 	lobby.AddPlayer(player, 1, "")
@@ -483,7 +717,7 @@ func TestSlotNeedsSubstitute(t *testing.T) {
 func TestFillSubstitute(t *testing.T) {
 	t.Parallel()
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
 
 	player := testhelpers.CreatePlayer()
 
@@ -498,16 +732,418 @@ func TestFillSubstitute(t *testing.T) {
 func TestStart(t *testing.T) {
 	t.Parallel()
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
+
+	// lobbies can only be started after readying up
+	lobby.Start()
+	assert.Equal(t, lobby.CurrentState(), Initializing)
 
+	lobby.SetState(Waiting, "test", 0)
+	lobby.SetState(ReadyingUp, "test", 0)
 	lobby.Start()
 	assert.Equal(t, lobby.CurrentState(), InProgress)
 }
 
+func TestSetState(t *testing.T) {
+	t.Parallel()
+	lobby := testhelpers.CreateLobby()
+	player := testhelpers.CreatePlayer()
+
+	err := lobby.SetState(InProgress, "test", 0)
+	assert.Equal(t, TransitionError{Initializing, InProgress}, err)
+
+	assert.NoError(t, lobby.SetState(Waiting, "test", 0))
+	assert.NoError(t, lobby.SetState(ReadyingUp, "lobby full", player.ID))
+	assert.Equal(t, ReadyingUp, lobby.CurrentState())
+
+	lobby.Close(false, false, "closed by leader", player.ID)
+	assert.Equal(t, Ended, lobby.CurrentState())
+
+	// closed lobbies stay closed
+	err = lobby.SetState(Waiting, "ready up timed out", 0)
+	assert.Equal(t, TransitionError{Ended, Waiting}, err)
+	assert.Equal(t, Ended, lobby.State)
+
+	history := lobby.GetStateHistory()
+	if assert.Len(t, history, 3) {
+		assert.Equal(t, Initializing, history[0].FromState)
+		assert.Equal(t, Waiting, history[0].ToState)
+		assert.Equal(t, "lobby full", history[1].Cause)
+		assert.Equal(t, player.ID, history[1].ActorID)
+		assert.Equal(t, ReadyingUp, history[2].FromState)
+		assert.Equal(t, Ended, history[2].ToState)
+		assert.Equal(t, "closed by leader", history[2].Cause)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	t.Parallel()
+	lobby := testhelpers.CreateLobby()
+	defer lobby.Close(false, true, "test", 0)
+	player := testhelpers.CreatePlayer()
+
+	assert.Equal(t, ErrStartTime, lobby.Schedule(time.Now().Add(-time.Hour), player.ID))
+	assert.Equal(t, ErrStartTime, lobby.Schedule(time.Now().Add(MaxScheduleAhead+time.Hour), player.ID))
+	assert.Equal(t, Initializing, lobby.CurrentState())
+
+	assert.NoError(t, lobby.Schedule(time.Now().Add(time.Hour), player.ID))
+	assert.Equal(t, Scheduled, lobby.CurrentState())
+	assert.Len(t, timer.GetPending(lobby.ID), 1)
+
+	var found bool
+	for _, l := range GetScheduledLobbies() {
+		found = found || l.ID == lobby.ID
+	}
+	assert.True(t, found)
+
+	// players can join before the lobby opens, but it doesn't ready up
+	assert.NoError(t, lobby.AddPlayer(player, 0, ""))
+	assert.Equal(t, TransitionError{Scheduled, ReadyingUp}, lobby.SetState(ReadyingUp, "lobby full", 0))
+
+	lobby.Close(false, false, "test", 0)
+	assert.Empty(t, timer.GetPending(lobby.ID))
+}
+
+func TestScheduleStoredServer(t *testing.T) {
+	t.Parallel()
+	lobby := testhelpers.CreateLobby()
+	defer lobby.Close(false, true, "test", 0)
+	player := testhelpers.CreatePlayer()
+
+	stored, err := gameserver.NewStoredServer("scheduled", "10.0.3.1:27015", "rcon")
+	assert.NoError(t, err)
+	stored.Region = "scheduled"
+	assert.NoError(t, stored.Save())
+
+	req := gameserver.ServerRequest{SteamID: player.SteamID, Region: "scheduled", Tags: format.Sixes.Names()}
+	assert.NoError(t, lobby.SetPendingServer(gameserver.ProviderStored, req))
+	assert.NoError(t, lobby.Schedule(time.Now().Add(time.Hour), player.ID))
+	assert.Equal(t, "scheduled", lobby.RegionCode)
+
+	// the server isn't used by the lobby till it opens
+	stored, _ = gameserver.GetStoredServerByID(stored.ID)
+	assert.False(t, stored.Used)
+
+	assert.NoError(t, lobby.Open())
+	assert.Equal(t, Waiting, lobby.CurrentState())
+	stored, _ = gameserver.GetStoredServerByID(stored.ID)
+	assert.True(t, stored.Used)
+
+	lobby, _ = GetLobbyByIDServer(lobby.ID)
+	assert.Equal(t, gameserver.ProviderStored, lobby.ServerProvider)
+	assert.Equal(t, stored.Address, lobby.ServerInfo.Host)
+
+	lobby.Close(false, false, "test", 0)
+	stored, _ = gameserver.GetStoredServerByID(stored.ID)
+	assert.False(t, stored.Used)
+}
+
+func TestPresets(t *testing.T) {
+	t.Parallel()
+	player := testhelpers.CreatePlayer()
+
+	_, err := SavePreset(player.ID, "", []byte(`{"map": "cp_badlands"}`))
+	assert.Equal(t, ErrPresetName, err)
+	_, err = SavePreset(player.ID, "nightly", []byte(`["cp_badlands"]`))
+	assert.Equal(t, ErrPresetArgs, err)
+
+	preset, err := SavePreset(player.ID, "nightly", []byte(`{"map": "cp_badlands", "type": "6s"}`))
+	assert.NoError(t, err)
+	// saving with the same name replaces the preset
+	preset2, err := SavePreset(player.ID, "nightly", []byte(`{"map": "cp_process_final", "type": "6s"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, preset.ID, preset2.ID)
+	assert.Len(t, GetPresets(player.ID), 1)
+
+	// the RCON password and arguments for a single lobby aren't saved
+	preset, err = SavePreset(player.ID, "nightly", []byte(`{"map": "cp_process_final", "type": "6s",
+		"rconpwd": "secret", "serveme": {"startsAt": "2016-01-01T20:00:00.000+01:00"}, "startsAt": 1451674800}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"map": "cp_process_final", "type": "6s"}`, preset.Args)
+	_, err = SavePreset(player.ID, "secret", []byte(`{"rconpwd": "secret"}`))
+	assert.Equal(t, ErrPresetArgs, err)
+	// field names are matched case-insensitively when the arguments are decoded
+	preset, err = SavePreset(player.ID, "nightly", []byte(`{"map": "cp_process_final", "RconPwd": "secret", "StartsAt": 1}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"map": "cp_process_final"}`, preset.Args)
+
+	_, err = GetPreset(player.ID+1, preset.ID)
+	assert.Equal(t, ErrPresetNotFound, err)
+	preset, err = GetPreset(player.ID, preset.ID)
+	assert.NoError(t, err)
+
+	args, err := preset.Merge([]byte(`{"map": "cp_gullywash_final1", "mumbleRequired": true}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"map": "cp_gullywash_final1", "type": "6s", "mumbleRequired": true}`, string(args))
+
+	assert.NoError(t, preset.Delete())
+	assert.Empty(t, GetPresets(player.ID))
+}
+
+func TestRematch(t *testing.T) {
+	t.Parallel()
+	leader := testhelpers.CreatePlayer()
+	lobby := testhelpers.CreateLobby()
+	lobby.CreatedBySteamID = leader.SteamID
+	lobby.Save()
+
+	var players []*Player
+	for i := 0; i < 2; i++ {
+		p := testhelpers.CreatePlayer()
+		assert.NoError(t, lobby.AddPlayer(p, i, ""))
+		players = append(players, p)
+	}
+
+	_, err := lobby.Rematch(leader.ID, true)
+	assert.Equal(t, ErrNoRematch, err)
+
+	lobby.Close(false, true, "match ended", 0)
+	rematch, err := lobby.Rematch(leader.ID, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer rematch.Close(false, false, "test", 0)
+
+	_, err = lobby.Rematch(leader.ID, true)
+	assert.Equal(t, ErrRematchStarted, err)
+	assert.Equal(t, Waiting, rematch.CurrentState())
+	assert.Equal(t, lobby.MapName, rematch.MapName)
+	assert.Equal(t, leader.SteamID, rematch.CreatedBySteamID)
+
+	// players are reserved the same class on the other team
+	blu := format.NumberOfClasses(lobby.Type)
+	assert.False(t, rematch.IsSlotReserved(0))
+	assert.True(t, rematch.IsSlotReserved(blu))
+	assert.True(t, rematch.IsSlotReserved(blu+1))
+
+	assert.Equal(t, ErrSlotReserved, rematch.AddPlayer(testhelpers.CreatePlayer(), blu, ""))
+	assert.NoError(t, rematch.AddPlayer(players[0], blu, ""))
+	assert.False(t, rematch.IsSlotReserved(blu))
+
+	// taking another slot gives up the reservation
+	assert.NoError(t, rematch.AddPlayer(players[1], 0, ""))
+	assert.False(t, rematch.IsSlotReserved(blu+1))
+}
+
+func TestDraftRematch(t *testing.T) {
+	t.Parallel()
+	leader := testhelpers.CreatePlayer()
+	lobby := testhelpers.CreateLobby()
+	lobby.CreatedBySteamID = leader.SteamID
+	lobby.Draft = true
+	lobby.Save()
+
+	var players []*Player
+	for i := 0; i < 2; i++ {
+		p := testhelpers.CreatePlayer()
+		assert.NoError(t, lobby.AddPlayer(p, i, ""))
+		players = append(players, p)
+	}
+
+	lobby.Close(false, true, "match ended", 0)
+	rematch, err := lobby.Rematch(leader.ID, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer rematch.Close(false, false, "test", 0)
+	assert.True(t, rematch.Draft)
+
+	classes := format.GetClasses(rematch.Type)
+	for i := 0; i < format.NumberOfSlots(rematch.Type)-len(players); i++ {
+		assert.NoError(t, rematch.SignUp(testhelpers.CreatePlayer(), classes, i < 2))
+	}
+	// the draft waits for the reserved slots
+	assert.Equal(t, Waiting, rematch.CurrentState())
+
+	assert.True(t, rematch.IsSlotReservedFor(0, players[0].ID))
+	assert.NoError(t, rematch.AddPlayer(players[0], 0, ""))
+	assert.Equal(t, Waiting, rematch.CurrentState())
+	assert.NoError(t, rematch.AddPlayer(players[1], 1, ""))
+	assert.Equal(t, Drafting, rematch.CurrentState())
+}
+
+func TestCreateUnique(t *testing.T) {
+	t.Parallel()
+	creator := testhelpers.CreatePlayer()
+	newLobby := func() *Lobby {
+		lobby := NewLobby("cp_badlands", format.Sixes, "etf2l", gameserver.ServerRecord{}, "0", false, "")
+		lobby.CreatedBySteamID = creator.SteamID
+		return lobby
+	}
+
+	first := newLobby()
+	assert.NoError(t, first.CreateUnique())
+	assert.Equal(t, ErrStillCreating, newLobby().CreateUnique())
+
+	// the next lobby can be created once the first one is
+	assert.NoError(t, first.SetState(Waiting, "test", 0))
+	assert.NoError(t, newLobby().CreateUnique())
+}
+
+func TestServerProvider(t *testing.T) {
+	t.Parallel()
+	provider := testhelpers.NewFakeProvider(gameserver.StatusPending)
+	gameserver.RegisterProvider("fake", provider)
+
+	server, err := provider.Acquire(gameserver.ServerRequest{RconPassword: "rcon"})
+	assert.NoError(t, err)
+
+	lobby := testhelpers.CreateLobby()
+	lobby.SetServer("fake", server)
+	lobby.Save()
+
+	lobby, _ = GetLobbyByIDServer(lobby.ID)
+	assert.Equal(t, "fake", lobby.ServerProvider)
+	assert.Equal(t, server.Host, lobby.ServerInfo.Host)
+	assert.Equal(t, "rcon", lobby.ServerInfo.RconPassword)
+
+	status, err := lobby.ServerStatus()
+	assert.NoError(t, err)
+	assert.Equal(t, gameserver.StatusPending, status)
+
+	lobby.Delete()
+	assert.True(t, provider.Released(server.Host))
+
+	lobby.ServerProvider = "nonexistent"
+	_, err = lobby.Provider()
+	assert.Equal(t, gameserver.ErrNoProvider, err)
+}
+
+//not parallel, as reconciling checks every lobby's server
+func TestReconcileReservations(t *testing.T) {
+	provider := testhelpers.NewFakeProvider(gameserver.StatusReady)
+	gameserver.RegisterProvider("reconcileFake", provider)
+
+	newLobby := func() *Lobby {
+		server, err := provider.Acquire(gameserver.ServerRequest{RconPassword: "rcon"})
+		assert.NoError(t, err)
+
+		lobby := testhelpers.CreateLobby()
+		lobby.SetServer("reconcileFake", server)
+		lobby.Save()
+		lobby.SetState(Waiting, "test", 0)
+		lobby, _ = GetLobbyByIDServer(lobby.ID)
+		return lobby
+	}
+
+	lobby := newLobby()
+	status, _ := ReservationStatus(lobby.ID)
+	assert.Equal(t, ReservationUnknown, status)
+
+	ReconcileReservations()
+	status, checkedAt := ReservationStatus(lobby.ID)
+	assert.Equal(t, ReservationReady, status)
+	assert.False(t, checkedAt.IsZero())
+	assert.Equal(t, ReservationReady, DecorateLobbyData(lobby, false).Reservation.Status)
+
+	provider.SetState(gameserver.StatusEnded)
+	ReconcileReservations()
+	assert.Equal(t, Ended, lobby.CurrentState())
+	assert.True(t, provider.Released(lobby.ServerInfo.Host))
+
+	//reservations which couldn't be released are released later
+	deleted := newLobby()
+	provider.SetReleaseErr(errors.New("serveme is down"))
+	deleted.Delete()
+	assert.False(t, provider.Released(deleted.ServerInfo.Host))
+
+	var stale *StaleReservation
+	for _, reservation := range GetStaleReservations() {
+		if reservation.LobbyID == deleted.ID {
+			stale = reservation
+		}
+	}
+	if assert.NotNil(t, stale) {
+		assert.Equal(t, deleted.ServemeID, stale.ReservationID)
+	}
+
+	provider.SetReleaseErr(nil)
+	ReconcileReservations()
+	assert.True(t, provider.Released(deleted.ServerInfo.Host))
+	for _, reservation := range GetStaleReservations() {
+		assert.NotEqual(t, deleted.ID, reservation.LobbyID)
+	}
+
+	//lobbies left initializing (like after a restart) are deleted, freeing their servers
+	server, _ := provider.Acquire(gameserver.ServerRequest{RconPassword: "rcon"})
+	failed := testhelpers.CreateLobby()
+	failed.SetServer("reconcileFake", server)
+	failed.ServemeID = 0
+	failed.Save()
+	db.DB.Model(&Lobby{}).Where("id = ?", failed.ID).UpdateColumn("created_at", time.Now().Add(-2*StaleInitializingTimeout))
+
+	ReconcileReservations()
+	assert.True(t, provider.Released(server.Host))
+	_, err := GetLobbyByID(failed.ID)
+	assert.Equal(t, ErrLobbyNotFound, err)
+}
+
+func TestReconcileServemeReservations(t *testing.T) {
+	serveme := testhelpers.NewFakeServeme()
+	defer serveme.Close()
+	gameserver.RegisterProvider("reconcileServeme", gameserver.NewServemeProvider(serveme.URL))
+
+	lobby := testhelpers.CreateLobby()
+	lobby.SetServer("reconcileServeme", &gameserver.Server{Host: "127.0.0.1:27015", ReservationID: 4242})
+	lobby.Save()
+	lobby.SetState(Waiting, "test", 0)
+
+	serveme.SetReservation(4242, "Ready", false)
+	ReconcileReservations()
+	status, _ := ReservationStatus(lobby.ID)
+	assert.Equal(t, ReservationReady, status)
+
+	serveme.SetReservation(4242, "Ended", true)
+	ReconcileReservations()
+	assert.Equal(t, Ended, lobby.CurrentState())
+	assert.True(t, serveme.Deleted(4242))
+}
+
+func TestChatRelay(t *testing.T) {
+	t.Parallel()
+	lobby := testhelpers.CreateLobby()
+	defer lobby.Close(false, true, "test", 0)
+	player := testhelpers.CreatePlayer()
+
+	assert.False(t, lobby.ChatRelayEnabled(player.ID))
+	lobby.SetChatRelay(player.ID, true)
+	lobby.SetChatRelay(player.ID, true)
+	assert.True(t, lobby.ChatRelayEnabled(player.ID))
+
+	//the server isn't setup while the lobby is initializing
+	assert.False(t, lobby.RelayChat(player, "hello"))
+
+	var said []string
+	restore := SetSay(func(lobbyID uint, text string) {
+		if lobbyID == lobby.ID {
+			said = append(said, text)
+		}
+	})
+	defer restore()
+
+	lobby.SetState(Waiting, "test", 0)
+	assert.True(t, lobby.RelayChat(player, "hello"))
+	assert.False(t, lobby.RelayChat(player, "hello again"))
+
+	//commands can't be added to the say command
+	other := testhelpers.CreatePlayer()
+	other.Name = "a\";quit"
+	other.Save()
+	lobby.SetChatRelay(other.ID, true)
+	assert.True(t, lobby.RelayChat(other, "gg\"; rcon_password x;\nquit"))
+	assert.Equal(t, []string{
+		ChatRelayPrefix + " " + player.Alias() + ": hello",
+		ChatRelayPrefix + " aquit: gg rcon_password xquit",
+	}, said)
+
+	lobby.SetChatRelay(player.ID, false)
+	assert.False(t, lobby.ChatRelayEnabled(player.ID))
+}
+
 func TestIsSubNeeded(t *testing.T) {
 	t.Parallel()
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
 	player := testhelpers.CreatePlayer()
 	lobby.AddPlayer(player, 1, "")
 
@@ -519,7 +1155,7 @@ func TestIsSubNeeded(t *testing.T) {
 func TestLobbySlots(t *testing.T) {
 	t.Parallel()
 	lobby := testhelpers.CreateLobby()
-	defer lobby.Close(false, true)
+	defer lobby.Close(false, true, "test", 0)
 
 	for i := 0; i < 12; i++ {
 		p := testhelpers.CreatePlayer()
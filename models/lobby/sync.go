@@ -1,65 +1,81 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
 package lobby
 
 import (
-	"sync"
+	"errors"
 
 	db "github.com/TF2Stadium/Helen/database"
+	"github.com/jinzhu/gorm"
 )
 
-var (
-	mu         = new(sync.RWMutex)
-	lobbyLocks = make(map[uint]*sync.Mutex)
+//key spaces for advisory locks, so they don't collide with locks taken for other tables
+const (
+	lobbyLockSpace   = 1
+	creatorLockSpace = 2 // keyed by the hash of the creator's steam ID
 )
 
-//Lock aquires the lock for the given lobby.
-//Be careful while using Lock outside of models,
-//improper usage could result in deadlocks
-func (lobby *Lobby) Lock() {
-	mu.RLock()
-	lock, ok := lobbyLocks[lobby.ID]
-	mu.RUnlock()
-	if ok {
-		lock.Lock()
-	}
+var ErrStillCreating = errors.New("Your last lobby is still being created.")
+
+//WithLock calls f in a transaction holding a Postgres advisory lock for the lobby,
+//so changes made to the lobby are serialized across all Helen instances.
+//The transaction is committed if f returns nil, and rolled back otherwise.
+//Be careful while using WithLock outside of models,
+//taking locks for two lobbies at once could result in deadlocks
+func (lobby *Lobby) WithLock(f func(tx *gorm.DB) error) error {
+	return withAdvisoryLock(f, "SELECT pg_advisory_xact_lock(?, ?)", lobbyLockSpace, lobby.ID)
 }
 
-//Unlock releases the lock for the given lobby
-func (lobby *Lobby) Unlock() {
-	mu.RLock()
-	lock, ok := lobbyLocks[lobby.ID]
-	mu.RUnlock()
-	if ok {
-		lock.Unlock()
+//CreateUnique saves the new lobby, unless the player who created it already has a lobby
+//which is being created (Initializing). The check is serialized per creator across all
+//Helen instances, lobbies created by the matchmaking queue (without a creator) aren't checked.
+func (lobby *Lobby) CreateUnique() error {
+	if lobby.CreatedBySteamID == "" {
+		return lobby.Save()
 	}
-}
 
-//CreateLock creates a lock for lobby
-func (lobby *Lobby) CreateLock() {
-	mu.Lock()
-	lobbyLocks[lobby.ID] = new(sync.Mutex)
-	mu.Unlock()
-}
+	err := withAdvisoryLock(func(tx *gorm.DB) error {
+		var count int
+		tx.Model(&Lobby{}).Where("created_by_steam_id = ? AND state = ?", lobby.CreatedBySteamID, Initializing).Count(&count)
+		if count != 0 {
+			return ErrStillCreating
+		}
 
-func (lobby *Lobby) deleteLock() {
-	mu.Lock()
-	lock, ok := lobbyLocks[lobby.ID]
-	if ok {
-		lock.Lock()
-		delete(lobbyLocks, lobby.ID)
-		lock.Unlock()
+		return tx.Create(lobby).Error
+	}, "SELECT pg_advisory_xact_lock(?, hashtext(?))", creatorLockSpace, lobby.CreatedBySteamID)
+	if err != nil {
+		return err
 	}
-	mu.Unlock()
+
+	lobby.OnChange(true)
+	return nil
 }
 
-//CreateLocks creates locks for all lobbies that haven't ended yet
-func CreateLocks() {
-	mu.Lock()
-	defer mu.Unlock()
+//withAdvisoryLock calls f in a transaction, after taking the advisory lock with the given query
+func withAdvisoryLock(f func(tx *gorm.DB) error, lock string, args ...interface{}) error {
+	tx := db.DB.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
 
-	var ids []uint
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
 
-	db.DB.Model(&Lobby{}).Where("state <> ?", Ended).Pluck("id", &ids)
-	for _, id := range ids {
-		lobbyLocks[id] = new(sync.Mutex)
+	// released when the transaction ends
+	if err := tx.Exec(lock, args...).Error; err != nil {
+		return err
 	}
+
+	if err := f(tx); err != nil {
+		return err
+	}
+
+	committed = true
+	return tx.Commit().Error
 }
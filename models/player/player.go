@@ -20,6 +20,7 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/TF2Stadium/Helen/config"
+	"github.com/TF2Stadium/Helen/controllers/publisher"
 	db "github.com/TF2Stadium/Helen/database"
 	"github.com/TF2Stadium/Helen/helpers"
 	"github.com/TF2Stadium/Helen/helpers/authority"
@@ -49,6 +50,10 @@ type Player struct {
 	Name       string             `json:"name"`              // Player name
 	Role       authority.AuthRole `sql:"default:0" json:"-"` // Role is player by default
 
+	ProfilePrivate bool `json:"-"` // if true, GameHours couldn't be fetched from steam
+
+	Region string `json:"-"` // region code ("na", "eu", etc) the player last connected from
+
 	Settings postgres.Hstore `json:"-"`
 
 	MumbleUsername string `sql:"unique" json:"mumbleUsername"`
@@ -60,6 +65,9 @@ type Player struct {
 
 	ExternalLinks postgres.Hstore `json:"external_links,omitempty"`
 
+	Reliability          float64   `json:"-"` // cached reliability score, use GetReliability
+	ReliabilityUpdatedAt time.Time `json:"-"`
+
 	JSONFields
 }
 
@@ -74,6 +82,9 @@ type JSONFields struct {
 	//PlaceholderLobbies       *[]LobbyData `sql:"-" json:"lobbies"`
 	PlaceholderStats *PlayerStats `sql:"-" json:"stats"`
 	PlaceholderBans  []*PlayerBan `sql:"-" json:"bans"`
+
+	PlaceholderRatings     []*PlayerRating `sql:"-" json:"ratings,omitempty"`
+	PlaceholderReliability *float64        `sql:"-" json:"reliability,omitempty"`
 }
 
 // Create a new player with the given steam id.
@@ -198,8 +209,8 @@ func isClean(s string) bool {
 }
 
 func (player *Player) SetMumbleUsername(lobbyType format.Format, slot int) {
-	_, class, _ := format.GetSlotTeamClass(lobbyType, slot)
-	username := strings.ToUpper(class) + "_"
+	class, _ := format.GetSlotMumbleName(lobbyType, slot)
+	username := class + "_"
 	alias := player.GetSetting("siteAlias")
 
 	switch {
@@ -245,6 +256,17 @@ func (player *Player) Save() error {
 	return err
 }
 
+//SetRole changes the player's role and saves it
+func (player *Player) SetRole(role authority.AuthRole) error {
+	player.Role = role
+	if err := player.Save(); err != nil {
+		return err
+	}
+
+	publisher.Publish(publisher.RoleChanged{SteamID: player.SteamID, Role: helpers.RoleNames[role]})
+	return nil
+}
+
 // Get a player by it's ID
 func GetPlayerByID(ID uint) (*Player, error) {
 	player := &Player{}
@@ -341,7 +363,8 @@ func (player *Player) UpdatePlayerInfo() error {
 	}
 
 	// profile state is 1 when the player have a steam community profile
-	if playerInfo.Profilestate == 1 && playerInfo.Visibility == "public" {
+	player.ProfilePrivate = !(playerInfo.Profilestate == 1 && playerInfo.Visibility == "public")
+	if !player.ProfilePrivate {
 		pHours, hErr := scraper.GetTF2Hours(player.SteamID)
 
 		if hErr != nil {
@@ -3,6 +3,7 @@ package player
 import (
 	"time"
 
+	"github.com/TF2Stadium/Helen/controllers/publisher"
 	db "github.com/TF2Stadium/Helen/database"
 	"github.com/jinzhu/gorm"
 )
@@ -61,6 +62,7 @@ func (player *Player) BanUntil(tim time.Time, t BanType, reason string, bannedBy
 	// first check if player is already banned
 	if banned := player.IsBanned(t); banned {
 		db.DB.Model(&PlayerBan{}).Where("player_id = ? AND type = ? AND active = TRUE AND until > now()", player.ID, t).Update("until", tim)
+		player.publishBan(tim, t, reason, bannedBy)
 		return nil
 	}
 	ban := PlayerBan{
@@ -71,7 +73,25 @@ func (player *Player) BanUntil(tim time.Time, t BanType, reason string, bannedBy
 		BannedByPlayerID: bannedBy,
 	}
 
-	return db.DB.Create(&ban).Error
+	if err := db.DB.Create(&ban).Error; err != nil {
+		return err
+	}
+	player.publishBan(tim, t, reason, bannedBy)
+	return nil
+}
+
+func (player *Player) publishBan(until time.Time, t BanType, reason string, bannedBy uint) {
+	event := publisher.BanIssued{
+		SteamID: player.SteamID,
+		Type:    t.String(),
+		Until:   until,
+		Reason:  reason,
+	}
+	if admin, err := GetPlayerByID(bannedBy); err == nil {
+		event.BannedBy = admin.SteamID
+	}
+
+	publisher.Publish(event)
 }
 
 func (player *Player) Unban(t BanType) error {
@@ -28,6 +28,9 @@ func (p *Player) setJSONFields(stats, lobbies, streaming, bans bool) {
 	if stats {
 		p.Stats.Total = p.Stats.TotalLobbies()
 		p.PlaceholderStats = &p.Stats
+		p.PlaceholderRatings = p.GetRatings()
+		reliability := p.GetReliability()
+		p.PlaceholderReliability = &reliability
 	}
 
 	p.PlaceholderTags = new([]string)
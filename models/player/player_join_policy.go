@@ -0,0 +1,143 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package player
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TF2Stadium/Helen/config"
+	db "github.com/TF2Stadium/Helen/database"
+	"github.com/TF2Stadium/Helen/helpers"
+	"github.com/TF2Stadium/Helen/helpers/authority"
+)
+
+var (
+	ErrProfileNotFetched = errors.New("Your Steam profile is being checked, try again in a minute.")
+	ErrPrivateProfile    = errors.New("Your Steam profile needs to be public to join lobbies.")
+)
+
+//RecheckInterval is how often steam info is refreshed for players who don't have enough
+//hours, so that they don't have to wait for their info to go stale once they do
+const RecheckInterval = 10 * time.Minute
+
+//JoinPolicy is the site-wide policy players have to meet to join any lobby,
+//it can be changed by admins at runtime. Only the last row is used.
+type JoinPolicy struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+
+	MinHours             int    // minimum number of TF2 hours, only checked if a Steam API key is set
+	MinAccountAgeDays    int    // minimum number of days since the player first logged in
+	AllowPrivateProfiles bool   // if true, players whose hours can't be fetched aren't checked for them
+	ExemptRoles          string // comma separated role names ("moderator", etc) the policy doesn't apply to
+	StaleHours           int    // steam info older than this is refreshed in the background
+	UpdatedBy            string // SteamID of the admin who changed the policy
+}
+
+//DefaultJoinPolicy returns the policy used when no one has changed it
+func DefaultJoinPolicy() *JoinPolicy {
+	return &JoinPolicy{
+		MinHours:   150,
+		StaleHours: 24,
+	}
+}
+
+//GetJoinPolicy returns the policy currently used
+func GetJoinPolicy() *JoinPolicy {
+	policy := &JoinPolicy{}
+	if err := db.DB.Last(policy).Error; err != nil {
+		return DefaultJoinPolicy()
+	}
+	return policy
+}
+
+//Save stores a new policy, which is used from now on
+func (policy *JoinPolicy) Save() error {
+	policy.ID = 0
+	return db.DB.Create(policy).Error
+}
+
+//IsExempt returns whether players with the given role don't have to meet the policy
+func (policy *JoinPolicy) IsExempt(role authority.AuthRole) bool {
+	for _, name := range strings.Split(policy.ExemptRoles, ",") {
+		if r, ok := helpers.RoleMap[strings.TrimSpace(name)]; ok && r == role {
+			return true
+		}
+	}
+	return false
+}
+
+//Check returns an error if the player doesn't meet the policy. It never waits on the
+//Steam API, stale info is refreshed in the background and used by later checks.
+func (policy *JoinPolicy) Check(p *Player) error {
+	if policy.IsExempt(p.Role) {
+		return nil
+	}
+
+	if time.Since(p.CreatedAt) < time.Duration(policy.MinAccountAgeDays)*24*time.Hour {
+		return fmt.Errorf("Your account needs to be at least %d days old to join lobbies.", policy.MinAccountAgeDays)
+	}
+
+	if config.Constants.SteamDevAPIKey == "" || policy.MinHours <= 0 {
+		return nil
+	}
+
+	p.RefreshProfile(time.Duration(policy.StaleHours) * time.Hour)
+	switch {
+	case p.ProfileUpdatedAt.IsZero():
+		return ErrProfileNotFetched
+	case p.ProfilePrivate && policy.AllowPrivateProfiles:
+		return nil
+	case p.ProfilePrivate:
+		p.RefreshProfile(RecheckInterval)
+		return ErrPrivateProfile
+	case p.GameHours < policy.MinHours:
+		p.RefreshProfile(RecheckInterval)
+		return fmt.Errorf("You need at least %d hours to join lobbies.", policy.MinHours)
+	}
+
+	return nil
+}
+
+var (
+	refreshMu  = new(sync.Mutex)
+	refreshing = make(map[uint]bool)
+)
+
+//RefreshProfile updates the player's steam info in the background if it's older than maxAge.
+//Only one update runs for a player at a time, p itself isn't changed.
+func (p *Player) RefreshProfile(maxAge time.Duration) {
+	if config.Constants.SteamDevAPIKey == "" || time.Since(p.ProfileUpdatedAt) < maxAge {
+		return
+	}
+
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+	if refreshing[p.ID] {
+		return
+	}
+	refreshing[p.ID] = true
+
+	go func(id uint) {
+		defer func() {
+			refreshMu.Lock()
+			delete(refreshing, id)
+			refreshMu.Unlock()
+		}()
+
+		player, err := GetPlayerByID(id)
+		if err != nil {
+			return
+		}
+		if err := player.UpdatePlayerInfo(); err != nil {
+			logrus.Errorf("Couldn't update steam info for %s: %s", player.SteamID, err.Error())
+		}
+	}(p.ID)
+}
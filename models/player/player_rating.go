@@ -0,0 +1,80 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package player
+
+import (
+	"encoding/json"
+	"time"
+
+	db "github.com/TF2Stadium/Helen/database"
+	"github.com/TF2Stadium/Helen/models/lobby/format"
+	"github.com/TF2Stadium/Helen/models/rating"
+)
+
+//PlayerRating stores a player's rating for a format, or for a class in a format
+type PlayerRating struct {
+	ID        uint      `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+
+	PlayerID uint          `json:"-"`
+	Format   format.Format `json:"-"`
+	Class    string        `json:"class,omitempty"` // TF2 class, empty for the rating for the format
+
+	Rating     float64 `json:"rating"`
+	RD         float64 `json:"rd"`
+	Volatility float64 `json:"-"`
+	Matches    int     `json:"matches"`
+}
+
+//MarshalJSON adds the format's name to the rating
+func (r *PlayerRating) MarshalJSON() ([]byte, error) {
+	type playerRating PlayerRating
+	return json.Marshal(struct {
+		Type string `json:"type"`
+		*playerRating
+	}{r.Format.String(), (*playerRating)(r)})
+}
+
+//Get returns the rating in the Glicko-2 representation
+func (r *PlayerRating) Get() rating.Rating {
+	return rating.Rating{Rating: r.Rating, RD: r.RD, Volatility: r.Volatility}
+}
+
+//GetRating returns the player's rating for the given format and class (empty for
+//the rating for the whole format). Players who haven't played it yet have the default rating.
+func (p *Player) GetRating(f format.Format, class string) *PlayerRating {
+	r := &PlayerRating{}
+	err := db.DB.Where("player_id = ? AND format = ? AND class = ?", p.ID, f, class).First(r).Error
+	if err != nil {
+		def := rating.Default()
+		r = &PlayerRating{
+			PlayerID:   p.ID,
+			Format:     f,
+			Class:      class,
+			Rating:     def.Rating,
+			RD:         def.RD,
+			Volatility: def.Volatility,
+		}
+	}
+
+	return r
+}
+
+//GetRatings returns all ratings the player has
+func (p *Player) GetRatings() []*PlayerRating {
+	var ratings []*PlayerRating
+	db.DB.Where("player_id = ?", p.ID).Order("format, class").Find(&ratings)
+	return ratings
+}
+
+//Update sets the rating to new, counting one more match played
+func (r *PlayerRating) Update(new rating.Rating) error {
+	r.Rating = new.Rating
+	r.RD = new.RD
+	r.Volatility = new.Volatility
+	r.Matches++
+
+	return db.DB.Save(r).Error
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package player
+
+import (
+	"math"
+	"time"
+
+	db "github.com/TF2Stadium/Helen/database"
+)
+
+//reliability scores are recomputed when they're older than this
+const reliabilityCacheTime = time.Hour
+
+//ReliabilityConfig stores the weights used to compute reliability scores, so that
+//moderators can tune them. Only the last row is used.
+type ReliabilityConfig struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+
+	Prior        float64 // weight every player starts with, so new players are reliable
+	Completed    float64 // weight of each lobby played till the end
+	SubsTaken    float64 // weight of each substitute slot filled
+	SubReports   float64 // penalty for each time the player needed a substitute
+	VoteReports  float64 // penalty for each time the player was !repped
+	RageQuits    float64 // penalty for each rage quit
+	HalfLifeDays float64 // number of days after which an event counts half as much
+	UpdatedBy    string  // SteamID of the moderator who changed the weights
+}
+
+//DefaultReliabilityConfig returns the weights used when no one has changed them
+func DefaultReliabilityConfig() *ReliabilityConfig {
+	return &ReliabilityConfig{
+		Prior:        5,
+		Completed:    1,
+		SubsTaken:    1,
+		SubReports:   3,
+		VoteReports:  3,
+		RageQuits:    5,
+		HalfLifeDays: 30,
+	}
+}
+
+//GetReliabilityConfig returns the weights currently used to compute reliability scores
+func GetReliabilityConfig() *ReliabilityConfig {
+	config := &ReliabilityConfig{}
+	if err := db.DB.Last(config).Error; err != nil {
+		return DefaultReliabilityConfig()
+	}
+	return config
+}
+
+//Save stores a new set of weights, and invalidates all cached reliability scores
+func (c *ReliabilityConfig) Save() error {
+	c.ID = 0
+	if err := db.DB.Create(c).Error; err != nil {
+		return err
+	}
+
+	return db.DB.Model(&Player{}).UpdateColumn("reliability_updated_at", time.Time{}).Error
+}
+
+//decay returns how much an event that happened at t counts now
+func (c *ReliabilityConfig) decay(t time.Time) float64 {
+	if c.HalfLifeDays <= 0 {
+		return 1
+	}
+
+	days := time.Since(t).Hours() / 24
+	return math.Pow(0.5, days/c.HalfLifeDays)
+}
+
+func (c *ReliabilityConfig) sum(times []time.Time) float64 {
+	var sum float64
+	for _, t := range times {
+		sum += c.decay(t)
+	}
+	return sum
+}
+
+//GetReliability returns the player's reliability score, between 0 (unreliable) and 1.
+//The score is cached, and recomputed once it's older than an hour.
+func (p *Player) GetReliability() float64 {
+	if time.Since(p.ReliabilityUpdatedAt) < reliabilityCacheTime {
+		return p.Reliability
+	}
+
+	return p.UpdateReliability()
+}
+
+//UpdateReliability computes the player's reliability score and caches it.
+//Reports made against the player lower it, while completed lobbies and substitute
+//slots taken raise it. Recent events count more than older ones.
+func (p *Player) UpdateReliability() float64 {
+	c := GetReliabilityConfig()
+
+	reports := func(rtype ReportType) []time.Time {
+		var times []time.Time
+		db.DB.Model(&Report{}).Where("player_id = ? AND type = ?", p.ID, rtype).Pluck("created_at", &times)
+		return times
+	}
+
+	var completed, subsTaken []time.Time
+	db.DB.Table("lobby_slots").
+		Joins("INNER JOIN lobbies ON lobbies.id = lobby_slots.lobby_id").
+		Where("lobby_slots.player_id = ? AND lobby_slots.needs_sub = FALSE AND lobbies.match_ended = TRUE", p.ID).
+		Pluck("lobbies.updated_at", &completed)
+	db.DB.Table("lobby_slots").Where("player_id = ? AND substitute = TRUE", p.ID).
+		Pluck("created_at", &subsTaken)
+
+	good := c.Prior + c.Completed*c.sum(completed) + c.SubsTaken*c.sum(subsTaken)
+	bad := c.SubReports*c.sum(reports(Substitute)) +
+		c.VoteReports*c.sum(reports(Vote)) +
+		c.RageQuits*c.sum(reports(RageQuit))
+
+	p.Reliability = 1
+	if good+bad > 0 {
+		p.Reliability = good / (good + bad)
+	}
+	p.ReliabilityUpdatedAt = time.Now()
+
+	db.DB.Model(&Player{}).Where("id = ?", p.ID).UpdateColumns(map[string]interface{}{
+		"reliability":            p.Reliability,
+		"reliability_updated_at": p.ReliabilityUpdatedAt,
+	})
+
+	return p.Reliability
+}
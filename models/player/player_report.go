@@ -51,4 +51,5 @@ func (player *Player) NewReport(rtype ReportType, lobbyid uint) {
 		Type:     rtype,
 	}
 	db.DB.Save(r)
+	player.UpdateReliability()
 }
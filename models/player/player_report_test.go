@@ -18,11 +18,11 @@ func TestReportSubs(t *testing.T) {
 
 	p := testhelpers.CreatePlayer()
 	l1 := testhelpers.CreateLobby()
-	defer l1.Close(false, false)
+	defer l1.Close(false, false, "test", 0)
 	l2 := testhelpers.CreateLobby()
-	defer l2.Close(false, false)
+	defer l2.Close(false, false, "test", 0)
 	// l3 := testhelpers.CreateLobby()
-	// defer l3.Close(false, false)
+	// defer l3.Close(false, false, "test", 0)
 
 	p.NewReport(Substitute, l1.ID)
 	p.NewReport(Substitute, l2.ID)
@@ -36,9 +36,9 @@ func TestReportVoted(t *testing.T) {
 	t.Parallel()
 	p := testhelpers.CreatePlayer()
 	l1 := testhelpers.CreateLobby()
-	defer l1.Close(false, false)
+	defer l1.Close(false, false, "test", 0)
 	l2 := testhelpers.CreateLobby()
-	defer l2.Close(false, false)
+	defer l2.Close(false, false, "test", 0)
 
 	// RageQuit = Vote + 1, so we don't need to test that
 	p.NewReport(Vote, l1.ID)
@@ -48,3 +48,17 @@ func TestReportVoted(t *testing.T) {
 	assert.True(t, banned, "Player should be banned from joining lobbies")
 	assert.WithinDuration(t, until, time.Now(), 30*time.Minute)
 }
+
+func TestReliability(t *testing.T) {
+	t.Parallel()
+	p := testhelpers.CreatePlayer()
+	l1 := testhelpers.CreateLobby()
+	defer l1.Close(false, false, "test", 0)
+
+	// new players are completely reliable
+	assert.Equal(t, 1.0, p.GetReliability())
+
+	p.NewReport(RageQuit, l1.ID)
+	c := DefaultReliabilityConfig()
+	assert.InDelta(t, c.Prior/(c.Prior+c.RageQuits), p.GetReliability(), 0.001)
+}
@@ -76,12 +76,37 @@ func (ps *PlayerStats) IncreaseSubCount() {
 	database.DB.Save(ps)
 }
 
+//ClassCount returns the number of lobbies played as the given TF2 class
+func (ps *PlayerStats) ClassCount(class string) int {
+	switch class {
+	case "scout":
+		return ps.Scout
+	case "soldier":
+		return ps.Soldier
+	case "pyro":
+		return ps.Pyro
+	case "engineer":
+		return ps.Engineer
+	case "heavy":
+		return ps.Heavy
+	case "demoman":
+		return ps.Demoman
+	case "sniper":
+		return ps.Sniper
+	case "medic":
+		return ps.Medic
+	case "spy":
+		return ps.Spy
+	}
+	return 0
+}
+
 func (ps *PlayerStats) IncreaseClassCount(f format.Format, slot int) {
-	_, class, _ := format.GetSlotTeamClass(f, slot)
+	class, _ := format.GetSlotTF2Class(f, slot)
 	switch class {
-	case "scout", "scout1", "scout2":
+	case "scout":
 		ps.Scout++
-	case "roamer", "pocket", "soldier", "soldier1", "soldier2":
+	case "soldier":
 		ps.Soldier++
 	case "pyro":
 		ps.Pyro++
@@ -10,7 +10,7 @@ import (
 
 	"github.com/TF2Stadium/Helen/config"
 	"github.com/TF2Stadium/Helen/database"
-	_ "github.com/TF2Stadium/Helen/helpers"
+	"github.com/TF2Stadium/Helen/helpers"
 	"github.com/TF2Stadium/Helen/internal/testhelpers"
 	lobbypackage "github.com/TF2Stadium/Helen/models/lobby"
 	"github.com/TF2Stadium/Helen/models/lobby/format"
@@ -30,6 +30,27 @@ func TestGetPlayer(t *testing.T) {
 	assert.Equal(t, player.ID, player2.ID)
 }
 
+func TestJoinPolicy(t *testing.T) {
+	t.Parallel()
+	player := testhelpers.CreatePlayer()
+
+	policy := DefaultJoinPolicy()
+	// hours aren't checked without a steam API key
+	assert.NoError(t, policy.Check(player))
+
+	policy.MinAccountAgeDays = 2
+	assert.Error(t, policy.Check(player))
+
+	policy.ExemptRoles = "moderator,administrator"
+	assert.Error(t, policy.Check(player))
+	player.Role = helpers.RoleMod
+	assert.NoError(t, policy.Check(player))
+
+	player.Role = helpers.RolePlayer
+	player.CreatedAt = time.Now().Add(-3 * 24 * time.Hour)
+	assert.NoError(t, policy.Check(player))
+}
+
 func TestIsSpectating(t *testing.T) {
 	lobby := testhelpers.CreateLobby()
 	database.DB.Save(lobby)
@@ -190,14 +211,9 @@ func TestGetLobbyID(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, id, lobby.ID)
 
-	lobby.State = lobbypackage.Ended
-	lobby.Save()
-	id, err = player.GetLobbyID(false)
-	assert.Error(t, err)
-	assert.Equal(t, id, uint(0))
-
-	lobby.State = lobbypackage.InProgress
-	lobby.Save()
+	lobby.SetState(lobbypackage.Waiting, "test", 0)
+	lobby.SetState(lobbypackage.ReadyingUp, "test", 0)
+	lobby.SetState(lobbypackage.InProgress, "test", 0)
 
 	//Exclude lobbies in progress
 	id, err = player.GetLobbyID(true)
@@ -208,4 +224,9 @@ func TestGetLobbyID(t *testing.T) {
 	id, err = player.GetLobbyID(false)
 	assert.NoError(t, err)
 	assert.Equal(t, id, lobby.ID)
+
+	lobby.SetState(lobbypackage.Ended, "test", 0)
+	id, err = player.GetLobbyID(false)
+	assert.Error(t, err)
+	assert.Equal(t, id, uint(0))
 }
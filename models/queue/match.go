@@ -0,0 +1,370 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	mrand "math/rand"
+	"sort"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/TF2Stadium/Helen/helpers/secret"
+	"github.com/TF2Stadium/Helen/models/gameserver"
+	"github.com/TF2Stadium/Helen/models/lobby"
+	"github.com/TF2Stadium/Helen/models/lobby/format"
+	"github.com/TF2Stadium/Helen/models/player"
+)
+
+var ErrNoServer = errors.New("No free server available for the region")
+
+//Placement represents a queued player who has been put in a lobby slot
+type Placement struct {
+	Lobby  *lobby.Lobby
+	Player *player.Player
+	Slot   int
+}
+
+//NewLobby is a lobby created by Match for a whole group of matched players. It's
+//server is set up, and the players put in it, by Setup, outside of the matcher's lock.
+type NewLobby struct {
+	Lobby *lobby.Lobby
+
+	assignment map[int]*candidate // slot -> matched player
+}
+
+//candidate is a queued player who is still waiting to be placed
+type candidate struct {
+	entry  *QueueEntry
+	player *player.Player
+}
+
+//canPlay returns true if the player can be put in the given slot without any
+//further input from them (slot passwords can't be supplied by the queue)
+func canPlay(lob *lobby.Lobby, p *player.Player, slot int) bool {
+	if lob.IsPlayerBanned(p) {
+		return false
+	}
+	if lob.Mumble && p.IsBanned(player.BanJoinMumble) {
+		return false
+	}
+
+	if lob.HasSlotRequirement(slot) {
+		req, _ := lob.GetSlotRequirement(slot)
+		if req.Password != "" {
+			return false
+		}
+
+		if ok, _ := lob.FitsRequirements(p, slot); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+//getCandidates returns the players queued for the given format and region, dropping entries
+//for players who can't be matched anymore. If connected isn't nil, players for which it returns
+//false are skipped.
+func getCandidates(f format.Format, region string, connected func(*player.Player) bool) []*candidate {
+	var candidates []*candidate
+
+	for _, entry := range GetEntries(f, region) {
+		p, err := player.GetPlayerByID(entry.PlayerID)
+		if err != nil {
+			entry.Delete()
+			continue
+		}
+
+		if _, err := p.GetLobbyID(false); err == nil || p.IsBanned(player.BanJoin) {
+			// player joined a lobby on their own or got banned while queued
+			entry.Delete()
+			continue
+		}
+
+		if connected != nil && !connected(p) {
+			continue
+		}
+
+		candidates = append(candidates, &candidate{entry, p})
+	}
+
+	return candidates
+}
+
+//waiting lobbies, most filled first, so players are put in games that start sooner
+type byPlayers []*lobby.Lobby
+
+func (l byPlayers) Len() int           { return len(l) }
+func (l byPlayers) Less(i, j int) bool { return l[i].GetPlayerNumber() > l[j].GetPlayerNumber() }
+func (l byPlayers) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+func getWaitingLobbies(f format.Format, region string) []*lobby.Lobby {
+	var lobbies []*lobby.Lobby
+
+	for _, lob := range lobby.GetWaitingLobbies() {
+		//players in draft lobbies are picked by the captains
+		if lob.Type == f && lob.RegionCode == region && !lob.Draft {
+			lobbies = append(lobbies, lob)
+		}
+	}
+
+	sort.Stable(byPlayers(lobbies))
+	return lobbies
+}
+
+//Match puts players queued for the given format and region in lobby slots.
+//Existing waiting lobbies are filled first. If enough players are left to fill
+//a whole lobby, a new one is created on a free stored server in the region,
+//and returned as a NewLobby which still has to be set up.
+//connected is used to skip players who aren't online, and can be nil.
+func Match(f format.Format, region string, connected func(*player.Player) bool) ([]Placement, *NewLobby) {
+	var placements []Placement
+
+	candidates := getCandidates(f, region, connected)
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	for _, lob := range getWaitingLobbies(f, region) {
+		placed := fillLobby(lob, &candidates)
+		placements = append(placements, placed...)
+		if len(candidates) == 0 {
+			return placements, nil
+		}
+	}
+
+	assignment := assignSlots(f, candidates)
+	if assignment == nil {
+		return placements, nil
+	}
+
+	lob, err := newQueueLobby(f, region)
+	if err != nil {
+		logrus.Warning("queue: couldn't create lobby: ", err)
+		return placements, nil
+	}
+
+	//the players are taken out of the queue, so that they aren't matched
+	//again while the lobby's server is being set up
+	for _, c := range assignment {
+		c.entry.Delete()
+	}
+
+	return placements, &NewLobby{lob, assignment}
+}
+
+//Setup sets up the new lobby's server and puts the matched players in it. If the server
+//can't be set up, the lobby is deleted and the players are put back in the queue.
+func (n *NewLobby) Setup() ([]Placement, error) {
+	lob := n.Lobby
+
+	if err := lob.SetupServer(); err != nil {
+		lob.Delete()
+		for _, c := range n.assignment {
+			c.entry.requeue()
+		}
+		return nil, err
+	}
+	lob.SetState(lobby.Waiting, "matchmaking", 0)
+
+	var placements []Placement
+	for slot, c := range n.assignment {
+		//players who joined a lobby on their own in the meantime stay there
+		if _, err := c.player.GetLobbyID(false); err == nil {
+			continue
+		}
+
+		if err := lob.AddPlayer(c.player, slot, ""); err != nil {
+			logrus.Warningf("queue: couldn't add player %d to lobby %d: %s", c.player.ID, lob.ID, err.Error())
+			continue
+		}
+		placements = append(placements, Placement{lob, c.player, slot})
+	}
+
+	return placements, nil
+}
+
+//fillLobby puts candidates in the free slots of the given lobby, removing the
+//placed players from candidates
+func fillLobby(lob *lobby.Lobby, candidates *[]*candidate) []Placement {
+	var placements []Placement
+
+	for slot := 0; slot < format.NumberOfSlots(lob.Type); slot++ {
+		//reserved slots are kept for players from the previous lobby in rematches
+		if lob.IsSlotOccupied(slot) || lob.IsSlotReserved(slot) {
+			continue
+		}
+		_, class, _ := format.GetSlotTeamClass(lob.Type, slot)
+
+		for i, c := range *candidates {
+			if !c.entry.Wants(class) || !canPlay(lob, c.player, slot) {
+				continue
+			}
+
+			if err := lob.AddPlayer(c.player, slot, ""); err != nil {
+				continue
+			}
+
+			c.entry.Delete()
+			placements = append(placements, Placement{lob, c.player, slot})
+			*candidates = append((*candidates)[:i], (*candidates)[i+1:]...)
+			break
+		}
+	}
+
+	return placements
+}
+
+//assignSlots tries to give every slot in a lobby of format f to a different candidate,
+//respecting their class preferences. Returns nil if that isn't possible.
+func assignSlots(f format.Format, candidates []*candidate) map[int]*candidate {
+	slots := format.NumberOfSlots(f)
+	if len(candidates) < slots {
+		return nil
+	}
+
+	classes := make([]string, slots)
+	for slot := range classes {
+		_, classes[slot], _ = format.GetSlotTeamClass(f, slot)
+	}
+
+	// simple augmenting path bipartite matching between slots and candidates,
+	// candidates are tried in queue order.
+	owner := make(map[int]int) // candidate index -> slot
+	slotOwner := make([]int, slots)
+	for i := range slotOwner {
+		slotOwner[i] = -1
+	}
+
+	var augment func(slot int, seen map[int]bool) bool
+	augment = func(slot int, seen map[int]bool) bool {
+		for i, c := range candidates {
+			if seen[i] || !c.entry.Wants(classes[slot]) {
+				continue
+			}
+			seen[i] = true
+
+			prev, taken := owner[i]
+			if !taken || augment(prev, seen) {
+				owner[i] = slot
+				slotOwner[slot] = i
+				return true
+			}
+		}
+		return false
+	}
+
+	for slot := 0; slot < slots; slot++ {
+		if !augment(slot, make(map[int]bool)) {
+			return nil
+		}
+	}
+
+	assignment := make(map[int]*candidate)
+	for slot, i := range slotOwner {
+		assignment[slot] = candidates[i]
+	}
+
+	return assignment
+}
+
+//pickMap returns one of the most important maps for the format in the lobby settings
+func pickMap(f format.Format) (string, bool) {
+	d, ok := format.Get(f)
+	if !ok {
+		return "", false
+	}
+
+	var maps []string
+	best := -1
+
+	for _, m := range lobby.LobbyMaps {
+		for _, mf := range m.Formats {
+			if mf.Format.Name != d.Name {
+				continue
+			}
+
+			if mf.Importance > best {
+				best = mf.Importance
+				maps = maps[:0]
+			}
+			if mf.Importance == best {
+				maps = append(maps, m.Name)
+			}
+		}
+	}
+
+	if len(maps) == 0 {
+		return "", false
+	}
+
+	return maps[mrand.Intn(len(maps))], true
+}
+
+//pickLeague returns the first league (and a whitelist for it) in the lobby settings
+//that is used for the format
+func pickLeague(f format.Format) (league string, whitelist string) {
+	d, ok := format.Get(f)
+	if !ok {
+		return
+	}
+
+	for _, l := range lobby.LobbyLeagues {
+		for _, lf := range l.Formats {
+			if lf.Format.Name == d.Name && lf.Used {
+				league = l.Name
+				break
+			}
+		}
+		if league != "" {
+			break
+		}
+	}
+
+	for _, w := range lobby.LobbyWhitelists {
+		if w.League.Name == league && w.Format.Name == d.Name {
+			whitelist = strconv.Itoa(w.ID)
+			break
+		}
+	}
+
+	return
+}
+
+//newQueueLobby creates a new lobby for matched players on a free stored server in the region.
+//The lobby stays in the Initializing state till it's server has been set up.
+func newQueueLobby(f format.Format, region string) (*lobby.Lobby, error) {
+	mapName, ok := pickMap(f)
+	if !ok {
+		return nil, errors.New("No map found for the format")
+	}
+	league, whitelist := pickLeague(f)
+
+	provider, err := gameserver.GetProvider(gameserver.ProviderStored)
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := provider.Acquire(gameserver.ServerRequest{Region: region, Tags: f.Names()})
+	if err != nil {
+		return nil, ErrNoServer
+	}
+
+	randBytes := make([]byte, 6)
+	rand.Read(randBytes)
+
+	info := gameserver.ServerRecord{
+		ServerPassword: secret.String(base64.URLEncoding.EncodeToString(randBytes)),
+	}
+
+	lob := lobby.NewLobby(mapName, f, league, info, whitelist, false, "")
+	lob.SetServer(gameserver.ProviderStored, server)
+	lob.RegionCode, lob.RegionName = provider.Region(server)
+	lob.Save()
+	return lob, nil
+}
@@ -0,0 +1,169 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+//Package queue implements the matchmaking queue, where players wait to be
+//put in a lobby for a given format and region
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	db "github.com/TF2Stadium/Helen/database"
+	"github.com/TF2Stadium/Helen/models/lobby/format"
+	"github.com/TF2Stadium/Helen/models/player"
+)
+
+var (
+	ErrNoClasses     = errors.New("You need to pick at least one class")
+	ErrNoRegion      = errors.New("You need to pick a region")
+	ErrInLobby       = errors.New("You're already in a lobby")
+	ErrNotQueued     = errors.New("You aren't in the queue")
+	ErrInvalidFormat = errors.New("Invalid format")
+)
+
+//QueueEntry represents a player waiting in the matchmaking queue
+type QueueEntry struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+
+	PlayerID uint          `sql:"unique"`
+	Format   format.Format // format the player wants to play
+	Region   string        // region code ("na", "eu", etc)
+	Classes  string        // comma separated list of classes the player wants to play
+}
+
+//validClass returns true if class is a class in the given format, or a prefix for
+//numbered classes in it (like "scout" for "scout1" and "scout2" in 6s)
+func validClass(f format.Format, class string) bool {
+	for _, c := range format.GetClasses(f) {
+		if classMatches(class, c) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//classMatches returns true if the queued class pref can be used to fill a slot for class
+func classMatches(pref, class string) bool {
+	return pref == class || strings.TrimRight(class, "0123456789") == pref
+}
+
+//Join puts the given player in the queue for format f and region, replacing any
+//existing entry the player has.
+func Join(p *player.Player, f format.Format, region string, classes []string) (*QueueEntry, error) {
+	if len(format.GetClasses(f)) == 0 {
+		return nil, ErrInvalidFormat
+	}
+	if region == "" {
+		return nil, ErrNoRegion
+	}
+	if len(classes) == 0 {
+		return nil, ErrNoClasses
+	}
+
+	for _, class := range classes {
+		if !validClass(f, class) {
+			return nil, fmt.Errorf("%s isn't a class in %s", class, f)
+		}
+	}
+
+	if banned, until := p.IsBannedWithTime(player.BanJoin); banned {
+		return nil, fmt.Errorf("You have been banned from joining lobbies till %s", until.Format(time.RFC822))
+	}
+
+	if _, err := p.GetLobbyID(false); err == nil {
+		return nil, ErrInLobby
+	}
+
+	entry := &QueueEntry{
+		PlayerID: p.ID,
+		Format:   f,
+		Region:   region,
+		Classes:  strings.Join(classes, ","),
+	}
+
+	db.DB.Where("player_id = ?", p.ID).Delete(&QueueEntry{})
+	err := db.DB.Create(entry).Error
+	return entry, err
+}
+
+//Leave removes the given player from the queue
+func Leave(p *player.Player) error {
+	return db.DB.Where("player_id = ?", p.ID).Delete(&QueueEntry{}).Error
+}
+
+//GetEntry returns the queue entry for the given player
+func GetEntry(p *player.Player) (*QueueEntry, error) {
+	entry := &QueueEntry{}
+	err := db.DB.Where("player_id = ?", p.ID).First(entry).Error
+	if err != nil {
+		return nil, ErrNotQueued
+	}
+
+	return entry, nil
+}
+
+//GetEntries returns all queue entries for the given format and region, oldest first
+func GetEntries(f format.Format, region string) []*QueueEntry {
+	var entries []*QueueEntry
+	db.DB.Where("format = ? AND region = ?", f, region).Order("created_at, id").Find(&entries)
+	return entries
+}
+
+//Bucket is a format and region pair which has queued players
+type Bucket struct {
+	Format format.Format
+	Region string
+}
+
+//GetBuckets returns all format and region pairs which have at least one queued player
+func GetBuckets() []Bucket {
+	var buckets []Bucket
+
+	rows, err := db.DB.DB().Query("SELECT DISTINCT format, region FROM queue_entries")
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var b Bucket
+		rows.Scan(&b.Format, &b.Region)
+		buckets = append(buckets, b)
+	}
+
+	return buckets
+}
+
+//ClassList returns the list of classes the entry's player wants to play
+func (e *QueueEntry) ClassList() []string {
+	return strings.Split(e.Classes, ",")
+}
+
+//Wants returns true if the entry's player can be put in a slot for the given class
+func (e *QueueEntry) Wants(class string) bool {
+	for _, pref := range e.ClassList() {
+		if classMatches(pref, class) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Delete removes the entry from the queue
+func (e *QueueEntry) Delete() {
+	db.DB.Delete(e)
+}
+
+//requeue puts a deleted entry back in the queue, keeping it's place in it.
+//Nothing is changed if the player has joined the queue again in the meantime.
+func (e *QueueEntry) requeue() {
+	e.ID = 0
+	db.DB.Create(e)
+}
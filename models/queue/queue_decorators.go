@@ -0,0 +1,93 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package queue
+
+import (
+	"github.com/TF2Stadium/Helen/controllers/broadcaster"
+	db "github.com/TF2Stadium/Helen/database"
+	"github.com/TF2Stadium/Helen/models/player"
+)
+
+//Status is sent to players as queueStatus
+type Status struct {
+	Queued  bool     `json:"queued"`
+	Type    string   `json:"type,omitempty"`
+	Region  string   `json:"region,omitempty"`
+	Classes []string `json:"classes,omitempty"`
+	Players int      `json:"players"`         // number of players queued for the same format and region
+	Since   int64    `json:"since,omitempty"` // (Unix) timestamp at which the player joined the queue
+
+	LobbyID uint `json:"lobbyID,omitempty"` // lobby the player has been put in, if any
+	Slot    *int `json:"slot,omitempty"`
+}
+
+//DecorateStatus returns the queue status for the given entry
+func DecorateStatus(e *QueueEntry) Status {
+	var count int
+	db.DB.Model(&QueueEntry{}).Where("format = ? AND region = ?", e.Format, e.Region).Count(&count)
+
+	return decorateStatus(e, count)
+}
+
+//decorateStatus returns the queue status for the given entry, with count
+//players queued for it's format and region
+func decorateStatus(e *QueueEntry, count int) Status {
+	return Status{
+		Queued:  true,
+		Type:    e.Format.String(),
+		Region:  e.Region,
+		Classes: e.ClassList(),
+		Players: count,
+		Since:   e.CreatedAt.Unix(),
+	}
+}
+
+//DecoratePlacement returns the queue status for a player who has been put in a lobby
+func DecoratePlacement(pl Placement) Status {
+	slot := pl.Slot
+	return Status{
+		Type:    pl.Lobby.Type.String(),
+		Region:  pl.Lobby.RegionCode,
+		LobbyID: pl.Lobby.ID,
+		Slot:    &slot,
+	}
+}
+
+//BroadcastStatus sends the queue status to the given player
+func BroadcastStatus(p *player.Player) {
+	entry, err := GetEntry(p)
+	if err != nil {
+		broadcaster.SendMessage(p.SteamID, "queueStatus", Status{})
+		return
+	}
+
+	broadcaster.SendMessage(p.SteamID, "queueStatus", DecorateStatus(entry))
+}
+
+//BroadcastBucket sends the queue status to every player queued for the given bucket
+func BroadcastBucket(b Bucket) {
+	rows, err := db.DB.DB().Query(`SELECT queue_entries.created_at, queue_entries.classes, players.steam_id
+FROM queue_entries INNER JOIN players ON players.id = queue_entries.player_id
+WHERE queue_entries.format = $1 AND queue_entries.region = $2`, b.Format, b.Region)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	type queued struct {
+		entry   *QueueEntry
+		steamID string
+	}
+	var entries []queued
+	for rows.Next() {
+		q := queued{entry: &QueueEntry{Format: b.Format, Region: b.Region}}
+		rows.Scan(&q.entry.CreatedAt, &q.entry.Classes, &q.steamID)
+		entries = append(entries, q)
+	}
+
+	for _, q := range entries {
+		broadcaster.SendMessage(q.steamID, "queueStatus", decorateStatus(q.entry, len(entries)))
+	}
+}
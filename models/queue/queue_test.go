@@ -0,0 +1,83 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package queue_test
+
+import (
+	"testing"
+
+	_ "github.com/TF2Stadium/Helen/helpers"
+	"github.com/TF2Stadium/Helen/internal/testhelpers"
+	"github.com/TF2Stadium/Helen/models/lobby"
+	"github.com/TF2Stadium/Helen/models/lobby/format"
+	. "github.com/TF2Stadium/Helen/models/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	testhelpers.CleanupDB()
+}
+
+func TestJoinLeave(t *testing.T) {
+	t.Parallel()
+	p := testhelpers.CreatePlayer()
+
+	_, err := Join(p, format.Sixes, "eu", []string{})
+	assert.Equal(t, ErrNoClasses, err)
+	_, err = Join(p, format.Sixes, "", []string{"medic"})
+	assert.Equal(t, ErrNoRegion, err)
+	_, err = Join(p, format.Sixes, "eu", []string{"heavy"})
+	assert.Error(t, err)
+
+	entry, err := Join(p, format.Sixes, "eu", []string{"scout", "medic"})
+	assert.NoError(t, err)
+	assert.True(t, entry.Wants("scout2"))
+	assert.True(t, entry.Wants("medic"))
+	assert.False(t, entry.Wants("demoman"))
+
+	// joining again replaces the old entry
+	_, err = Join(p, format.Highlander, "eu", []string{"heavy"})
+	assert.NoError(t, err)
+	entry, err = GetEntry(p)
+	assert.NoError(t, err)
+	assert.Equal(t, format.Highlander, entry.Format)
+
+	assert.NoError(t, Leave(p))
+	_, err = GetEntry(p)
+	assert.Equal(t, ErrNotQueued, err)
+}
+
+func TestMatchFillsWaitingLobby(t *testing.T) {
+	t.Parallel()
+	lob := testhelpers.CreateLobby()
+	lob.RegionCode = "queue-test"
+	lob.Save()
+	lob.SetState(lobby.Waiting, "test", 0)
+	defer lob.Close(false, false, "test", 0)
+
+	medic := testhelpers.CreatePlayer()
+	demo := testhelpers.CreatePlayer()
+	_, err := Join(medic, format.Sixes, "queue-test", []string{"medic"})
+	assert.NoError(t, err)
+	_, err = Join(demo, format.Sixes, "queue-test", []string{"demoman"})
+	assert.NoError(t, err)
+
+	placements, created := Match(format.Sixes, "queue-test", nil)
+	assert.Nil(t, created)
+	assert.Len(t, placements, 2)
+
+	slot, err := lob.GetPlayerSlot(medic)
+	assert.NoError(t, err)
+	_, class, _ := format.GetSlotTeamClass(format.Sixes, slot)
+	assert.Equal(t, "medic", class)
+
+	slot, err = lob.GetPlayerSlot(demo)
+	assert.NoError(t, err)
+	_, class, _ = format.GetSlotTeamClass(format.Sixes, slot)
+	assert.Equal(t, "demoman", class)
+
+	// matched players are removed from the queue
+	_, err = GetEntry(medic)
+	assert.Equal(t, ErrNotQueued, err)
+}
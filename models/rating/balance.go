@@ -0,0 +1,52 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package rating
+
+import (
+	"math"
+)
+
+//Balance decides which pairs of players should be swapped between two teams, so that
+//the difference between the sum of ratings of each team is as small as possible.
+//red[i] and blu[i] are the ratings of the players playing the i-th class in each team,
+//and swap[i] is true if they should be swapped. When several assignments are equally
+//balanced, the one with the fewest swaps is picked.
+//
+//All assignments are tried, which is fine for the number of classes in TF2 formats.
+func Balance(red, blu []float64) (swap []bool) {
+	n := len(red)
+	if len(blu) < n {
+		n = len(blu)
+	}
+
+	var diff float64 // red - blu
+	for i := 0; i < n; i++ {
+		diff += red[i] - blu[i]
+	}
+
+	best, bestSwaps := math.Abs(diff), 0
+	bestMask := 0
+
+	for mask := 1; mask < 1<<uint(n); mask++ {
+		d := diff
+		swaps := 0
+		for i := 0; i < n; i++ {
+			if mask&(1<<uint(i)) != 0 {
+				d -= 2 * (red[i] - blu[i])
+				swaps++
+			}
+		}
+
+		if abs := math.Abs(d); abs < best || (abs == best && swaps < bestSwaps) {
+			best, bestSwaps, bestMask = abs, swaps, mask
+		}
+	}
+
+	swap = make([]bool, n)
+	for i := range swap {
+		swap[i] = bestMask&(1<<uint(i)) != 0
+	}
+	return swap
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+//Package rating implements the Glicko-2 rating system
+//(http://www.glicko.net/glicko/glicko2.pdf), used to rate players after each lobby.
+package rating
+
+import (
+	"math"
+)
+
+const (
+	DefaultRating     = 1500.0
+	DefaultRD         = 350.0
+	DefaultVolatility = 0.06
+
+	tau     = 0.5 // constrains the change in volatility over time
+	scale   = 173.7178
+	epsilon = 0.000001
+)
+
+//Rating is a player's (or a team's) Glicko-2 rating
+type Rating struct {
+	Rating     float64 `json:"rating"`
+	RD         float64 `json:"rd"` // rating deviation
+	Volatility float64 `json:"-"`
+}
+
+//Default returns the rating given to new players
+func Default() Rating {
+	return Rating{DefaultRating, DefaultRD, DefaultVolatility}
+}
+
+//Result is the outcome of a game against an opponent
+type Result struct {
+	Opponent Rating
+	Score    float64 // 1 for a win, 0.5 for a draw, 0 for a loss
+}
+
+//Scores for results
+const (
+	Loss = 0.0
+	Draw = 0.5
+	Win  = 1.0
+)
+
+func g(phi float64) float64 {
+	return 1 / math.Sqrt(1+3*phi*phi/(math.Pi*math.Pi))
+}
+
+func expected(mu, muj, phij float64) float64 {
+	return 1 / (1 + math.Exp(-g(phij)*(mu-muj)))
+}
+
+//Update returns the new rating after the given results in a rating period.
+//If there aren't any results, only the rating deviation increases.
+func (r Rating) Update(results []Result) Rating {
+	mu := (r.Rating - DefaultRating) / scale
+	phi := r.RD / scale
+	sigma := r.Volatility
+
+	if len(results) == 0 {
+		r.RD = math.Sqrt(phi*phi+sigma*sigma) * scale
+		return r
+	}
+
+	var vInv, sum float64
+	for _, res := range results {
+		muj := (res.Opponent.Rating - DefaultRating) / scale
+		phij := res.Opponent.RD / scale
+
+		e := expected(mu, muj, phij)
+		vInv += g(phij) * g(phij) * e * (1 - e)
+		sum += g(phij) * (res.Score - e)
+	}
+	v := 1 / vInv
+	delta := v * sum
+
+	sigma = newVolatility(sigma, phi, v, delta)
+
+	phiStar := math.Sqrt(phi*phi + sigma*sigma)
+	phi = 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+	mu += phi * phi * sum
+
+	return Rating{
+		Rating:     mu*scale + DefaultRating,
+		RD:         phi * scale,
+		Volatility: sigma,
+	}
+}
+
+//newVolatility finds the new volatility with the Illinois algorithm (step 5 of the paper)
+func newVolatility(sigma, phi, v, delta float64) float64 {
+	a := math.Log(sigma * sigma)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		d := phi*phi + v + ex
+		return ex*(delta*delta-phi*phi-v-ex)/(2*d*d) - (x-a)/(tau*tau)
+	}
+
+	A := a
+	var B float64
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*tau) < 0 {
+			k++
+		}
+		B = a - k*tau
+	}
+
+	fA, fB := f(A), f(B)
+	for math.Abs(B-A) > epsilon {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB < 0 {
+			A, fA = B, fB
+		} else {
+			fA /= 2
+		}
+		B, fB = C, fC
+	}
+
+	return math.Exp(A / 2)
+}
+
+//Team returns a single rating representing a team of players,
+//used as the opponent for players in the other team.
+func Team(ratings []Rating) Rating {
+	if len(ratings) == 0 {
+		return Default()
+	}
+
+	var team Rating
+	for _, r := range ratings {
+		team.Rating += r.Rating
+		team.RD += r.RD * r.RD
+		team.Volatility += r.Volatility
+	}
+
+	n := float64(len(ratings))
+	team.Rating /= n
+	team.RD = math.Sqrt(team.RD / n)
+	team.Volatility /= n
+	return team
+}
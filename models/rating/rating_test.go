@@ -0,0 +1,76 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package rating_test
+
+import (
+	"testing"
+
+	. "github.com/TF2Stadium/Helen/models/rating"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdate(t *testing.T) {
+	t.Parallel()
+
+	// example from the Glicko-2 paper
+	r := Rating{1500, 200, 0.06}
+	r = r.Update([]Result{
+		{Rating{1400, 30, 0.06}, Win},
+		{Rating{1550, 100, 0.06}, Loss},
+		{Rating{1700, 300, 0.06}, Loss},
+	})
+
+	assert.InDelta(t, 1464.06, r.Rating, 0.01)
+	assert.InDelta(t, 151.52, r.RD, 0.01)
+	assert.InDelta(t, 0.05999, r.Volatility, 0.00001)
+}
+
+func TestUpdateNoResults(t *testing.T) {
+	t.Parallel()
+
+	r := Rating{1500, 200, 0.06}.Update(nil)
+	assert.Equal(t, 1500.0, r.Rating)
+	assert.True(t, r.RD > 200)
+}
+
+func TestWinsAndLosses(t *testing.T) {
+	t.Parallel()
+
+	won := Default().Update([]Result{{Default(), Win}})
+	lost := Default().Update([]Result{{Default(), Loss}})
+	drew := Default().Update([]Result{{Default(), Draw}})
+
+	assert.True(t, won.Rating > DefaultRating)
+	assert.True(t, lost.Rating < DefaultRating)
+	assert.InDelta(t, DefaultRating, drew.Rating, 0.0001)
+	assert.InDelta(t, won.Rating-DefaultRating, DefaultRating-lost.Rating, 0.0001)
+}
+
+func TestTeam(t *testing.T) {
+	t.Parallel()
+
+	team := Team([]Rating{{1400, 30, 0.06}, {1600, 40, 0.06}})
+	assert.Equal(t, 1500.0, team.Rating)
+	assert.InDelta(t, 35.355, team.RD, 0.001)
+	assert.Equal(t, Default(), Team(nil))
+}
+
+func TestBalance(t *testing.T) {
+	t.Parallel()
+
+	// the best player is on red, swapping them balances the teams the most
+	swap := Balance([]float64{1800, 1600, 1520}, []float64{1500, 1500, 1500})
+	assert.Equal(t, []bool{true, false, false}, swap)
+
+	// already balanced teams aren't changed
+	swap = Balance([]float64{1600, 1400}, []float64{1400, 1600})
+	assert.Equal(t, []bool{false, false}, swap)
+
+	// swapping every pair is the same as not swapping any
+	swap = Balance([]float64{1500, 1500}, []float64{1500, 1500})
+	assert.Equal(t, []bool{false, false}, swap)
+
+	assert.Empty(t, Balance(nil, nil))
+}
@@ -5,6 +5,8 @@
 package rpc
 
 import (
+	"net/rpc"
+
 	"github.com/TF2Stadium/Helen/models/gameserver"
 	"github.com/TF2Stadium/Helen/models/lobby/format"
 )
@@ -65,11 +67,18 @@ func ReExecConfig(lobbyId uint, changeMap bool) error {
 	return pauling.Call("Pauling.ReExecConfig", &Args{Id: lobbyId, ChangeMap: changeMap}, &struct{}{})
 }
 
+//VerifyInfo checks that the server can be reached with the given RCON password.
+//Errors other than the ones returned by Pauling are returned as gameserver.UncheckedError.
 func VerifyInfo(info gameserver.ServerRecord) error {
 	if *paulingDisabled {
 		return nil
 	}
-	return pauling.Call("Pauling.VerifyInfo", &info, &struct{}{})
+
+	err := pauling.Call("Pauling.VerifyInfo", &info, &struct{}{})
+	if _, ok := err.(rpc.ServerError); err != nil && !ok {
+		return gameserver.UncheckedError{Err: err}
+	}
+	return err
 }
 
 func End(lobbyId uint) {
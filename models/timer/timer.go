@@ -0,0 +1,167 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+//Package timer implements timers which are stored in the database, so that they
+//survive restarts. Each timer has a name which refers to a function registered
+//with Register, and the lobby and player it was started for.
+package timer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	db "github.com/TF2Stadium/Helen/database"
+	"github.com/TF2Stadium/Helen/helpers"
+	"github.com/jinzhu/gorm"
+)
+
+//Timer is a pending call to a registered function
+type Timer struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+
+	Name     string `sql:"index"`
+	LobbyID  uint   `sql:"index"`
+	PlayerID uint
+	Deadline time.Time // time after which the function is called
+}
+
+//Func is called with the lobby and player ID the timer was started for
+type Func func(lobbyID, playerID uint)
+
+var (
+	funcs = make(map[string]Func)
+
+	timersMu = new(sync.Mutex)
+	timers   = make(map[uint]*time.Timer) // Timer ID -> armed timer
+	stopped  bool
+)
+
+//Register registers f to be called when timers with the given name expire.
+//It should be called from init functions, before any timers are restored.
+func Register(name string, f Func) {
+	if _, ok := funcs[name]; ok {
+		panic("timer: " + name + " registered twice")
+	}
+	funcs[name] = f
+}
+
+//AfterFunc calls the function registered with name after the duration has elapsed,
+//replacing any pending timer with the same name, lobby and player.
+func AfterFunc(name string, lobbyID, playerID uint, d time.Duration) error {
+	if _, ok := funcs[name]; !ok {
+		panic("timer: " + name + " isn't registered")
+	}
+
+	Stop(name, lobbyID, playerID)
+
+	t := &Timer{
+		Name:     name,
+		LobbyID:  lobbyID,
+		PlayerID: playerID,
+		Deadline: time.Now().Add(d),
+	}
+	if err := db.DB.Create(t).Error; err != nil {
+		return err
+	}
+
+	t.arm()
+	return nil
+}
+
+//Stop stops all pending timers with the given name, lobby and player.
+func Stop(name string, lobbyID, playerID uint) {
+	stop(db.DB.Where("name = ? AND lobby_id = ? AND player_id = ?", name, lobbyID, playerID))
+}
+
+//StopPlayer stops all pending timers with the given name for the player, regardless of lobby.
+func StopPlayer(name string, playerID uint) {
+	stop(db.DB.Where("name = ? AND player_id = ?", name, playerID))
+}
+
+func stop(query *gorm.DB) {
+	var ids []uint
+	query.Model(&Timer{}).Pluck("id", &ids)
+	if len(ids) == 0 {
+		return
+	}
+
+	db.DB.Where("id IN (?)", ids).Delete(&Timer{})
+
+	timersMu.Lock()
+	for _, id := range ids {
+		if armed, ok := timers[id]; ok {
+			armed.Stop()
+			delete(timers, id)
+		}
+	}
+	timersMu.Unlock()
+}
+
+//Restore arms all timers stored in the database. Timers which expired while
+//Helen wasn't running are called immediately.
+func Restore() {
+	var pending []*Timer
+	db.DB.Order("deadline").Find(&pending)
+
+	for _, t := range pending {
+		t.arm()
+	}
+	logrus.Infof("Restored %d timers", len(pending))
+}
+
+//StopAll disarms all timers without removing them from the database, so they
+//can be restored on the next start. Used when shutting down.
+func StopAll() {
+	timersMu.Lock()
+	defer timersMu.Unlock()
+
+	stopped = true
+	for id, armed := range timers {
+		armed.Stop()
+		delete(timers, id)
+	}
+}
+
+//GetPending returns all pending timers for the given lobby
+func GetPending(lobbyID uint) []*Timer {
+	var pending []*Timer
+	db.DB.Where("lobby_id = ?", lobbyID).Order("deadline").Find(&pending)
+	return pending
+}
+
+func (t *Timer) arm() {
+	timersMu.Lock()
+	defer timersMu.Unlock()
+
+	if stopped {
+		return
+	}
+
+	// negative durations fire immediately
+	timers[t.ID] = time.AfterFunc(t.Deadline.Sub(time.Now()), t.fire)
+}
+
+func (t *Timer) fire() {
+	timersMu.Lock()
+	delete(timers, t.ID)
+	timersMu.Unlock()
+
+	// only one process gets to delete the row, which makes sure the
+	// function is called once even if the timer was armed more than once
+	if db.DB.Where("id = ?", t.ID).Delete(&Timer{}).RowsAffected != 1 {
+		return
+	}
+
+	f, ok := funcs[t.Name]
+	if !ok {
+		logrus.Errorf("timer: no function registered for %s", t.Name)
+		return
+	}
+
+	helpers.GlobalWait.Add(1)
+	defer helpers.GlobalWait.Done()
+	f(t.LobbyID, t.PlayerID)
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2015  TF2Stadium
+// Use of this source code is governed by the GPLv3
+// that can be found in the COPYING file.
+
+package timer_test
+
+import (
+	"testing"
+	"time"
+
+	db "github.com/TF2Stadium/Helen/database"
+	"github.com/TF2Stadium/Helen/internal/testhelpers"
+	. "github.com/TF2Stadium/Helen/models/timer"
+	"github.com/stretchr/testify/assert"
+)
+
+type call struct {
+	lobbyID, playerID uint
+}
+
+var (
+	fired     = make(chan call, 10)
+	restored  = make(chan call, 10)
+	neverFire = make(chan call, 10)
+)
+
+func init() {
+	testhelpers.CleanupDB()
+
+	Register("test", func(lobbyID, playerID uint) { fired <- call{lobbyID, playerID} })
+	Register("testRestore", func(lobbyID, playerID uint) { restored <- call{lobbyID, playerID} })
+	Register("testStop", func(lobbyID, playerID uint) { neverFire <- call{lobbyID, playerID} })
+}
+
+func TestAfterFunc(t *testing.T) {
+	t.Parallel()
+
+	assert.NoError(t, AfterFunc("test", 1, 2, 10*time.Millisecond))
+	assert.Len(t, GetPending(1), 1)
+
+	select {
+	case c := <-fired:
+		assert.Equal(t, call{1, 2}, c)
+	case <-time.After(time.Second):
+		t.Fatal("timer didn't fire")
+	}
+	assert.Empty(t, GetPending(1))
+}
+
+func TestStop(t *testing.T) {
+	t.Parallel()
+
+	assert.NoError(t, AfterFunc("testStop", 3, 4, 10*time.Millisecond))
+	Stop("testStop", 3, 4)
+	assert.Empty(t, GetPending(3))
+
+	select {
+	case <-neverFire:
+		t.Fatal("stopped timer fired")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRestore(t *testing.T) {
+	t.Parallel()
+
+	// timer which expired while Helen wasn't running
+	db.DB.Create(&Timer{
+		Name:     "testRestore",
+		LobbyID:  5,
+		PlayerID: 6,
+		Deadline: time.Now().Add(-time.Minute),
+	})
+	Restore()
+
+	select {
+	case c := <-restored:
+		assert.Equal(t, call{5, 6}, c)
+	case <-time.After(time.Second):
+		t.Fatal("restored timer didn't fire")
+	}
+	assert.Empty(t, GetPending(5))
+}
@@ -40,7 +40,16 @@ var routes = []route{
 	{"/admin/server/", chelpers.FilterHTTPRequest(helpers.ModifyServers, admin.ViewServerPage)},
 	{"/admin/server/add", chelpers.FilterHTTPRequest(helpers.ModifyServers, admin.AddServer)},
 	{"/admin/server/remove", chelpers.FilterHTTPRequest(helpers.ModifyServers, admin.RemoveServer)},
+	{"/admin/server/update", chelpers.FilterHTTPRequest(helpers.ModifyServers, admin.UpdateServer)},
+	{"/admin/server/history", chelpers.FilterHTTPRequest(helpers.ModifyServers, admin.ViewServerHistory)},
 	{"/admin/lobbies", chelpers.FilterHTTPRequest(helpers.ActionViewLogs, admin.ViewOpenLobbies)},
+	{"/admin/lobbies/history", chelpers.FilterHTTPRequest(helpers.ActionViewLogs, admin.ViewLobbyHistory)},
+	{"/admin/reliability", chelpers.FilterHTTPRequest(helpers.ModifyReliability, admin.ViewReliability)},
+	{"/admin/reliability/update", chelpers.FilterHTTPRequest(helpers.ModifyReliability, admin.UpdateReliability)},
+	{"/admin/joinpolicy", chelpers.FilterHTTPRequest(helpers.ModifyJoinPolicy, admin.ViewJoinPolicy)},
+	{"/admin/joinpolicy/update", chelpers.FilterHTTPRequest(helpers.ModifyJoinPolicy, admin.UpdateJoinPolicy)},
+	{"/admin/events", chelpers.FilterHTTPRequest(helpers.ReplayEvents, admin.ViewDeadLetters)},
+	{"/admin/events/replay", chelpers.FilterHTTPRequest(helpers.ReplayEvents, admin.ReplayDeadLetter)},
 
 	{"/stats", stats.StatsHandler},
 	{"/badge/", controllers.TwitchBadge},
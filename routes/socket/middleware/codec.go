@@ -5,10 +5,43 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
 )
 
 type JSONCodec struct{}
 
+var (
+	validatorsMu = new(sync.RWMutex)
+	validators   = make(map[string]func(string) bool)
+)
+
+//RegisterValidator registers a function which can be used to check string fields,
+//by using the given name prefixed with '@' as the valid tag (like `valid:"@format"`).
+//This is used for fields whose valid values aren't known at compile time.
+func RegisterValidator(name string, f func(string) bool) {
+	validatorsMu.Lock()
+	validators[name] = f
+	validatorsMu.Unlock()
+}
+
+func isValid(validTag, value string) bool {
+	if strings.HasPrefix(validTag, "@") {
+		validatorsMu.RLock()
+		f, ok := validators[validTag[1:]]
+		validatorsMu.RUnlock()
+
+		return ok && f(value)
+	}
+
+	for _, valid := range strings.Split(validTag, ",") {
+		if value == valid {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (JSONCodec) ReadName(data []byte) string {
 	var body struct {
 		Request string
@@ -26,7 +59,6 @@ func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
 
 	stValue := reflect.Indirect(reflect.ValueOf(v))
 
-outer:
 	for i := 0; i < stValue.NumField(); i++ {
 		curField := stValue.Type().Field(i)
 		fieldPtrValue := stValue.Field(i) //The pointer field
@@ -53,20 +85,28 @@ outer:
 			continue
 		}
 
-		for _, valid := range strings.Split(validTag, ",") {
-			if reflect.DeepEqual(reflect.Indirect(fieldPtrValue).String(), valid) {
-				continue outer
-			}
+		if !isValid(validTag, reflect.Indirect(fieldPtrValue).String()) {
+			return fmt.Errorf("Field %s isn't valid.", curField.Name)
 		}
-		return fmt.Errorf("Field %s isn't valid.", curField.Name)
 	}
 
 	return nil
 }
 
+//detailedError is implemented by errors which carry more information for the client
+type detailedError interface {
+	Details() interface{}
+}
+
 func (JSONCodec) Error(err error) interface{} {
+	var details interface{}
+	if e, ok := err.(detailedError); ok {
+		details = e.Details()
+	}
+
 	return struct {
-		Message string `json:"message"`
-		Success bool   `json:"success"`
-	}{err.Error(), false}
+		Message string      `json:"message"`
+		Success bool        `json:"success"`
+		Details interface{} `json:"details,omitempty"`
+	}{err.Error(), false, details}
 }